@@ -0,0 +1,223 @@
+package infreqdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync/atomic"
+
+	"github.com/bluele/gcache"
+	"github.com/pkg/errors"
+)
+
+//BloomSuffix is appended to a partid to name its bloom filter sidecar in storage
+const BloomSuffix = ".bloom"
+
+//bloommagic starts every serialized filter
+var bloommagic = []byte("IFQB\x01")
+
+//bloomfilter holds the (bucket, key) pairs of a partition, top level buckets only.
+//A filter without bits can't rule anything out, it stands for a missing sidecar.
+type bloomfilter struct {
+	k    uint8
+	bits []uint64
+	//mutable filters are dropped by CheckExpiry
+	mutable bool
+}
+
+//newbloomfilter sizes a filter for n keys at a 1% false positive rate
+func newbloomfilter(n int) *bloomfilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(0.01) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	return &bloomfilter{k: 7, bits: make([]uint64, (m+63)/64)}
+}
+
+//bloomhash hashes bucket and key, the two halves seed double hashing
+func bloomhash(bucket, key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(bucket)))
+	h.Write(l[:])
+	h.Write(bucket)
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (bf *bloomfilter) add(bucket, key []byte) {
+	h1, h2 := bloomhash(bucket, key)
+	m := uint64(len(bf.bits)) * 64
+	for i := uint32(0); i < uint32(bf.k); i++ {
+		bit := uint64(h1+i*h2) % m
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+//has returns false only if bucket/key is certainly absent
+func (bf *bloomfilter) has(bucket, key []byte) bool {
+	if len(bf.bits) == 0 {
+		return true
+	}
+	h1, h2 := bloomhash(bucket, key)
+	m := uint64(len(bf.bits)) * 64
+	for i := uint32(0); i < uint32(bf.k); i++ {
+		bit := uint64(h1+i*h2) % m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//buildbloom computes the filter of a partition
+func buildbloom(r PartReader) (*bloomfilter, error) {
+	buckets, err := r.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, br := range buckets {
+		n += br.Keys
+	}
+	bf := newbloomfilter(n)
+	for _, br := range buckets {
+		name := []byte(br.Name)
+		err = r.Iterate([][]byte{name}, nil, nil, func(k, v []byte) error {
+			bf.add(name, k)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bf, nil
+}
+
+func (bf *bloomfilter) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.Write(bloommagic)
+	bw.WriteByte(bf.k)
+	binary.Write(bw, binary.BigEndian, uint64(len(bf.bits)))
+	binary.Write(bw, binary.BigEndian, bf.bits)
+	return bw.Flush()
+}
+
+func readbloom(r io.Reader) (*bloomfilter, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(bloommagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || !bytes.Equal(magic, bloommagic) {
+		return nil, errors.Wrap(ErrCorruptPartition, "bad bloom filter header")
+	}
+	bf := &bloomfilter{}
+	bf.k, err = br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var n uint64
+	err = binary.Read(br, binary.BigEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n > 1<<28 {
+		return nil, errors.Wrapf(ErrCorruptPartition, "bloom filter of %d words", n)
+	}
+	bf.bits = make([]uint64, n)
+	err = binary.Read(br, binary.BigEndian, bf.bits)
+	if err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+//WithBloomFilters makes SetPart store a bloom filter of every partition as a sidecar
+//and Get consult it before downloading a partition, so lookups of absent keys are cheap.
+//n is the number of filters kept in memory. Filters only cover top level buckets.
+//Filters of mutable partitions are fetched again after CheckExpiry, until then
+//keys added on other nodes may look absent.
+func WithBloomFilters(n int) Option {
+	return func(db *DB) {
+		db.filters = gcache.New(n).LRU().Build()
+	}
+}
+
+//putbloom builds and stores the filter of fname, built by engine
+func (db *DB) putbloom(partid, fname, engine string, mutable bool) error {
+	r, _, err := openpart(fname, engine, db.engines)
+	if err != nil {
+		return err
+	}
+	bf, err := buildbloom(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile("", "infreqdb-bloom-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	err = bf.writeTo(tmpfile)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return db.storage.Put(partid+BloomSuffix, tmpfile.Name(), mutable)
+}
+
+//getbloom returns the filter of partid, fetching it if needed.
+//A partition without a sidecar gets an empty filter that rules nothing out.
+func (db *DB) getbloom(partid string) (*bloomfilter, error) {
+	if v, err := db.filters.GetIFPresent(partid); err == nil {
+		return v.(*bloomfilter), nil
+	}
+	fname, found, mutable, _, err := db.storage.Get(partid + BloomSuffix)
+	if err != nil {
+		return nil, err
+	}
+	bf := &bloomfilter{mutable: true}
+	if found {
+		defer os.Remove(fname)
+		f, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		bf, err = readbloom(f)
+		if err != nil {
+			return nil, errors.Wrap(err, partid)
+		}
+		bf.mutable = mutable
+	}
+	db.filters.Set(partid, bf)
+	return bf, nil
+}
+
+//ruledout tells if the bloom filter of partid proves bucket/key absent.
+//Cached partitions are read directly, failing to get a filter just means downloading.
+func (db *DB) ruledout(partid string, bucket, key []byte) bool {
+	if db.filters == nil {
+		return false
+	}
+	if _, ok, _ := db.cached(partid); ok {
+		return false
+	}
+	bf, err := db.getbloom(partid)
+	if err != nil {
+		return false
+	}
+	if bf.has(bucket, key) {
+		return false
+	}
+	atomic.AddInt64(&db.stats.bloomSkips, 1)
+	return true
+}
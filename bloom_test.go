@@ -0,0 +1,146 @@
+package infreqdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := newbloomfilter(1000)
+	for i := 0; i < 1000; i++ {
+		bf.add([]byte("bucket"), []byte(fmt.Sprintf("key-%d", i)))
+	}
+	var buf bytes.Buffer
+	err := bf.writeTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf, err = readbloom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if !bf.has([]byte("bucket"), []byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d must be in the filter", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if bf.has([]byte("bucket"), []byte(fmt.Sprintf("other-%d", i))) {
+			fp++
+		}
+	}
+	if fp > 300 {
+		t.Errorf("false positive rate too high: %v of 10000", fp)
+	}
+	if _, err = readbloom(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("expected garbage to be rejected")
+	}
+}
+
+func TestBloomSkipsDownload(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	storage := &flakystorage{Storage: NewS3Storage(bucket, "/")}
+	db, err := NewWithStorage(storage, 10, WithBloomFilters(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("MyBucket"), []byte("answer"), []byte("42"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Get("part", []byte("MyBucket"), []byte("question"))
+	if err == nil {
+		t.Error("expected not found")
+	}
+	results, err := db.GetMulti(context.Background(), []Lookup{{"part", []byte("MyBucket"), []byte("nope")}})
+	if err != nil || results[0].Err == nil {
+		t.Errorf("expected not found, got %+v %v", results, err)
+	}
+	//Only the filter was downloaded
+	if storage.gets != 1 || db.Stats().BloomSkips != 2 {
+		t.Errorf("expected 1 download and 2 skips, got %v %+v", storage.gets, db.Stats())
+	}
+	v, err := db.Get("part", []byte("MyBucket"), []byte("answer"))
+	if err != nil || string(v) != "42" {
+		t.Errorf("expected 42, got %s %v", v, err)
+	}
+	//A new version replaces the filter
+	bld, _ = NewBuilder("part")
+	bld.Put([]byte("MyBucket"), []byte("question"), []byte("?"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = db.Get("part", []byte("MyBucket"), []byte("question"))
+	if err != nil || string(v) != "?" {
+		t.Errorf("expected ?, got %s %v", v, err)
+	}
+	//Sidecars are not partitions
+	entries, err := storage.Storage.(Lister).List("")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only the partition, got %+v %v", entries, err)
+	}
+	err = db.DeletePart("part")
+	if err != nil {
+		t.Error(err)
+	}
+	_, found, _ := storage.Stat("part" + BloomSuffix)
+	if found {
+		t.Error("sidecar must be deleted with its partition")
+	}
+}
+
+func TestBloomMultiErrors(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &flakystorage{Storage: NewS3Storage(bucket, "/")}
+	db, err := NewWithStorage(storage, 10, WithBloomFilters(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("MyBucket"), []byte("answer"), []byte("42"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.getbloom("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The partition can't be loaded, keys the filter answered are still answered
+	atomic.StoreInt32(&storage.broken, 1)
+	results, err := db.GetMulti(context.Background(), []Lookup{
+		{"part", []byte("MyBucket"), []byte("nope")},
+		{"part", []byte("MyBucket"), []byte("answer")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err == nil || !strings.Contains(results[0].Err.Error(), "not found") {
+		t.Errorf("expected not found, got %v", results[0].Err)
+	}
+	if results[1].Err == nil || !strings.Contains(results[1].Err.Error(), "S3 is down") {
+		t.Errorf("expected the load to fail, got %v", results[1].Err)
+	}
+}
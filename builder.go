@@ -0,0 +1,101 @@
+package infreqdb
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//Builder writes a partition into a local bolt file and uploads it on Commit.
+//It saves callers from managing temp files and bolt handles themselves.
+type Builder struct {
+	partid string
+	fname  string
+	bdb    *bolt.DB
+	//puts are buffered until Update or Commit writes them in one transaction
+	puts []deltaop
+}
+
+//NewBuilder creates a builder for partid backed by a fresh temp file
+func NewBuilder(partid string) (*Builder, error) {
+	tmpfile, err := ioutil.TempFile("", "infreqdb-build-")
+	if err != nil {
+		return nil, err
+	}
+	fname := tmpfile.Name()
+	tmpfile.Close()
+	bdb, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		os.Remove(fname)
+		return nil, err
+	}
+	return &Builder{partid: partid, fname: fname, bdb: bdb}, nil
+}
+
+//Partition returns the partid this builder writes
+func (b *Builder) Partition() string {
+	return b.partid
+}
+
+//Update runs fn inside a read-write transaction on the partition being built, after the puts
+//buffered so far. See https://godoc.org/github.com/boltdb/bolt#DB.Update for more info
+func (b *Builder) Update(fn func(*bolt.Tx) error) error {
+	err := b.bdb.Update(func(tx *bolt.Tx) error {
+		err := b.flush(tx)
+		if err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+	if err == nil {
+		b.puts = nil
+	}
+	return err
+}
+
+//Put stages a single key, creating bucket if needed. Puts are held in memory and
+//written in a single transaction by Commit, use Update for loads that don't fit.
+//The caller must not modify bucket, key or value afterwards.
+func (b *Builder) Put(bucket, key, value []byte) error {
+	b.puts = append(b.puts, deltaop{Bucket: bucket, Key: key, Value: value})
+	return nil
+}
+
+//flush writes the buffered puts in tx, they stay buffered in case tx is rolled back
+func (b *Builder) flush(tx *bolt.Tx) error {
+	for i := range b.puts {
+		err := b.puts[i].apply(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Commit uploads the partition using db.SetPart recording BoltEngine, replacing whatever was there.
+//The local file is removed afterwards, the builder must not be used again.
+func (b *Builder) Commit(db *DB, mutable bool) error {
+	defer os.Remove(b.fname)
+	err := b.close()
+	if err != nil {
+		return errors.Wrap(err, "Commit")
+	}
+	return db.setpart(b.partid, b.fname, mutable, BoltEngine.Name())
+}
+
+//close writes the buffered puts and closes the bolt file
+func (b *Builder) close() error {
+	err := b.bdb.Update(b.flush)
+	if cerr := b.bdb.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//Discard throws away the partition without uploading it
+func (b *Builder) Discard() error {
+	defer os.Remove(b.fname)
+	return b.bdb.Close()
+}
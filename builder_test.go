@@ -0,0 +1,47 @@
+package infreqdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBuilderPuts(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k1"), []byte("v1"))
+	//Buffered puts are seen by Update and kept if it fails
+	failed := errors.New("failed")
+	err = bld.Update(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("b")).Get([]byte("k1")); string(v) != "v1" {
+			t.Errorf("expected v1, got %q", v)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected %v, got %v", failed, err)
+	}
+	bld.Put([]byte("b"), []byte("k2"), []byte("v2"))
+	err = bld.Commit(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, expected := range map[string]string{"k1": "v1", "k2": "v2"} {
+		v, err := db.Get("part", []byte("b"), []byte(k))
+		if err != nil || string(v) != expected {
+			t.Errorf("expected %s, got %s %v", expected, v, err)
+		}
+	}
+}
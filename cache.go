@@ -1,54 +1,131 @@
 package infreqdb
 
 import (
-	"bytes"
-	"compress/gzip"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/goamz/goamz/s3"
+	"github.com/pkg/errors"
 )
 
 type cachepartition struct {
 	*sync.RWMutex
-	db           *bolt.DB
+	//r is nil if the partition does not exist
+	r            PartReader
+	engine       string
 	fname        string
 	lastModified time.Time
 	mutable      bool
+	//deltas is the number of the last delta applied on top of the file, made against generation deltagen
+	deltas   int
+	deltagen int64
+	//ranged partitions are read from storage in place, there is no file, see WithRangeReads
+	ranged bool
+	//refmu guards refs and evicted. Snapshots hold references,
+	//an evicted partition is closed once the last one is released.
+	refmu   sync.Mutex
+	refs    int
+	evicted bool
 }
 
 func (cp *cachepartition) view(fn func(*bolt.Tx) error) error {
-	//Locking... so we when we close bolt.DB there are no reads inflight
-	if cp.db == nil {
+	if cp.r == nil {
 		//cp would be nil if the partition did not exist
 		return nil
 	}
+	bv, ok := cp.r.(boltviewer)
+	if !ok {
+		return errors.Wrap(ErrNotBolt, cp.engine)
+	}
+	//Locking... so we when we close bolt.DB there are no reads inflight
 	cp.RLock()
 	defer cp.RUnlock()
-	return cp.db.View(fn)
+	return bv.View(fn)
 }
 
-func (cp *cachepartition) get(bucket, key []byte) (v []byte, err error) {
-	err = cp.view(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b == nil {
-			return fmt.Errorf("Bucket %s not found", bucket)
-		}
-		v = b.Get(key)
-		if v == nil {
-			return fmt.Errorf("Key %v not found in bucket %v", key, bucket)
-		}
+//read runs fn on the partition whatever its engine, fn is not called for missing partitions
+func (cp *cachepartition) read(fn func(PartReader) error) error {
+	if cp.r == nil {
 		return nil
+	}
+	cp.RLock()
+	defer cp.RUnlock()
+	return fn(cp.r)
+}
+
+//openfile opens the partition file, e.g. to send it to another node.
+//It stays readable after the partition is closed.
+func (cp *cachepartition) openfile() (*os.File, error) {
+	cp.RLock()
+	defer cp.RUnlock()
+	return os.Open(cp.fname)
+}
+
+func (cp *cachepartition) get(bucket, key []byte) (v []byte, err error) {
+	err = cp.read(func(r PartReader) error {
+		v, err = getkey(r, bucket, key)
+		return err
 	})
 	return
 }
 
+//getkey looks up key in a top level bucket
+func getkey(r PartReader, bucket, key []byte) ([]byte, error) {
+	v, err := r.Get([][]byte{bucket}, key)
+	if _, ok := err.(*BucketNotFoundError); ok {
+		return nil, fmt.Errorf("Bucket %s not found", bucket)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, errkeynotfound(bucket, key)
+	}
+	return v, nil
+}
+
+//errkeynotfound is what getkey returns for a missing key
+func errkeynotfound(bucket, key []byte) error {
+	return &causeerror{fmt.Sprintf("Key %v not found in bucket %v", key, bucket), ErrNotFound}
+}
+
+//retain takes a reference, false if the partition was already evicted
+func (cp *cachepartition) retain() bool {
+	cp.refmu.Lock()
+	defer cp.refmu.Unlock()
+	if cp.evicted {
+		return false
+	}
+	cp.refs++
+	return true
+}
+
+//release drops a reference, closing the partition if it was the last one of an evicted partition
+func (cp *cachepartition) release() {
+	cp.refmu.Lock()
+	cp.refs--
+	last := cp.refs == 0 && cp.evicted
+	cp.refmu.Unlock()
+	if last {
+		cp.close()
+	}
+}
+
+//evict closes the partition when it leaves the cache, unless it is still referenced
+func (cp *cachepartition) evict() {
+	cp.refmu.Lock()
+	cp.evicted = true
+	idle := cp.refs == 0
+	cp.refmu.Unlock()
+	if idle {
+		cp.close()
+	}
+}
+
 func (cp *cachepartition) close() error {
 	//Lock forever... no more reads here...
 	//Lock waits for all readers to finish...
@@ -56,17 +133,18 @@ func (cp *cachepartition) close() error {
 	if cp.fname != "" {
 		defer os.Remove(cp.fname)
 	}
-	if cp.db != nil {
-		return cp.db.Close()
+	if cp.r != nil {
+		return cp.r.Close()
 	}
 	return nil
 }
 
-func newcachepartition(part string, storage Storage) (*cachepartition, error) {
+//newcachepartition downloads part and opens it with the recorded engine, or the first of
+//engines recognizing it, nil engines are the defaults
+func newcachepartition(part string, storage Storage, engines []Engine) (*cachepartition, error) {
 	cp := &cachepartition{RWMutex: &sync.RWMutex{}}
 	//Download file from storage
-	fname, found, mutable, lastmod, err := storage.Get(part)
-
+	fname, found, mutable, lastmod, engine, err := getpartfile(part, storage)
 	if err != nil {
 		return nil, err
 	}
@@ -78,40 +156,39 @@ func newcachepartition(part string, storage Storage) (*cachepartition, error) {
 		return cp, nil
 	}
 	//Ok we have a partition
+	return opencachepartition(part, fname, engine, mutable, lastmod, engines)
+}
+
+//getpartfile downloads a partition, once more if it arrived corrupt
+func getpartfile(part string, storage Storage) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	fname, found, mutable, lastmod, engine, err = getengine(storage, part)
+	if errors.Cause(err) == ErrCorruptPartition {
+		//Might have been mangled in transit, give it one more go
+		log.Println("redownloading", part, err)
+		fname, found, mutable, lastmod, engine, err = getengine(storage, part)
+	}
+	return
+}
+
+//opencachepartition opens a downloaded partition file with engine, see openpart. The file is removed on failure.
+func opencachepartition(part, fname, engine string, mutable bool, lastmod time.Time, engines []Engine) (*cachepartition, error) {
+	cp := &cachepartition{RWMutex: &sync.RWMutex{}}
 	//Populate last-modified from header
 	cp.lastModified = lastmod
 	cp.fname = fname
 	st := time.Now()
-	cp.db, err = bolt.Open(cp.fname, os.ModeExclusive, &bolt.Options{
-		ReadOnly: true,
-	})
+	r, e, err := openpart(cp.fname, engine, engines)
 	if err != nil {
 		os.Remove(cp.fname)
-		return nil, err
+		return nil, errors.Wrap(err, part)
 	}
-	log.Println("loadedbolt ", part, time.Since(st))
+	cp.r, cp.engine = r, e.Name()
+	log.Println("loaded"+cp.engine, part, time.Since(st))
 	cp.mutable = mutable
 	return cp, nil
 }
 
+//upLoadCachePartition stores fname under key in bucket, bypassing the DB
 func upLoadCachePartition(key, fname string, bucket *s3.Bucket, mutable bool) error {
-	var network bytes.Buffer
-	//compress..
-	//Yikes in memory
-	gzrw := gzip.NewWriter(&network)
-	f, err := os.Open(fname)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = io.Copy(gzrw, f)
-	if err != nil {
-		return err
-	}
-	gzrw.Close()
-	hdr := make(http.Header)
-	if mutable {
-		hdr.Set("x-amz-meta-mutable", "yes")
-	}
-	return bucket.PutHeader(key, network.Bytes(), hdr, "")
+	return NewS3Storage(bucket, "").Put(key, fname, mutable)
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
 )
 
 func TestCache(t *testing.T) {
@@ -42,7 +43,7 @@ func TestCache(t *testing.T) {
 		t.Error(err)
 	}
 	//Try to load same partition
-	cp, err := newcachepartition(path, &S3Storage{bucket, ""})
+	cp, err := newcachepartition(path, NewS3Storage(bucket, ""), nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -59,7 +60,7 @@ func TestCache(t *testing.T) {
 	}
 	//Test closure
 	//Check file really exists
-	fname := cp.db.Path()
+	fname := cp.fname
 	_, err = os.Stat(fname)
 	if err != nil {
 		t.Error(err)
@@ -79,3 +80,33 @@ func TestCache(t *testing.T) {
 	}
 
 }
+
+//corruptonce fails the first Get with ErrCorruptPartition
+type corruptonce struct {
+	Storage
+	gets int
+}
+
+func (co *corruptonce) Get(part string) (string, bool, bool, time.Time, error) {
+	co.gets++
+	if co.gets == 1 {
+		return "", false, false, time.Time{}, errors.Wrap(ErrCorruptPartition, part)
+	}
+	return co.Storage.Get(part)
+}
+
+func TestCacheRedownload(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	co := &corruptonce{Storage: NewS3Storage(bucket, "")}
+	cp, err := newcachepartition("/foo/bar", co, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if co.gets != 2 {
+		t.Errorf("expected 2 downloads, got %v", co.gets)
+	}
+	cp.close()
+}
@@ -0,0 +1,591 @@
+package infreqdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//ClusterPath is where a Cluster expects to be mounted
+const ClusterPath = "/infreqdb/cluster/"
+
+//Cluster splits partitions between nodes, so the cache of each node only holds the
+//partitions it owns. Every partition is owned by replicas nodes picked by consistent hashing.
+//Reads of partitions owned elsewhere are forwarded to an owner, and when membership changes
+//cached partitions are handed off to their new owners.
+//Get, GetMulti, the path helpers and Exporter are forwarded. View, Snapshot and PartInfo
+//return a *NotOwnerError for partitions owned by other nodes, a bolt transaction can't be
+//run across the network.
+type Cluster struct {
+	self     string
+	replicas int
+	vnodes   int
+	client   *http.Client
+	mu       sync.RWMutex
+	ring     *Ring
+	db       *DB
+	secret   []byte
+}
+
+//NewCluster creates a Cluster, pass it to NewWithStorage using WithCluster and mount it at ClusterPath.
+//self and nodes are base urls like http://10.0.0.1:8080, self must be part of nodes and every
+//node must use the same list. replicas is the number of nodes caching each partition.
+func NewCluster(self string, nodes []string, replicas int) *Cluster {
+	if replicas < 1 {
+		replicas = 1
+	}
+	c := &Cluster{
+		self:     self,
+		replicas: replicas,
+		vnodes:   64,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+	c.ring = NewRing(nodes, c.vnodes)
+	return c
+}
+
+//WithCluster makes the DB cache only the partitions this node owns in c
+func WithCluster(c *Cluster) Option {
+	return func(db *DB) {
+		db.cluster = c
+		c.db = db
+	}
+}
+
+//SetSecret makes nodes sign forwarded reads and handoffs with an HMAC with secret,
+//unsigned requests are refused. Every node needs the same secret.
+func (c *Cluster) SetSecret(secret []byte) {
+	c.mu.Lock()
+	c.secret = append([]byte(nil), secret...)
+	c.mu.Unlock()
+}
+
+//getsecret returns the secret, nil if there is none
+func (c *Cluster) getsecret() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.secret
+}
+
+//Owners returns the nodes owning partid, primary first
+func (c *Cluster) Owners(partid string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Owners(partid, c.replicas)
+}
+
+//IsOwner tells if this node owns partid
+func (c *Cluster) IsOwner(partid string) bool {
+	owners := c.Owners(partid)
+	return len(owners) == 0 || contains(owners, c.self)
+}
+
+//SetNodes replaces the cluster membership. Cached partitions this node no longer owns
+//are sent to their new owners and evicted. To leave the cluster, call it without self.
+//Handoff is best effort, new owners load whatever they missed from storage.
+//Returns the first handoff error.
+func (c *Cluster) SetNodes(nodes []string) error {
+	ring := NewRing(nodes, c.vnodes)
+	c.mu.Lock()
+	c.ring = ring
+	c.mu.Unlock()
+	if c.db == nil {
+		return nil
+	}
+	var first error
+	for _, k := range c.db.cache.Keys() {
+		partid, ok := k.(string)
+		if !ok || c.IsOwner(partid) {
+			continue
+		}
+		err := c.handoff(partid)
+		if err != nil {
+			log.Println("handoff", partid, err)
+			if first == nil {
+				first = err
+			}
+		}
+		c.db.Expire(partid)
+	}
+	return first
+}
+
+//handoff sends cached partid to each of its owners
+func (c *Cluster) handoff(partid string) error {
+	cp, ok, err := c.db.cached(partid)
+	if err != nil || !ok || cp.r == nil || cp.ranged {
+		//Nothing worth sending, missing and ranged partitions are cheap to open again
+		return err
+	}
+	var first error
+	for _, owner := range c.Owners(partid) {
+		err := c.push(owner, partid, cp)
+		if err != nil && first == nil {
+			first = errors.Wrapf(err, "handoff to %s", owner)
+		}
+	}
+	return first
+}
+
+//push streams cp to node
+func (c *Cluster) push(node, partid string, cp *cachepartition) error {
+	f, err := cp.openfile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	secret := c.getsecret()
+	var sum string
+	if secret != nil {
+		//The signature covers the file, so it is read twice
+		h := sha256.New()
+		if _, err = io.Copy(h, f); err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+	}
+	req, err := http.NewRequest("PUT", node+ClusterPath+"handoff/"+url.QueryEscape(partid), f)
+	if err != nil {
+		return err
+	}
+	mutable := "no"
+	if cp.mutable {
+		mutable = "yes"
+	}
+	lastmod := cp.lastModified.Format(time.RFC3339Nano)
+	req.Header.Set(hdrMutable, mutable)
+	req.Header.Set(hdrLastMod, lastmod)
+	req.Header.Set(hdrEngine, cp.engine)
+	sign(req, secret, "handoff", partid, mutable, lastmod, cp.engine, sum)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+//rpclookup is a Lookup on the wire
+type rpclookup struct {
+	Partition string `json:"partition"`
+	Bucket    []byte `json:"bucket"`
+	Key       []byte `json:"key"`
+}
+
+//rpcresult is a Result on the wire
+type rpcresult struct {
+	Value []byte `json:"value,omitempty"`
+	Err   string `json:"err,omitempty"`
+	//Code is set when the cause of Err is one of rpccodes
+	Code string `json:"code,omitempty"`
+}
+
+//rpccodes are the errors callers tell apart with errors.Cause, they keep their identity across nodes
+var rpccodes = map[string]error{
+	"notfound": ErrNotFound,
+	"changed":  ErrPartitionChanged,
+}
+
+//rpcerror returns the message and code of err for the wire
+func rpcerror(err error) (msg, code string) {
+	cause := errors.Cause(err)
+	for code, sentinel := range rpccodes {
+		if cause == sentinel {
+			return err.Error(), code
+		}
+	}
+	return err.Error(), ""
+}
+
+//rpcunerror turns msg and code from the wire back into an error with the cause of code
+func rpcunerror(msg, code string) error {
+	if sentinel, ok := rpccodes[code]; ok {
+		return &causeerror{msg, sentinel}
+	}
+	return errors.New(msg)
+}
+
+//forward asks the owners of partid for lookups, trying them in order
+func (c *Cluster) forward(ctx context.Context, partid string, lookups []Lookup) ([]Result, error) {
+	req := make([]rpclookup, len(lookups))
+	for i, l := range lookups {
+		req[i] = rpclookup{l.Partition, l.Bucket, l.Key}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("no owner for %s", partid)
+	for _, owner := range c.Owners(partid) {
+		var results []Result
+		results, err = c.rpcget(ctx, owner, body)
+		if err == nil {
+			return results, nil
+		}
+		log.Println("forward", owner, partid, err)
+	}
+	return nil, errors.Wrapf(err, "forward %s", partid)
+}
+
+//post sends a signed json body to an endpoint of node, failing unless it answers 200
+func (c *Cluster) post(ctx context.Context, node, endpoint string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", node+ClusterPath+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	sign(req, c.getsecret(), endpoint, string(body))
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+//readbody reads the json body of a request from another node, checking its signature
+func (c *Cluster) readbody(w http.ResponseWriter, r *http.Request, endpoint string) ([]byte, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if !verify(r, c.getsecret(), endpoint, string(body)) {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+//rpcget posts encoded lookups to node
+func (c *Cluster) rpcget(ctx context.Context, node string, body []byte) ([]Result, error) {
+	resp, err := c.post(ctx, node, "get", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var rpcresults []rpcresult
+	err = json.NewDecoder(resp.Body).Decode(&rpcresults)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(rpcresults))
+	for i, r := range rpcresults {
+		results[i].Value = r.Value
+		if r.Err != "" {
+			results[i].Err = rpcunerror(r.Err, r.Code)
+		}
+	}
+	return results, nil
+}
+
+//ServeHTTP answers forwarded reads and handoffs from other nodes
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case c.db == nil:
+		http.Error(w, "no DB attached", http.StatusServiceUnavailable)
+	case r.Method == "POST" && path == ClusterPath+"get":
+		c.serveget(w, r)
+	case r.Method == "POST" && path == ClusterPath+"read":
+		c.serveread(w, r)
+	case r.Method == "PUT" && strings.HasPrefix(path, ClusterPath+"handoff/"):
+		partid, err := url.QueryUnescape(strings.TrimPrefix(path, ClusterPath+"handoff/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.servehandoff(w, r, partid)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//serveget does forwarded lookups, but only in partitions we own so
+//nodes that disagree on membership can't bounce requests between each other
+func (c *Cluster) serveget(w http.ResponseWriter, r *http.Request) {
+	body, ok := c.readbody(w, r, "get")
+	if !ok {
+		return
+	}
+	var req []rpclookup
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lookups := make([]Lookup, len(req))
+	for i, l := range req {
+		if !c.IsOwner(l.Partition) {
+			http.Error(w, (&NotOwnerError{l.Partition, c.Owners(l.Partition)}).Error(), http.StatusConflict)
+			return
+		}
+		lookups[i] = Lookup{l.Partition, l.Bucket, l.Key}
+	}
+	results, err := c.db.GetMulti(r.Context(), lookups)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	resp := make([]rpcresult, len(results))
+	for i, res := range results {
+		resp[i].Value = res.Value
+		if res.Err != nil {
+			resp[i].Err, resp[i].Code = rpcerror(res.Err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("cluster get", err)
+	}
+}
+
+//servehandoff caches a partition another node handed to us
+func (c *Cluster) servehandoff(w http.ResponseWriter, r *http.Request, partid string) {
+	if !c.IsOwner(partid) {
+		http.Error(w, (&NotOwnerError{partid, c.Owners(partid)}).Error(), http.StatusConflict)
+		return
+	}
+	lastmod, err := time.Parse(time.RFC3339Nano, r.Header.Get(hdrLastMod))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tmpfile, err := ioutil.TempFile("", "infreqdb-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpfile, h), r.Body)
+	tmpfile.Close()
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret := c.getsecret()
+	if !verify(r, secret, "handoff", partid, r.Header.Get(hdrMutable), r.Header.Get(hdrLastMod), r.Header.Get(hdrEngine), hex.EncodeToString(h.Sum(nil))) {
+		os.Remove(tmpfile.Name())
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	err = c.db.adopt(partid, tmpfile.Name(), r.Header.Get(hdrEngine), r.Header.Get(hdrMutable) == "yes", lastmod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//rpcread is a read of a partition on the wire, Op is get, iterate or buckets
+type rpcread struct {
+	Partition string   `json:"partition"`
+	Op        string   `json:"op"`
+	Path      [][]byte `json:"path,omitempty"`
+	Key       []byte   `json:"key,omitempty"`
+	Start     []byte   `json:"start,omitempty"`
+	End       []byte   `json:"end,omitempty"`
+}
+
+//rpcrecord is one line of the answer to an rpcread, the last one has Done set
+type rpcrecord struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	//Found tells an empty value from a missing key or a nested bucket
+	Found   bool          `json:"found,omitempty"`
+	Buckets []BucketRange `json:"buckets,omitempty"`
+	Done    bool          `json:"done,omitempty"`
+	Err     string        `json:"err,omitempty"`
+	Code    string        `json:"code,omitempty"`
+	//Missing is set when the partition does not exist
+	Missing bool `json:"missing,omitempty"`
+	//NoBucket is the depth of a *BucketNotFoundError plus one
+	NoBucket int `json:"nobucket,omitempty"`
+}
+
+//errremotemissing stops fn of DB.readpart when a forwarded partition does not exist
+var errremotemissing = errors.New("partition does not exist")
+
+//forwardread runs fn of DB.readpart on a partition owned by other nodes
+func (c *Cluster) forwardread(partid string, fn func(PartReader) error) error {
+	err := fn(&remotereader{c: c, partid: partid})
+	if errors.Cause(err) == errremotemissing {
+		//Same as readpart, fn is not called for missing partitions
+		return nil
+	}
+	return err
+}
+
+//remotereader is a PartReader reading a partition on its owners
+type remotereader struct {
+	c      *Cluster
+	partid string
+}
+
+//read sends req to the owners of the partition in order, fn gets every record but the last
+func (rr *remotereader) read(req rpcread, fn func(rec *rpcrecord) error) error {
+	req.Partition = rr.partid
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var resp *http.Response
+	err = fmt.Errorf("no owner for %s", rr.partid)
+	for _, owner := range rr.c.Owners(rr.partid) {
+		resp, err = rr.c.post(context.Background(), owner, "read", body)
+		if err == nil {
+			break
+		}
+		log.Println("forward", owner, rr.partid, err)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "forward %s", rr.partid)
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var rec rpcrecord
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			return errors.Wrapf(io.ErrUnexpectedEOF, "forward %s", rr.partid)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "forward %s", rr.partid)
+		}
+		switch {
+		case !rec.Done:
+			if err = fn(&rec); err != nil {
+				return err
+			}
+		case rec.Missing:
+			return errremotemissing
+		case rec.NoBucket > 0:
+			return &BucketNotFoundError{Path: req.Path, Depth: rec.NoBucket - 1}
+		case rec.Err != "":
+			return rpcunerror(rec.Err, rec.Code)
+		default:
+			return nil
+		}
+	}
+}
+
+func (rr *remotereader) Get(path [][]byte, key []byte) (v []byte, err error) {
+	err = rr.read(rpcread{Op: "get", Path: path, Key: key}, func(rec *rpcrecord) error {
+		if rec.Found {
+			v = append([]byte{}, rec.Value...)
+		}
+		return nil
+	})
+	return
+}
+
+func (rr *remotereader) Iterate(path [][]byte, start, end []byte, fn func(k, v []byte) error) error {
+	return rr.read(rpcread{Op: "iterate", Path: path, Start: start, End: end}, func(rec *rpcrecord) error {
+		if rec.Found && rec.Value == nil {
+			rec.Value = []byte{}
+		}
+		return fn(rec.Key, rec.Value)
+	})
+}
+
+func (rr *remotereader) Buckets() (buckets []BucketRange, err error) {
+	err = rr.read(rpcread{Op: "buckets"}, func(rec *rpcrecord) error {
+		buckets = rec.Buckets
+		return nil
+	})
+	return
+}
+
+//Size is unknown for forwarded partitions
+func (rr *remotereader) Size() int64 {
+	return 0
+}
+
+func (rr *remotereader) Close() error {
+	return nil
+}
+
+//serveread does a forwarded read of a partition we own, one json record per key.
+//Records are buffered and sent once the partition is released, so a slow reader
+//doesn't hold it open and block Expire.
+func (c *Cluster) serveread(w http.ResponseWriter, r *http.Request) {
+	body, ok := c.readbody(w, r, "read")
+	if !ok {
+		return
+	}
+	var req rpcread
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.IsOwner(req.Partition) {
+		http.Error(w, (&NotOwnerError{req.Partition, c.Owners(req.Partition)}).Error(), http.StatusConflict)
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	found := false
+	err = c.db.readpart(req.Partition, func(pr PartReader) error {
+		found = true
+		switch req.Op {
+		case "get":
+			v, err := pr.Get(req.Path, req.Key)
+			if err != nil {
+				return err
+			}
+			return enc.Encode(rpcrecord{Value: v, Found: v != nil})
+		case "iterate":
+			return pr.Iterate(req.Path, req.Start, req.End, func(k, v []byte) error {
+				return enc.Encode(rpcrecord{Key: k, Value: v, Found: v != nil})
+			})
+		case "buckets":
+			buckets, err := pr.Buckets()
+			if err != nil {
+				return err
+			}
+			return enc.Encode(rpcrecord{Buckets: buckets})
+		}
+		return fmt.Errorf("unknown op %q", req.Op)
+	})
+	last := rpcrecord{Done: true, Missing: !found && err == nil}
+	if bnf, ok := err.(*BucketNotFoundError); ok {
+		last.NoBucket = bnf.Depth + 1
+	} else if err != nil {
+		last.Err, last.Code = rpcerror(err)
+	}
+	err = enc.Encode(last)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_, err = buf.WriteTo(w)
+	}
+	if err != nil {
+		log.Println("cluster read", err)
+	}
+}
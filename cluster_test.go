@@ -0,0 +1,182 @@
+package infreqdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCluster(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	upstream := &flakystorage{Storage: NewS3Storage(bucket, "/")}
+	var handlers [3]http.Handler
+	var urls []string
+	for i := range handlers {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	var clusters []*Cluster
+	var dbs []*DB
+	for i := range handlers {
+		c := NewCluster(urls[i], urls, 1)
+		c.SetSecret([]byte("s3cret"))
+		db, err := NewWithStorage(upstream, 10, WithCluster(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		handlers[i] = c
+		clusters = append(clusters, c)
+		dbs = append(dbs, db)
+	}
+	var parts []string
+	for i := 0; i < 6; i++ {
+		partid := fmt.Sprintf("part-%d", i)
+		parts = append(parts, partid)
+		bld, err := NewBuilder(partid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bld.Put([]byte("MyBucket"), []byte("answer"), []byte(partid))
+		bld.Put([]byte("MyBucket"), []byte("empty"), []byte{})
+		err = bld.Commit(dbs[0], true)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	//Every node reads every partition, only owners download
+	for _, db := range dbs {
+		for _, partid := range parts {
+			v, err := db.Get(partid, []byte("MyBucket"), []byte("answer"))
+			if err != nil || string(v) != partid {
+				t.Errorf("expected %v, got %s %v", partid, v, err)
+			}
+		}
+		results, err := db.GetMulti(context.Background(), []Lookup{
+			{parts[0], []byte("MyBucket"), []byte("answer")},
+			{parts[1], []byte("MyBucket"), []byte("nokey")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		//Forwarded or not, a missing key is still ErrNotFound
+		if string(results[0].Value) != parts[0] || errors.Cause(results[1].Err) != ErrNotFound {
+			t.Errorf("unexpected results %+v", results)
+		}
+	}
+	if int(upstream.gets) != len(parts) {
+		t.Errorf("expected %v upstream downloads, got %v", len(parts), upstream.gets)
+	}
+	owned := make(map[string]int)
+	for i, db := range dbs {
+		for _, partid := range parts {
+			_, cached, _ := db.cached(partid)
+			if cached != clusters[i].IsOwner(partid) {
+				t.Errorf("node %v: %v cached %v, owner %v", i, partid, cached, clusters[i].IsOwner(partid))
+			}
+			if cached {
+				owned[partid] = i
+			}
+		}
+	}
+	_, err = dbs[0].View(parts[0], noview)
+	if _, ok := err.(*NotOwnerError); !ok && !clusters[0].IsOwner(parts[0]) {
+		t.Errorf("expected NotOwnerError, got %v", err)
+	}
+	//Path helpers are forwarded too
+	for _, db := range dbs {
+		for _, partid := range parts {
+			v, err := db.GetPath(partid, [][]byte{[]byte("MyBucket")}, []byte("answer"))
+			if err != nil || string(v) != partid {
+				t.Errorf("expected %v, got %s %v", partid, v, err)
+			}
+			var keys []string
+			err = db.RangePath(partid, [][]byte{[]byte("MyBucket")}, nil, nil, func(k, v []byte) error {
+				if v == nil {
+					return fmt.Errorf("%s is not a bucket", k)
+				}
+				keys = append(keys, string(k))
+				return nil
+			})
+			if err != nil || fmt.Sprint(keys) != "[answer empty]" {
+				t.Errorf("expected 2 keys, got %v %v", keys, err)
+			}
+		}
+		_, err = db.GetPath(parts[0], [][]byte{[]byte("nobucket")}, []byte("answer"))
+		if _, ok := err.(*BucketNotFoundError); !ok {
+			t.Errorf("expected BucketNotFoundError, got %v", err)
+		}
+	}
+	//Nodes without the secret are refused
+	stranger := NewCluster(urls[0], urls, 1)
+	_, err = stranger.forward(context.Background(), parts[0], []Lookup{{parts[0], []byte("MyBucket"), []byte("answer")}})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401, got %v", err)
+	}
+	mine := ""
+	for i := 0; !clusters[0].IsOwner(mine); i++ {
+		mine = fmt.Sprintf("mine-%d", i)
+	}
+	req, _ := http.NewRequest("PUT", urls[0]+ClusterPath+"handoff/"+mine, strings.NewReader("junk"))
+	req.Header.Set(hdrMutable, "yes")
+	req.Header.Set(hdrLastMod, time.Now().Format(time.RFC3339Nano))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unsigned handoff to be refused, got %v %v", resp, err)
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+	//Node 2 leaves, its partitions are handed off
+	for _, i := range []int{0, 1, 2} {
+		err = clusters[i].SetNodes(urls[:2])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for partid, i := range owned {
+		if i != 2 {
+			continue
+		}
+		for j, db := range dbs[:2] {
+			_, cached, _ := db.cached(partid)
+			if cached != clusters[j].IsOwner(partid) {
+				t.Errorf("node %v: %v cached %v after handoff", j, partid, cached)
+			}
+		}
+		_, cached, _ := dbs[2].cached(partid)
+		if cached {
+			t.Errorf("%v still cached on node that left", partid)
+		}
+	}
+	for _, db := range dbs[:2] {
+		for _, partid := range parts {
+			v, err := db.Get(partid, []byte("MyBucket"), []byte("answer"))
+			if err != nil || string(v) != partid {
+				t.Errorf("expected %v, got %s %v", partid, v, err)
+			}
+		}
+	}
+	if int(upstream.gets) != len(parts) {
+		t.Errorf("handoff must not download again, got %v downloads", upstream.gets)
+	}
+	for _, db := range dbs[:2] {
+		v, err := db.GetPath("missing", [][]byte{[]byte("MyBucket")}, []byte("answer"))
+		if err != nil || v != nil {
+			t.Errorf("expected nothing, got %s %v", v, err)
+		}
+	}
+}
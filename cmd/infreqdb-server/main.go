@@ -0,0 +1,89 @@
+//Command infreqdb-server serves an infreqdb DB over HTTP for services that can't embed the library.
+//
+//	GET  /parts/{partid}/buckets/{bucket}/keys/{key}   raw value
+//	GET  /parts/{partid}/buckets/{bucket}/keys         listing, see ?prefix= ?start= ?end= ?limit= ?values=
+//	GET  /parts/{partid}                               partition metadata
+//	POST /parts/{partid}/expire                        evict the partition from the cache
+//	GET  /stats                                        cache and storage counters
+//
+//Path elements are query escaped, e.g. a partid foo/bar is requested as /parts/foo%2Fbar.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/onrik/logrus/filename"
+	"github.com/turbobytes/infreqdb"
+)
+
+var (
+	listen       = flag.String("listen", ":8080", "address to serve on")
+	storageType  = flag.String("storage", "s3", "storage backend: s3 or file")
+	prefix       = flag.String("prefix", "", "prefix for all s3 keys")
+	s3bucketName = flag.String("s3bucket", "", "S3 bucket name, for s3 storage")
+	s3region     = flag.String("s3region", "", "S3 region name, for s3 storage")
+	dir          = flag.String("dir", "", "directory holding partitions, for file storage")
+	cacheSize    = flag.Int("cache", 100, "number of partitions to cache on disk")
+	checkExpiry  = flag.Duration("checkexpiry", time.Minute, "how often to look for changed partitions, 0 disables")
+	maxList      = flag.Int("maxlist", 10000, "maximum number of keys returned by a listing")
+)
+
+//newstorage builds the storage backend chosen by flags
+func newstorage() (infreqdb.Storage, error) {
+	switch *storageType {
+	case "s3":
+		if *s3bucketName == "" {
+			log.Fatal("Bucket name must be provided")
+		}
+		if *s3region == "" {
+			log.Fatal("Region name must be provided")
+		}
+		auth, err := aws.EnvAuth()
+		if err != nil {
+			return nil, err
+		}
+		region, ok := aws.Regions[*s3region]
+		if !ok {
+			log.Fatalf("Region %v not found", *s3region)
+		}
+		return infreqdb.NewS3Storage(s3.New(auth, region).Bucket(*s3bucketName), *prefix), nil
+	case "file":
+		if *dir == "" {
+			log.Fatal("Directory must be provided")
+		}
+		return infreqdb.NewFileStorage(*dir)
+	}
+	log.Fatalf("Unknown storage %v", *storageType)
+	return nil, nil
+}
+
+func main() {
+	log.AddHook(filename.NewHook())
+	flag.Parse()
+	storage, err := newstorage()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := infreqdb.NewWithStorage(storage, *cacheSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if *checkExpiry > 0 {
+		go func() {
+			for range time.Tick(*checkExpiry) {
+				report := db.CheckExpiry()
+				if len(report.Expired) > 0 || len(report.Deleted) > 0 {
+					log.Println("expired", report.Expired, "deleted", report.Deleted)
+				}
+			}
+		}()
+	}
+	log.Println("listening on", *listen)
+	log.Fatal(http.ListenAndServe(*listen, &server{db: db, maxList: *maxList}))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/turbobytes/infreqdb"
+)
+
+//server exposes a DB over HTTP
+type server struct {
+	db *infreqdb.DB
+	//maxList caps the number of keys of a listing
+	maxList int
+}
+
+//entry is one key of a listing, []byte is base64 in json
+type entry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+//listing is the response of a key listing
+type listing struct {
+	Keys []entry `json:"keys"`
+	//Next is the start of the next page, empty on the last page
+	Next []byte `json:"next,omitempty"`
+}
+
+//errStop ends a listing early
+var errStop = errors.New("stop")
+
+//splitpath unescapes the elements of an escaped url path
+func splitpath(path string) ([]string, error) {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	for i, seg := range segs {
+		var err error
+		segs[i], err = url.QueryUnescape(seg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return segs, nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs, err := splitpath(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var method string
+	var handle func()
+	switch {
+	case len(segs) == 1 && segs[0] == "stats":
+		method, handle = "GET", func() { s.writejson(w, http.StatusOK, s.db.Stats()) }
+	case len(segs) == 2 && segs[0] == "parts":
+		method, handle = "GET", func() { s.partinfo(w, segs[1]) }
+	case len(segs) == 3 && segs[0] == "parts" && segs[2] == "expire":
+		method, handle = "POST", func() {
+			s.db.Expire(segs[1])
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case len(segs) == 5 && segs[0] == "parts" && segs[2] == "buckets" && segs[4] == "keys":
+		method, handle = "GET", func() { s.list(w, r, segs[1], segs[3]) }
+	case len(segs) == 6 && segs[0] == "parts" && segs[2] == "buckets" && segs[4] == "keys":
+		method, handle = "GET", func() { s.get(w, segs[1], segs[3], segs[5]) }
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, method+" only", http.StatusMethodNotAllowed)
+		return
+	}
+	handle()
+}
+
+//get writes a single value
+func (s *server) get(w http.ResponseWriter, partid, bucket, key string) {
+	var value []byte
+	found := false
+	mutable, err := s.db.ReadPart(partid, func(r infreqdb.PartReader) error {
+		found = true
+		var err error
+		value, err = r.Get([][]byte{[]byte(bucket)}, []byte(key))
+		return err
+	})
+	if err != nil {
+		//A missing bucket too
+		s.error(w, err)
+		return
+	}
+	if !found || value == nil {
+		missing := "key"
+		if !found {
+			missing = "partition"
+		}
+		http.Error(w, missing+" not found", http.StatusNotFound)
+		return
+	}
+	setcachecontrol(w, mutable)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.Write(value)
+}
+
+//list writes keys of a bucket as json, filtered by the prefix or start and end query parameters.
+//limit caps the number of keys, values=false leaves out values.
+func (s *server) list(w http.ResponseWriter, r *http.Request, partid, bucket string) {
+	q := r.URL.Query()
+	limit := s.maxList
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	values := q.Get("values") != "false"
+	resp := listing{Keys: []entry{}}
+	fn := func(k, v []byte) error {
+		if len(resp.Keys) == limit {
+			resp.Next = append([]byte(nil), k...)
+			return errStop
+		}
+		e := entry{Key: append([]byte(nil), k...)}
+		if values {
+			e.Value = append([]byte{}, v...)
+		}
+		resp.Keys = append(resp.Keys, e)
+		return nil
+	}
+	path := [][]byte{[]byte(bucket)}
+	var err error
+	if _, ok := q["prefix"]; ok {
+		prefix := []byte(q.Get("prefix"))
+		if start := q.Get("start"); start > string(prefix) {
+			//Continuing a paged prefix listing
+			err = s.db.RangePath(partid, path, []byte(start), nil, func(k, v []byte) error {
+				if !strings.HasPrefix(string(k), string(prefix)) {
+					return errStop
+				}
+				return fn(k, v)
+			})
+		} else {
+			err = s.db.PrefixPath(partid, path, prefix, fn)
+		}
+	} else {
+		var start, end []byte
+		if _, ok := q["start"]; ok {
+			start = []byte(q.Get("start"))
+		}
+		if _, ok := q["end"]; ok {
+			end = []byte(q.Get("end"))
+		}
+		err = s.db.RangePath(partid, path, start, end, fn)
+	}
+	if err != nil && err != errStop {
+		s.error(w, err)
+		return
+	}
+	s.writejson(w, http.StatusOK, resp)
+}
+
+//partinfo writes partition metadata
+func (s *server) partinfo(w http.ResponseWriter, partid string) {
+	info, err := s.db.PartInfo(partid)
+	if err != nil {
+		s.error(w, err)
+		return
+	}
+	status := http.StatusOK
+	if !info.Found {
+		status = http.StatusNotFound
+	}
+	s.writejson(w, status, info)
+}
+
+//setcachecontrol lets http caches keep values of immutable partitions
+func setcachecontrol(w http.ResponseWriter, mutable bool) {
+	if mutable {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+}
+
+//error maps DB errors to status codes
+func (s *server) error(w http.ResponseWriter, err error) {
+	switch errors.Cause(err).(type) {
+	case *infreqdb.BucketNotFoundError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Println(err)
+	//Mostly storage failures
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+//writejson writes v as json
+func (s *server) writejson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/turbobytes/infreqdb"
+)
+
+func newtestserver(t *testing.T) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "infreqdb-server-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := infreqdb.NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := infreqdb.NewWithStorage(storage, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld, err := infreqdb.NewBuilder("foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a1", "a2", "a3", "b1"} {
+		bld.Put([]byte("MyBucket"), []byte(k), []byte("value "+k))
+	}
+	err = bld.Commit(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&server{db: db, maxList: 2})
+	return srv, func() {
+		srv.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func fetch(t *testing.T, method, url string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestServerGet(t *testing.T) {
+	srv, done := newtestserver(t)
+	defer done()
+	resp, body := fetch(t, "GET", srv.URL+"/parts/foo%2Fbar/buckets/MyBucket/keys/a2")
+	if resp.StatusCode != http.StatusOK || string(body) != "value a2" {
+		t.Errorf("expected value a2, got %v %s", resp.Status, body)
+	}
+	if resp.Header.Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("immutable partitions should be cacheable, got %v", resp.Header.Get("Cache-Control"))
+	}
+	for _, path := range []string{
+		"/parts/foo%2Fbar/buckets/MyBucket/keys/nokey",
+		"/parts/foo%2Fbar/buckets/NoBucket/keys/a2",
+		"/parts/nopart/buckets/MyBucket/keys/a2",
+		"/nothing",
+	} {
+		resp, body = fetch(t, "GET", srv.URL+path)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%v: expected 404, got %v %s", path, resp.Status, body)
+		}
+	}
+	resp, _ = fetch(t, "POST", srv.URL+"/parts/foo%2Fbar/buckets/MyBucket/keys/a2")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %v", resp.Status)
+	}
+}
+
+func TestServerList(t *testing.T) {
+	srv, done := newtestserver(t)
+	defer done()
+	var l listing
+	list := func(query string) []string {
+		resp, body := fetch(t, "GET", srv.URL+"/parts/foo%2Fbar/buckets/MyBucket/keys"+query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: %v %s", query, resp.Status, body)
+		}
+		l = listing{}
+		err := json.Unmarshal(body, &l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, e := range l.Keys {
+			keys = append(keys, string(e.Key))
+		}
+		return keys
+	}
+	if keys := list("?prefix=a"); len(keys) != 2 || keys[0] != "a1" || string(l.Next) != "a3" {
+		t.Errorf("expected first page a1 a2, got %v next %s", keys, l.Next)
+	}
+	if keys := list("?prefix=a&start=a3"); len(keys) != 1 || keys[0] != "a3" || l.Next != nil {
+		t.Errorf("expected last page a3, got %v next %s", keys, l.Next)
+	}
+	if keys := list("?start=a2&end=b1&values=false"); len(keys) != 2 || keys[1] != "a3" || l.Keys[0].Value != nil {
+		t.Errorf("expected a2 a3 without values, got %+v", l.Keys)
+	}
+	if keys := list("?limit=1"); len(keys) != 1 || string(l.Keys[0].Value) != "value a1" {
+		t.Errorf("expected a1, got %+v", l.Keys)
+	}
+	resp, _ := fetch(t, "GET", srv.URL+"/parts/foo%2Fbar/buckets/NoBucket/keys")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %v", resp.Status)
+	}
+}
+
+func TestServerMeta(t *testing.T) {
+	srv, done := newtestserver(t)
+	defer done()
+	resp, body := fetch(t, "GET", srv.URL+"/parts/foo%2Fbar")
+	var info infreqdb.PartInfo
+	err := json.Unmarshal(body, &info)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%v %s %v", resp.Status, body, err)
+	}
+	if !info.Found || info.Mutable || len(info.Buckets) != 1 || info.Buckets[0].Keys != 4 {
+		t.Errorf("unexpected info %+v", info)
+	}
+	resp, _ = fetch(t, "POST", srv.URL+"/parts/foo%2Fbar/expire")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204, got %v", resp.Status)
+	}
+	resp, body = fetch(t, "GET", srv.URL+"/stats")
+	var st infreqdb.Stats
+	err = json.Unmarshal(body, &st)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%v %s %v", resp.Status, body, err)
+	}
+	if st.Cached != 0 || st.Loads != 1 || st.Expired != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestServerTable(t *testing.T) {
+	srv, done := newtestserver(t)
+	defer done()
+	db := srv.Config.Handler.(*server).db
+	c := infreqdb.NewCompactor(db)
+	c.Engine = infreqdb.TableEngine
+	res, err := c.Compact("foo/bar")
+	if err != nil || !res.Uploaded {
+		t.Fatalf("expected a table, got %+v %v", res, err)
+	}
+	info, err := db.PartInfo("foo/bar")
+	if err != nil || info.Engine != "table" {
+		t.Fatalf("expected a table, got %+v %v", info, err)
+	}
+	resp, body := fetch(t, "GET", srv.URL+"/parts/foo%2Fbar/buckets/MyBucket/keys/a2")
+	if resp.StatusCode != http.StatusOK || string(body) != "value a2" {
+		t.Errorf("expected value a2, got %v %s", resp.Status, body)
+	}
+	if resp.Header.Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("immutable partitions should be cacheable, got %v", resp.Header.Get("Cache-Control"))
+	}
+	for _, path := range []string{
+		"/parts/foo%2Fbar/buckets/MyBucket/keys/nokey",
+		"/parts/foo%2Fbar/buckets/NoBucket/keys/a2",
+	} {
+		resp, body = fetch(t, "GET", srv.URL+path)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%v: expected 404, got %v %s", path, resp.Status, body)
+		}
+	}
+	resp, body = fetch(t, "GET", srv.URL+"/parts/foo%2Fbar/buckets/MyBucket/keys?prefix=a")
+	var l listing
+	err = json.Unmarshal(body, &l)
+	if err != nil || resp.StatusCode != http.StatusOK || len(l.Keys) != 2 || string(l.Keys[1].Value) != "value a2" {
+		t.Errorf("expected a1 a2, got %v %s %v", resp.Status, body, err)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/turbobytes/infreqdb"
+)
+
+//command runs a subcommand with its arguments, writing results to w
+type command func(storage infreqdb.Storage, args []string, w io.Writer) error
+
+var commands = map[string]command{
+	"ls":      ls,
+	"stat":    stat,
+	"get":     get,
+	"dump":    dump,
+	"put":     put,
+	"rm":      rm,
+	"seal":    seal,
+	"import":  importcmd,
+	"export":  export,
+	"compact": compact,
+}
+
+//errUsage when a subcommand gets the wrong arguments
+var errUsage = errors.New("usage")
+
+//ls lists partitions, optionally only those starting with a prefix
+func ls(storage infreqdb.Storage, args []string, w io.Writer) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	l, ok := storage.(infreqdb.Lister)
+	if !ok {
+		return infreqdb.ErrListNotSupported
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	entries, err := l.List(prefix)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PARTITION\tSIZE\tLAST MODIFIED\tMUTABLE\tENGINE")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%v\t%s\n", e.Partition, e.Size, e.LastModified.Format(time.RFC3339), e.Mutable, e.Engine)
+	}
+	return tw.Flush()
+}
+
+//stat prints the last modified time of a partition
+func stat(storage infreqdb.Storage, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	lastmod, found, err := storage.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Partition %s not found", args[0])
+	}
+	_, err = fmt.Fprintln(w, lastmod.Format(time.RFC3339))
+	return err
+}
+
+//opendb opens a DB for commands that write, keeping the manifest up to date if storage has one
+func opendb(storage infreqdb.Storage, opts ...infreqdb.Option) (*infreqdb.DB, error) {
+	_, found, err := storage.Stat(infreqdb.ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		opts = append(opts, infreqdb.WithManifest())
+	}
+	return infreqdb.NewWithStorage(storage, 1, opts...)
+}
+
+//engines open partitions, bbolt only when recorded as their engine, bolt files look the same
+var engines = []infreqdb.Engine{infreqdb.BoltEngine, infreqdb.BBoltEngine, infreqdb.TableEngine}
+
+//openpart downloads a partition and opens it with its engine, done removes the download
+func openpart(storage infreqdb.Storage, partid string) (r infreqdb.PartReader, done func(), err error) {
+	var fname, engine string
+	var found bool
+	if es, ok := storage.(infreqdb.EngineStorage); ok {
+		fname, found, _, _, engine, err = es.GetEngine(partid)
+	} else {
+		fname, found, _, _, err = storage.Get(partid)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("Partition %s not found", partid)
+	}
+	r, _, err = infreqdb.OpenPartFile(fname, engine, engines...)
+	if err != nil {
+		os.Remove(fname)
+		return nil, nil, err
+	}
+	return r, func() {
+		r.Close()
+		os.Remove(fname)
+	}, nil
+}
+
+//bytespath converts bucket names to a path
+func bytespath(names []string) [][]byte {
+	path := make([][]byte, len(names))
+	for i, name := range names {
+		path[i] = []byte(name)
+	}
+	return path
+}
+
+//get writes a single value, the arguments between partid and key are nested buckets
+func get(storage infreqdb.Storage, args []string, w io.Writer) error {
+	if len(args) < 3 {
+		return errUsage
+	}
+	r, done, err := openpart(storage, args[0])
+	if err != nil {
+		return err
+	}
+	defer done()
+	path, key := args[1:len(args)-1], args[len(args)-1]
+	v, err := r.Get(bytespath(path), []byte(key))
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return fmt.Errorf("Key %s not found", key)
+	}
+	_, err = w.Write(v)
+	return err
+}
+
+//dumpline is one key of a dump, []byte is base64 in json
+type dumpline struct {
+	//Bucket is the path of nested buckets holding the key
+	Bucket [][]byte `json:"bucket"`
+	Key    []byte   `json:"key"`
+	Value  []byte   `json:"value"`
+}
+
+//dump writes every key of a partition as json lines
+func dump(storage infreqdb.Storage, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	r, done, err := openpart(storage, args[0])
+	if err != nil {
+		return err
+	}
+	defer done()
+	buckets, err := r.Buckets()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, br := range buckets {
+		err = dumpbucket(enc, r, [][]byte{[]byte(br.Name)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//dumpbucket writes the keys of the bucket at path, then those of its nested buckets
+func dumpbucket(enc *json.Encoder, r infreqdb.PartReader, path [][]byte) error {
+	var nested [][]byte
+	err := r.Iterate(path, nil, nil, func(k, v []byte) error {
+		if v == nil {
+			nested = append(nested, append([]byte(nil), k...))
+			return nil
+		}
+		return enc.Encode(dumpline{Bucket: path, Key: k, Value: v})
+	})
+	for _, name := range nested {
+		if err != nil {
+			break
+		}
+		err = dumpbucket(enc, r, append(append([][]byte(nil), path...), name))
+	}
+	return err
+}
+
+//put uploads a local partition file of any engine, recording its engine.
+//-engine picks one when several recognize the file, e.g. bbolt for a bolt file.
+func put(storage infreqdb.Storage, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	mutable := fs.Bool("mutable", false, "expect changes to this partition")
+	engine := fs.String("engine", "", "engine of the file: bolt, bbolt or table, detected if empty")
+	if fs.Parse(args) != nil || fs.NArg() != 2 {
+		return errUsage
+	}
+	partid, fname := fs.Arg(0), fs.Arg(1)
+	//Refuse to upload something the DB can't open
+	r, e, err := infreqdb.OpenPartFile(fname, *engine, engines...)
+	if err != nil {
+		return errors.Wrap(err, fname)
+	}
+	r.Close()
+	if *engine != "" && e.Name() != *engine {
+		return fmt.Errorf("Unknown engine %v", *engine)
+	}
+	//SetPart records the first engine recognizing the file
+	ordered := []infreqdb.Engine{e}
+	for _, other := range engines {
+		if other != e {
+			ordered = append(ordered, other)
+		}
+	}
+	db, err := opendb(storage, infreqdb.WithEngines(ordered...))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.SetPart(partid, fname, *mutable)
+}
+
+//rm deletes a partition
+func rm(storage infreqdb.Storage, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	db, err := opendb(storage)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.DeletePart(args[0])
+}
+
+//seal uploads a mutable partition again as immutable
+func seal(storage infreqdb.Storage, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	db, err := opendb(storage)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Seal(args[0])
+}
+
+//compact rewrites partitions into packed bolt files, see infreqdb.Compactor
+func compact(storage infreqdb.Storage, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	minShrink := fs.Float64("min-shrink", 0.1, "upload only partitions shrinking by this fraction")
+	deltas := fs.Bool("deltas", false, "merge pending deltas")
+	all := fs.Bool("prefix", false, "arguments are prefixes, compact every partition starting with them")
+	if fs.Parse(args) != nil || fs.NArg() == 0 {
+		return errUsage
+	}
+	var opts []infreqdb.Option
+	if *deltas {
+		opts = append(opts, infreqdb.WithDeltas(0))
+	}
+	db, err := opendb(storage, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	c := infreqdb.NewCompactor(db)
+	c.MinShrink = *minShrink
+	report := &infreqdb.CompactReport{Errored: make(map[string]error)}
+	for _, arg := range fs.Args() {
+		if *all {
+			r, err := c.CompactAll(arg)
+			if err != nil {
+				return err
+			}
+			report.Results = append(report.Results, r.Results...)
+			for partid, err := range r.Errored {
+				report.Errored[partid] = err
+			}
+			continue
+		}
+		res, err := c.Compact(arg)
+		if err != nil {
+			report.Errored[arg] = err
+			continue
+		}
+		report.Results = append(report.Results, res)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PARTITION\tBEFORE\tAFTER\tDELTAS\tUPLOADED")
+	for _, res := range report.Results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%v\n", res.Partition, res.Before, res.After, res.Deltas, res.Uploaded)
+	}
+	tw.Flush()
+	for partid, err := range report.Errored {
+		fmt.Fprintln(w, "failed", partid, err)
+	}
+	if len(report.Errored) > 0 {
+		return fmt.Errorf("%d partitions failed", len(report.Errored))
+	}
+	return nil
+}
+
+//importcmd loads a jsonl or csv file, - for stdin, into partitions
+func importcmd(storage infreqdb.Storage, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	format := fs.String("format", "jsonl", "input format: jsonl or csv")
+	partition := fs.String("partition", "", "partition template, e.g. {date}")
+	bucket := fs.String("bucket", "", "bucket template, e.g. {city}")
+	key := fs.String("key", "", "key template, e.g. {hour}")
+	value := fs.String("value", "{.}", "value template, {.} is the whole record as json")
+	mutable := fs.Bool("mutable", false, "expect changes to these partitions")
+	parallel := fs.Int("parallel", 4, "partitions uploaded at once")
+	keys := fs.String("keys", "raw", "bucket and key encoding: raw, text or hex")
+	values := fs.String("values", "raw", "value encoding: raw, text or hex")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	parsekey, ok := parsers[*keys]
+	if !ok {
+		return fmt.Errorf("Unknown key encoding %v", *keys)
+	}
+	parsevalue, ok := parsers[*values]
+	if !ok {
+		return fmt.Errorf("Unknown value encoding %v", *values)
+	}
+	in := os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var rr infreqdb.RecordReader
+	switch *format {
+	case "jsonl":
+		rr = infreqdb.NewJSONLReader(in)
+	case "csv":
+		rr = infreqdb.NewCSVReader(in)
+	default:
+		return fmt.Errorf("Unknown format %v", *format)
+	}
+	db, err := opendb(storage)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	im := infreqdb.NewImporter(db)
+	im.Partition, im.Bucket, im.Key, im.Value = *partition, *bucket, *key, *value
+	im.ParseKey, im.ParseValue = parsekey, parsevalue
+	im.Mutable = *mutable
+	im.Parallelism = *parallel
+	report, err := im.Import(rr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "imported %d records into %d partitions\n", report.Records, len(report.Partitions))
+	for partid, err := range report.Errored {
+		fmt.Fprintln(w, "failed", partid, err)
+	}
+	if len(report.Errored) > 0 {
+		return fmt.Errorf("%d partitions failed", len(report.Errored))
+	}
+	return nil
+}
+
+//parsers read what export wrote, raw takes text as it is
+var parsers = map[string]infreqdb.TextParser{
+	"raw":  nil,
+	"text": infreqdb.ParseText,
+	"hex":  infreqdb.ParseHex,
+}
+
+//decoders are the value decoders export can use without knowing value types
+var decoders = map[string]infreqdb.ValueDecoder{
+	"text":   infreqdb.TextDecoder,
+	"string": infreqdb.StringDecoder,
+	"base64": infreqdb.BytesDecoder,
+	"json":   infreqdb.JSONDecoder,
+}
+
+//keydecoders are the key decoders export can use
+var keydecoders = map[string]infreqdb.KeyDecoder{
+	"text":   infreqdb.TextKeyDecoder,
+	"string": infreqdb.StringKeyDecoder,
+	"hex":    infreqdb.HexKeyDecoder,
+}
+
+//bucketlist collects repeated -bucket flags
+type bucketlist []string
+
+func (bl *bucketlist) String() string     { return strings.Join(*bl, ",") }
+func (bl *bucketlist) Set(b string) error { *bl = append(*bl, b); return nil }
+
+//export writes the keys of partitions in [start, end) as jsonl or csv
+func export(storage infreqdb.Storage, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	format := fs.String("format", "jsonl", "output format: jsonl or csv")
+	value := fs.String("value", "text", "value encoding: text, string, base64 or json")
+	keys := fs.String("keys", "text", "bucket and key encoding: text, string or hex")
+	var buckets bucketlist
+	fs.Var(&buckets, "bucket", "only export this bucket, can be repeated")
+	if fs.Parse(args) != nil || fs.NArg() < 1 || fs.NArg() > 2 {
+		return errUsage
+	}
+	decode, ok := decoders[*value]
+	if !ok {
+		return fmt.Errorf("Unknown value encoding %v", *value)
+	}
+	decodekey, ok := keydecoders[*keys]
+	if !ok {
+		return fmt.Errorf("Unknown key encoding %v", *keys)
+	}
+	var ew infreqdb.ExportWriter
+	switch *format {
+	case "jsonl":
+		ew = infreqdb.NewJSONLWriter(w)
+	case "csv":
+		ew = infreqdb.NewCSVWriter(w)
+	default:
+		return fmt.Errorf("Unknown format %v", *format)
+	}
+	db, err := infreqdb.NewWithStorage(storage, 1)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ex := infreqdb.NewExporter(db)
+	ex.Buckets = buckets
+	ex.Decode = decode
+	ex.DecodeKey = decodekey
+	partids, err := ex.Partitions(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	_, err = ex.Export(partids, ew)
+	return err
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/turbobytes/infreqdb"
+)
+
+func run(t *testing.T, storage infreqdb.Storage, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := commands[args[0]](storage, args[1:], &out)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := infreqdb.NewFileStorage(filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "part.db")
+	bdb, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("city"))
+		if err != nil {
+			return err
+		}
+		b.Put([]byte("name"), []byte("bangkok"))
+		nested, err := b.CreateBucket([]byte("temp"))
+		if err != nil {
+			return err
+		}
+		return nested.Put([]byte("noon"), []byte("35"))
+	})
+	bdb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run(t, storage, "put", "-mutable", "2017-01-01", fname); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run(t, storage, "put", "bogus", filepath.Join(dir, "nofile")); err == nil {
+		t.Error("expected put of a missing file to fail")
+	}
+	out, err := run(t, storage, "ls")
+	if err != nil || !strings.Contains(out, "2017-01-01") || !strings.Contains(out, "true") {
+		t.Errorf("unexpected ls %q %v", out, err)
+	}
+	if out, err = run(t, storage, "get", "2017-01-01", "city", "temp", "noon"); err != nil || out != "35" {
+		t.Errorf("expected 35, got %q %v", out, err)
+	}
+	if _, err = run(t, storage, "get", "2017-01-01", "city", "nokey"); err == nil {
+		t.Error("expected missing key to fail")
+	}
+	out, err = run(t, storage, "dump", "2017-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []dumpline
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		var dl dumpline
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, dl)
+	}
+	if len(lines) != 2 || len(lines[1].Bucket) != 2 || string(lines[1].Bucket[1]) != "temp" || string(lines[1].Value) != "35" {
+		t.Errorf("unexpected dump %q", out)
+	}
+	if _, err = run(t, storage, "seal", "2017-01-01"); err != nil {
+		t.Error(err)
+	}
+	if out, _ = run(t, storage, "ls", "2017"); !strings.Contains(out, "false") {
+		t.Errorf("expected sealed partition, got %q", out)
+	}
+	if _, err = run(t, storage, "stat", "2017-01-01"); err != nil {
+		t.Error(err)
+	}
+	if _, err = run(t, storage, "rm", "2017-01-01"); err != nil {
+		t.Error(err)
+	}
+	if _, err = run(t, storage, "stat", "2017-01-01"); err == nil {
+		t.Error("expected removed partition to be gone")
+	}
+	if _, err = run(t, storage, "get", "2017-01-01"); err != errUsage {
+		t.Errorf("expected usage error, got %v", err)
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := infreqdb.NewFileStorage(filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "in.csv")
+	err = ioutil.WriteFile(fname, []byte("day,city,temp\n2017-01-01,bangkok,30\n2017-01-02,bangkok,31\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := run(t, storage, "import", "-format", "csv", "-partition", "{day}", "-bucket", "{city}", "-key", "temp", "-value", "{temp}", fname)
+	if err != nil || !strings.Contains(out, "2 records into 2 partitions") {
+		t.Fatalf("unexpected import %q %v", out, err)
+	}
+	if out, err = run(t, storage, "get", "2017-01-02", "bangkok", "temp"); err != nil || out != "31" {
+		t.Errorf("expected 31, got %q %v", out, err)
+	}
+	out, err = run(t, storage, "export", "-format", "csv", "-bucket", "bangkok", "2017-01-02")
+	if err != nil || out != "partition,bucket,key,value\n2017-01-02,bangkok,temp,31\n" {
+		t.Errorf("unexpected export %q %v", out, err)
+	}
+	if _, err = run(t, storage, "import", "-format", "xml", fname); err == nil {
+		t.Error("expected unknown format to fail")
+	}
+}
+
+func TestCompactCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := infreqdb.NewFileStorage(filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := infreqdb.NewWithStorage(storage, 1, infreqdb.WithDeltas(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d := db.NewDelta("2017-01-01")
+	d.Put([]byte("city"), []byte("name"), []byte("bangkok"))
+	if err = d.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := run(t, storage, "compact", "-deltas", "2017-01-01")
+	if err != nil || !strings.Contains(out, "2017-01-01") || !strings.Contains(out, "true") {
+		t.Errorf("unexpected compact %q %v", out, err)
+	}
+	if out, err = run(t, storage, "get", "2017-01-01", "city", "name"); err != nil || out != "bangkok" {
+		t.Errorf("expected bangkok, got %q %v", out, err)
+	}
+	if _, err = run(t, storage, "compact"); err != errUsage {
+		t.Errorf("expected usage error, got %v", err)
+	}
+}
+
+func TestManifestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := infreqdb.NewFileStorage(filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "in.csv")
+	err = ioutil.WriteFile(fname, []byte("day,city,temp\n2017-01-01,bangkok,30\n2017-01-02,bangkok,31\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Without a manifest none is created
+	if _, err = run(t, storage, "import", "-format", "csv", "-partition", "{day}", "-bucket", "{city}", "-key", "temp", "-value", "{temp}", fname); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := storage.Stat(infreqdb.ManifestName); found {
+		t.Error("expected no manifest")
+	}
+	db, err := infreqdb.NewWithStorage(storage, 1, infreqdb.WithManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := infreqdb.NewBuilder("2017-01-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("bangkok"), []byte("temp"), []byte("32"))
+	if err = bld.Commit(db, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run(t, storage, "import", "-format", "csv", "-partition", "{day}", "-bucket", "{city}", "-key", "temp", "-value", "{temp}", fname); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run(t, storage, "rm", "2017-01-03"); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := infreqdb.NewWithStorage(storage, 1, infreqdb.WithManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	entries, err := reader.ListParts("2017")
+	if err != nil || len(entries) != 2 || entries[0].Partition != "2017-01-01" || entries[1].Partition != "2017-01-02" {
+		t.Errorf("expected the imported partitions in the manifest, got %+v %v", entries, err)
+	}
+}
+
+func TestEngineCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := infreqdb.NewFileStorage(filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := infreqdb.NewWithStorage(storage, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := infreqdb.NewBuilder("bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("city"), []byte("name"), []byte("bangkok"))
+	bld.Put([]byte("city"), []byte("temp"), []byte("35"))
+	if err = bld.Commit(db, false); err != nil {
+		t.Fatal(err)
+	}
+	c := infreqdb.NewCompactor(db)
+	c.Engine = infreqdb.TableEngine
+	if _, err = c.Compact("bolt"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := run(t, storage, "ls")
+	if err != nil || !strings.Contains(out, "table") {
+		t.Errorf("expected a table, got %q %v", out, err)
+	}
+	if out, err = run(t, storage, "get", "bolt", "city", "temp"); err != nil || out != "35" {
+		t.Errorf("expected 35, got %q %v", out, err)
+	}
+	if _, err = run(t, storage, "get", "bolt", "nocity", "temp"); err == nil {
+		t.Error("expected missing bucket to fail")
+	}
+	if out, err = run(t, storage, "dump", "bolt"); err != nil || strings.Count(out, "\n") != 2 {
+		t.Errorf("expected 2 keys, got %q %v", out, err)
+	}
+
+	//Upload the table under another name, and a bolt file as bbolt
+	table, found, _, _, err := storage.Get("bolt")
+	if err != nil || !found {
+		t.Fatal(err)
+	}
+	defer os.Remove(table)
+	if _, err = run(t, storage, "put", "copy", table); err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "part.db")
+	bdb, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("city"))
+		if err == nil {
+			err = b.Put([]byte("name"), []byte("bangkok"))
+		}
+		return err
+	})
+	bdb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run(t, storage, "put", "-engine", "bbolt", "bbolt", fname); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run(t, storage, "put", "-engine", "table", "bogus", fname); err == nil {
+		t.Error("expected a bolt file to fail as a table")
+	}
+	entries, err := storage.List("")
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected 3 partitions, got %+v %v", entries, err)
+	}
+	for _, e := range entries {
+		expected := map[string]string{"bolt": "table", "copy": "table", "bbolt": "bbolt"}[e.Partition]
+		if e.Engine != expected {
+			t.Errorf("%s: expected %s, got %s", e.Partition, expected, e.Engine)
+		}
+	}
+	if out, err = run(t, storage, "get", "bbolt", "city", "name"); err != nil || out != "bangkok" {
+		t.Errorf("expected bangkok, got %q %v", out, err)
+	}
+	if out, err = run(t, storage, "get", "copy", "city", "name"); err != nil || out != "bangkok" {
+		t.Errorf("expected bangkok, got %q %v", out, err)
+	}
+}
@@ -0,0 +1,92 @@
+//Command infreqdb inspects and manages partitions in storage, without a running DB.
+//
+//	infreqdb [flags] ls [prefix]                     list partitions with size, last modified, mutable flag and engine
+//	infreqdb [flags] stat partid                     last modified time of a partition
+//	infreqdb [flags] get partid bucket... key        write a value to stdout, nested buckets are separate arguments
+//	infreqdb [flags] dump partid                     write every key of a partition as json lines
+//	infreqdb [flags] put [-mutable] [-engine e] partid file  upload a local partition file of any engine
+//	infreqdb [flags] rm partid                       delete a partition
+//	infreqdb [flags] seal partid                     mark a partition immutable
+//	infreqdb [flags] import [import flags] file      load jsonl or csv, - for stdin, see -partition -bucket -key -value
+//	infreqdb [flags] export [export flags] start [end] write keys of partitions in [start, end) as jsonl or csv
+//	infreqdb [flags] compact [-min-shrink f] [-deltas] [-prefix] partid...  rewrite partitions with full pages
+//
+//Running DBs don't notice rm, put, seal, import or compact until their next CheckExpiry.
+//If storage has a manifest, see infreqdb.WithManifest, the commands writing partitions update it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/turbobytes/infreqdb"
+)
+
+var (
+	storageType  = flag.String("storage", "s3", "storage backend: s3 or file")
+	prefix       = flag.String("prefix", "", "prefix for all s3 keys")
+	s3bucketName = flag.String("s3bucket", "", "S3 bucket name, for s3 storage")
+	s3region     = flag.String("s3region", "", "S3 region name, for s3 storage")
+	dir          = flag.String("dir", "", "directory holding partitions, for file storage")
+)
+
+//newstorage builds the storage backend chosen by flags
+func newstorage() (infreqdb.Storage, error) {
+	switch *storageType {
+	case "s3":
+		if *s3bucketName == "" {
+			return nil, fmt.Errorf("Bucket name must be provided")
+		}
+		if *s3region == "" {
+			return nil, fmt.Errorf("Region name must be provided")
+		}
+		auth, err := aws.EnvAuth()
+		if err != nil {
+			return nil, err
+		}
+		region, ok := aws.Regions[*s3region]
+		if !ok {
+			return nil, fmt.Errorf("Region %v not found", *s3region)
+		}
+		return infreqdb.NewS3Storage(s3.New(auth, region).Bucket(*s3bucketName), *prefix), nil
+	case "file":
+		if *dir == "" {
+			return nil, fmt.Errorf("Directory must be provided")
+		}
+		return infreqdb.NewFileStorage(*dir)
+	}
+	return nil, fmt.Errorf("Unknown storage %v", *storageType)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: infreqdb [flags] ls|stat|get|dump|put|rm|seal|import|export|compact args...")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+	}
+	storage, err := newstorage()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = cmd(storage, flag.Args()[1:], os.Stdout)
+	if err == errUsage {
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
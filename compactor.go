@@ -0,0 +1,271 @@
+package infreqdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//packBatch is how many bytes of keys and values are copied per transaction,
+//so packing a huge partition does not hold it all in memory
+const packBatch = 32 << 20
+
+//Compactor rewrites partitions into fresh files with full pages, dropping the free
+//pages that pile up when a bolt file is rewritten many times. With WithDeltas pending deltas
+//are merged too, with Engine set partitions move to another engine. The new file is checked
+//to hold exactly the same keys before it replaces the partition through SetPart, and only
+//if that is worth it.
+//Like Compact, changes made while compacting are detected but deltas committed meanwhile are lost.
+type Compactor struct {
+	//MinShrink is the fraction a partition has to shrink by to be uploaded again, e.g. 0.1 for 10%.
+	//Partitions with merged deltas are always uploaded.
+	MinShrink float64
+	//Engine builds the compacted files, BoltEngine if nil, and is recorded as their engine.
+	//Partitions the Engine does not recognize yet, or recorded with another engine, are always uploaded.
+	Engine Engine
+
+	db *DB
+}
+
+//NewCompactor creates a Compactor for partitions of db, MinShrink defaults to 0.1
+func NewCompactor(db *DB) *Compactor {
+	return &Compactor{MinShrink: 0.1, db: db}
+}
+
+//CompactResult is the outcome of compacting a partition
+type CompactResult struct {
+	Partition string
+	//Before and After are sizes of the uncompressed files
+	Before, After int64
+	//Deltas is the number of deltas merged
+	Deltas int
+	//Uploaded is false if the partition did not shrink enough, was missing or changed meanwhile
+	Uploaded bool
+}
+
+//CompactReport is the outcome of CompactAll
+type CompactReport struct {
+	Results []*CompactResult
+	//Errored partitions failed to compact and were left alone
+	Errored map[string]error
+}
+
+//CompactAll compacts every partition starting with prefix, see DB.ListParts.
+//Partitions that only exist as deltas are not listed, unless there is a manifest.
+func (c *Compactor) CompactAll(prefix string) (*CompactReport, error) {
+	entries, err := c.db.ListParts(prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "CompactAll")
+	}
+	report := &CompactReport{Errored: make(map[string]error)}
+	for _, e := range entries {
+		res, err := c.Compact(e.Partition)
+		if err != nil {
+			report.Errored[e.Partition] = err
+			continue
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report, nil
+}
+
+//Compact rewrites a single partition
+func (c *Compactor) Compact(partid string) (*CompactResult, error) {
+	res := &CompactResult{Partition: partid}
+	var m *materialized
+	var err error
+	if c.db.usedeltas {
+		m, err = c.db.materialize(partid)
+	} else {
+		var fname, engine string
+		var found, mutable bool
+		var lastmod time.Time
+		fname, found, mutable, lastmod, engine, err = getpartfile(partid, c.db.storage)
+		if found {
+			m = &materialized{fname: fname, engine: engine, mutable: mutable, lastmod: lastmod, found: true}
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Compact")
+	}
+	if m == nil {
+		return res, nil
+	}
+	defer os.Remove(m.fname)
+	e := c.Engine
+	if e == nil {
+		e = BoltEngine
+	}
+	header, err := readheader(m.fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "Compact")
+	}
+	//bolt and bbolt files look the same, the recorded engine tells them apart
+	convert := !e.Detect(header) || (m.engine != "" && m.engine != e.Name())
+	packed, err := packfile(m.fname, m.engine, c.db.engines, e)
+	if err != nil {
+		return nil, errors.Wrap(err, "Compact")
+	}
+	defer os.Remove(packed)
+	res.Deltas = m.deltas
+	res.Before, err = filesize(m.fname)
+	if err == nil {
+		res.After, err = filesize(packed)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Compact")
+	}
+	if m.deltas == 0 && !convert && float64(res.After) > float64(res.Before)*(1-c.MinShrink) {
+		return res, nil
+	}
+	//Don't overwrite changes made while we were busy
+	now, found, err := c.db.storage.Stat(partid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Compact")
+	}
+	if found != m.found || (found && !now.Equal(m.lastmod)) {
+		return res, nil
+	}
+	if c.db.usedeltas {
+		n, err := c.db.lastdelta(partid, m.gen)
+		if err != nil {
+			return nil, errors.Wrap(err, "Compact")
+		}
+		if n != m.deltas {
+			return res, nil
+		}
+	}
+	err = c.db.setpart(partid, packed, m.mutable, e.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "Compact")
+	}
+	res.Uploaded = true
+	return res, nil
+}
+
+//filesize returns the size of fname
+func filesize(fname string) (int64, error) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+//packfile copies the partition file fname, opened with engine or engines, see openpart,
+//into a new file built by e, and checks the copy
+func packfile(fname, engine string, engines []Engine, e Engine) (string, error) {
+	src, _, err := openpart(fname, engine, engines)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmpfile, err := ioutil.TempFile("", "infreqdb-")
+	if err != nil {
+		return "", err
+	}
+	tmpfile.Close()
+	packed := tmpfile.Name()
+	err = e.Build(packed, src)
+	if err == nil {
+		err = samecontents(src, e, packed)
+	}
+	if err != nil {
+		os.Remove(packed)
+		return "", err
+	}
+	return packed, nil
+}
+
+//packer writes keys in order into a bolt file, committing every packBatch bytes
+type packer struct {
+	dst  *bolt.DB
+	tx   *bolt.Tx
+	size int
+}
+
+//put writes k and v into the bucket at path, creating buckets as needed. A nil k only creates them.
+func (p *packer) put(path [][]byte, k, v []byte) error {
+	if p.size >= packBatch {
+		err := p.commit()
+		if err != nil {
+			return err
+		}
+	}
+	if p.tx == nil {
+		var err error
+		p.tx, err = p.dst.Begin(true)
+		if err != nil {
+			return err
+		}
+	}
+	b, err := p.tx.CreateBucketIfNotExists(path[0])
+	for i := 1; err == nil && i < len(path); i++ {
+		b.FillPercent = 1
+		b, err = b.CreateBucketIfNotExists(path[i])
+	}
+	if err != nil || k == nil {
+		return err
+	}
+	//Keys arrive sorted, pack pages full
+	b.FillPercent = 1
+	p.size += len(k) + len(v)
+	//Source keys and values are only valid during the walk
+	return b.Put(copyvalue(k), copyvalue(v))
+}
+
+//commit ends the current transaction
+func (p *packer) commit() error {
+	if p.tx == nil {
+		return nil
+	}
+	err := p.tx.Commit()
+	p.tx, p.size = nil, 0
+	return err
+}
+
+//samecontents checks that fname, built by e, holds exactly what src does
+func samecontents(src PartReader, e Engine, fname string) error {
+	dst, err := e.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	var sums [2][]byte
+	for i, r := range []PartReader{src, dst} {
+		h := sha256.New()
+		//Hashes the path of every bucket, then its keys and values in order
+		err = walkpart(r, func(path [][]byte, k, v []byte) error {
+			if k == nil {
+				writefield(h, bytes.Join(path, []byte{0}))
+				return nil
+			}
+			writefield(h, k)
+			writefield(h, v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sums[i] = h.Sum(nil)
+	}
+	if !bytes.Equal(sums[0], sums[1]) {
+		return errors.Wrap(ErrCorruptPartition, "compacted copy differs")
+	}
+	return nil
+}
+
+//writefield writes b length prefixed, so fields can't run into each other
+func writefield(h hash.Hash, b []byte) {
+	var l [8]byte
+	binary.BigEndian.PutUint64(l[:], uint64(len(b)))
+	h.Write(l[:])
+	h.Write(b)
+}
@@ -0,0 +1,98 @@
+package infreqdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCompactor(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10, WithDeltas(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Deleting most keys leaves free pages behind
+	err = bld.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("b"))
+		if err != nil {
+			return err
+		}
+		nested, err := b.CreateBucket([]byte("nested"))
+		if err != nil {
+			return err
+		}
+		nested.Put([]byte("n"), []byte("v"))
+		for i := 0; i < 10000; i++ {
+			b.Put([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100))
+		}
+		return nil
+	})
+	if err == nil {
+		err = bld.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("b"))
+			for i := 10; i < 10000; i++ {
+				b.Delete([]byte(fmt.Sprintf("k%05d", i)))
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCompactor(db)
+	res, err := c.Compact("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Uploaded || res.After >= res.Before || res.Deltas != 0 {
+		t.Errorf("expected a smaller upload, got %+v", res)
+	}
+	v, err := db.GetPath("part", [][]byte{[]byte("b"), []byte("nested")}, []byte("n"))
+	if err != nil || string(v) != "v" {
+		t.Errorf("expected v, got %s %v", v, err)
+	}
+	//Already packed
+	res, err = c.Compact("part")
+	if err != nil || res.Uploaded {
+		t.Errorf("expected no upload, got %+v %v", res, err)
+	}
+	//Deltas are merged regardless
+	d := db.NewDelta("part")
+	d.Put([]byte("b"), []byte("new"), []byte("x"))
+	err = d.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.CompactAll("")
+	if err != nil || len(report.Errored) != 0 || len(report.Results) != 1 {
+		t.Fatalf("unexpected report %+v %v", report, err)
+	}
+	if res = report.Results[0]; !res.Uploaded || res.Deltas != 1 {
+		t.Errorf("expected deltas to be merged, got %+v", res)
+	}
+	if names, _, _ := db.listdeltas("part"); len(names) != 0 {
+		t.Errorf("expected no deltas left, got %v", names)
+	}
+	v, err = db.Get("part", []byte("b"), []byte("new"))
+	if err != nil || string(v) != "x" {
+		t.Errorf("expected x, got %s %v", v, err)
+	}
+	res, err = c.Compact("nopart")
+	if err != nil || res.Uploaded {
+		t.Errorf("expected nothing to do, got %+v %v", res, err)
+	}
+}
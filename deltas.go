@@ -0,0 +1,490 @@
+package infreqdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//deltaInfix separates a partid from the generation and number of one of its deltas,
+//e.g. 2017-01-01.delta.1483228800000000000.3
+const deltaInfix = ".delta."
+
+//deltaname names the nth delta of partid made against generation gen of the partition,
+//the first one is 1
+func deltaname(partid string, gen int64, n int) string {
+	return partid + deltaInfix + strconv.FormatInt(gen, 10) + "." + strconv.Itoa(n)
+}
+
+//deltagen is the generation of a partition, its last modified time in nanoseconds, 0 if
+//there is none. Deltas only apply to the generation they were made against, so deltas
+//left behind by a replaced partition are never applied to the new one.
+func deltagen(lastmod time.Time, found bool) int64 {
+	if !found {
+		return 0
+	}
+	return lastmod.UnixNano()
+}
+
+//deltagen asks storage for the generation of partid
+func (db *DB) deltagen(partid string) (int64, error) {
+	lastmod, found, err := db.storage.Stat(partid)
+	return deltagen(lastmod, found), err
+}
+
+//parsedelta splits the name of a delta, ok is false if it is none
+func parsedelta(name string) (partid string, gen int64, n int, ok bool) {
+	i := strings.LastIndex(name, deltaInfix)
+	if i < 0 {
+		return
+	}
+	fields := strings.Split(name[i+len(deltaInfix):], ".")
+	if len(fields) != 2 {
+		return
+	}
+	gen, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || gen < 0 {
+		return
+	}
+	n, err = strconv.Atoi(fields[1])
+	if err != nil || n < 1 {
+		return
+	}
+	return name[:i], gen, n, true
+}
+
+//isdelta tells if a storage object is a delta
+func isdelta(part string) bool {
+	_, _, _, ok := parsedelta(part)
+	return ok
+}
+
+//deltaop is a put or tombstone in a delta, stored as a json line
+type deltaop struct {
+	Bucket []byte `json:"bucket"`
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+//WithDeltas lets small changes to a partition be stored as deltas next to it instead of
+//uploading the whole partition again, see DB.NewDelta. Partitions are loaded with their
+//deltas applied. Once compactAt deltas piled up, Delta.Commit merges them into a new
+//partition, 0 leaves that to Compact. Every node reading deltas needs this option,
+//loading a partition then costs a listing to look for deltas, or one more GET if the
+//storage is no NameLister.
+//Deltas are tied to the last modified time of the partition they were made against and
+//ignored once it is replaced. On storage with 1 second timestamps, like S3, don't replace
+//a partition and commit deltas to it within the same second.
+func WithDeltas(compactAt int) Option {
+	return func(db *DB) {
+		db.usedeltas = true
+		db.compactAt = compactAt
+	}
+}
+
+//Delta collects puts and deletes for a partition, stored as a single object on Commit.
+//Deltas are meant for mutable partitions, CheckExpiry does not look for deltas of
+//immutable ones. Have a single writer per partition, concurrent commits can overwrite
+//each other's deltas.
+type Delta struct {
+	partid string
+	ops    []deltaop
+	db     *DB
+}
+
+//NewDelta starts a delta for partid
+func (db *DB) NewDelta(partid string) *Delta {
+	return &Delta{partid: partid, db: db}
+}
+
+//Partition returns the partid the delta is for
+func (d *Delta) Partition() string {
+	return d.partid
+}
+
+//Put sets key in a top level bucket, creating the bucket if needed
+func (d *Delta) Put(bucket, key, value []byte) {
+	d.ops = append(d.ops, deltaop{
+		Bucket: append([]byte(nil), bucket...),
+		Key:    append([]byte(nil), key...),
+		Value:  append([]byte{}, value...),
+	})
+}
+
+//Delete removes key from a top level bucket, a missing key or bucket is not an error
+func (d *Delta) Delete(bucket, key []byte) {
+	d.ops = append(d.ops, deltaop{
+		Bucket: append([]byte(nil), bucket...),
+		Key:    append([]byte(nil), key...),
+		Delete: true,
+	})
+}
+
+//Commit stores the delta and expires the partition, on other nodes too if an Invalidator is set.
+//Compacts the partition if WithDeltas' threshold was reached.
+func (d *Delta) Commit() error {
+	db := d.db
+	if !db.usedeltas {
+		return errors.Wrap(ErrNoDeltas, "Commit")
+	}
+	if len(d.ops) == 0 {
+		return nil
+	}
+	gen, err := db.deltagen(d.partid)
+	if err != nil {
+		return errors.Wrap(err, "Commit")
+	}
+	n, err := db.lastdelta(d.partid, gen)
+	if err != nil {
+		return errors.Wrap(err, "Commit")
+	}
+	if db.filters != nil {
+		//The filter does not know the new keys
+		err = db.storage.Delete(d.partid + BloomSuffix)
+		if err != nil {
+			return errors.Wrap(err, "Commit")
+		}
+	}
+	err = d.put(deltaname(d.partid, gen, n+1))
+	if err == nil && db.usemanifest {
+		err = errors.Wrap(db.editmanifest(func(parts map[string]*ManifestEntry) {
+			me, ok := parts[d.partid]
+			if !ok {
+				me = &ManifestEntry{PartEntry: PartEntry{Partition: d.partid, Mutable: true}}
+				parts[d.partid] = me
+			}
+			me.widen(d.ops)
+		}), "manifest")
+	}
+	db.Expire(d.partid)
+	if err != nil {
+		return errors.Wrap(err, "Commit")
+	}
+	err = db.invalidate(d.partid)
+	if err != nil {
+		return errors.Wrap(err, "Commit")
+	}
+	if db.compactAt > 0 && n+1 >= db.compactAt {
+		return errors.Wrap(db.Compact(d.partid), "Commit")
+	}
+	return nil
+}
+
+//put uploads the delta as name
+func (d *Delta) put(name string) error {
+	tmpfile, err := ioutil.TempFile("", "infreqdb-delta-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	bw := bufio.NewWriter(tmpfile)
+	enc := json.NewEncoder(bw)
+	for _, op := range d.ops {
+		if err = enc.Encode(op); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return d.db.storage.Put(name, tmpfile.Name(), true)
+}
+
+//listdeltas returns the names of all deltas of partid, of any generation, sorted by
+//generation and number. ok is false if the storage can't list.
+func (db *DB) listdeltas(partid string) (names []string, ok bool, err error) {
+	l, err := namelisterof(db.storage)
+	if err == nil {
+		names, err = l.ListNames(partid + deltaInfix)
+	}
+	if errors.Cause(err) == ErrListNotSupported {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	var deltas deltanames
+	for _, name := range names {
+		if p, _, _, ok := parsedelta(name); ok && p == partid {
+			deltas = append(deltas, name)
+		}
+	}
+	sort.Sort(deltas)
+	return deltas, true, nil
+}
+
+//deltanames sorts delta names by generation and number
+type deltanames []string
+
+func (dn deltanames) Len() int      { return len(dn) }
+func (dn deltanames) Swap(i, j int) { dn[i], dn[j] = dn[j], dn[i] }
+func (dn deltanames) Less(i, j int) bool {
+	_, gi, ni, _ := parsedelta(dn[i])
+	_, gj, nj, _ := parsedelta(dn[j])
+	return gi < gj || (gi == gj && ni < nj)
+}
+
+//gendeltas returns the numbers of the deltas of partid made against generation gen, sorted.
+//Storage that can't list is probed until the first missing delta.
+func (db *DB) gendeltas(partid string, gen int64) ([]int, error) {
+	names, ok, err := db.listdeltas(partid)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	if ok {
+		for _, name := range names {
+			if _, g, n, _ := parsedelta(name); g == gen {
+				nums = append(nums, n)
+			}
+		}
+		return nums, nil
+	}
+	for {
+		_, found, err := db.storage.Stat(deltaname(partid, gen, len(nums)+1))
+		if err != nil || !found {
+			return nums, err
+		}
+		nums = append(nums, len(nums)+1)
+	}
+}
+
+//lastdelta returns the number of the last delta of partid made against gen, 0 if there is none
+func (db *DB) lastdelta(partid string, gen int64) (int, error) {
+	nums, err := db.gendeltas(partid, gen)
+	if err != nil || len(nums) == 0 {
+		return 0, err
+	}
+	return nums[len(nums)-1], nil
+}
+
+//hasdelta tells if the nth delta of partid made against gen exists, errors are logged and count as no
+func (db *DB) hasdelta(partid string, gen int64, n int) bool {
+	_, found, err := db.storage.Stat(deltaname(partid, gen, n))
+	if err != nil {
+		log.Println("CheckExpiry delta", partid, err)
+	}
+	return found
+}
+
+//deletedeltas removes the deltas of partid not made against generation keep, -1 removes all.
+//They are ignored anyway, so a failure only leaves garbage behind. Storage that can't list
+//is probed for the deltas of generation old.
+func (db *DB) deletedeltas(partid string, old, keep int64) error {
+	names, ok, err := db.listdeltas(partid)
+	if err != nil {
+		return errors.Wrap(err, "deltas")
+	}
+	if !ok && old != keep {
+		nums, err := db.gendeltas(partid, old)
+		if err != nil {
+			return errors.Wrap(err, "deltas")
+		}
+		for _, n := range nums {
+			names = append(names, deltaname(partid, old, n))
+		}
+	}
+	for _, name := range names {
+		if _, gen, _, _ := parsedelta(name); gen == keep {
+			continue
+		}
+		err = db.storage.Delete(name)
+		if err != nil {
+			return errors.Wrap(err, "deltas")
+		}
+	}
+	return nil
+}
+
+//Compact merges the deltas of partid into the partition using SetPart, which then removes them.
+//Deltas committed while compacting are lost.
+func (db *DB) Compact(partid string) error {
+	m, err := db.materialize(partid)
+	if err != nil {
+		return errors.Wrap(err, "Compact")
+	}
+	if m == nil {
+		return nil
+	}
+	defer os.Remove(m.fname)
+	if m.deltas == 0 {
+		return nil
+	}
+	return errors.Wrap(db.setpart(partid, m.fname, m.mutable, m.engine), "Compact")
+}
+
+//materialized is a partition file with its deltas applied
+type materialized struct {
+	fname string
+	//engine built fname, "" if unknown
+	engine  string
+	mutable bool
+	lastmod time.Time
+	//deltas is the number of the last delta applied, deltas are numbered from 1
+	deltas int
+	//gen is the generation the deltas were made against, see deltagen
+	gen int64
+	//found is false if there are only deltas
+	found bool
+}
+
+//materialize downloads partid and applies its deltas on top, nil if there is neither.
+//Deltas without a partition start from an empty one.
+func (db *DB) materialize(partid string) (*materialized, error) {
+	fname, found, mutable, lastmod, engine, err := getpartfile(partid, db.storage)
+	if err != nil {
+		return nil, err
+	}
+	m := &materialized{fname: fname, engine: engine, mutable: mutable, lastmod: lastmod, found: found, gen: deltagen(lastmod, found)}
+	if !found {
+		//Like a missing partition, so creating one later counts as a change
+		m.fname, m.mutable, m.lastmod = "", true, time.Unix(2, 2)
+	}
+	nums, err := db.gendeltas(partid, m.gen)
+	if err != nil {
+		if m.fname != "" {
+			os.Remove(m.fname)
+		}
+		return nil, err
+	}
+	var bdb *bolt.DB
+	for _, n := range nums {
+		dname, found, _, _, _, err := getpartfile(deltaname(partid, m.gen, n), db.storage)
+		if err == nil && !found {
+			//Removed since listed, the partition changed and CheckExpiry will notice
+			break
+		}
+		if err == nil && bdb == nil {
+			bdb, m.fname, err = db.openforupdate(m.fname, m.engine)
+			m.engine = BoltEngine.Name()
+		}
+		if err == nil {
+			err = applydelta(bdb, dname)
+		}
+		if dname != "" {
+			os.Remove(dname)
+		}
+		if err != nil {
+			if bdb != nil {
+				bdb.Close()
+			}
+			if m.fname != "" {
+				os.Remove(m.fname)
+			}
+			return nil, errors.Wrap(err, deltaname(partid, m.gen, n))
+		}
+		m.deltas = n
+	}
+	if bdb != nil {
+		err = bdb.Close()
+		if err != nil {
+			os.Remove(m.fname)
+			return nil, err
+		}
+	}
+	if m.fname == "" {
+		return nil, nil
+	}
+	return m, nil
+}
+
+//openforupdate opens a downloaded partition for writing, an empty fname creates a new one.
+//Partitions of other engines are rebuilt as bolt files, which replace fname.
+func (db *DB) openforupdate(fname, engine string) (*bolt.DB, string, error) {
+	if fname == "" {
+		tmpfile, err := ioutil.TempFile("", "infreqdb-")
+		if err != nil {
+			return nil, "", err
+		}
+		tmpfile.Close()
+		fname = tmpfile.Name()
+	} else if header, err := readheader(fname); err != nil {
+		return nil, fname, err
+	} else if !BoltEngine.Detect(header) {
+		packed, err := packfile(fname, engine, db.engines, BoltEngine)
+		if err != nil {
+			return nil, fname, err
+		}
+		os.Remove(fname)
+		fname = packed
+	}
+	bdb, err := bolt.Open(fname, 0600, nil)
+	return bdb, fname, err
+}
+
+//applydelta applies the ops stored in fname
+func applydelta(bdb *bolt.DB, fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	return bdb.Update(func(tx *bolt.Tx) error {
+		for {
+			var op deltaop
+			err := dec.Decode(&op)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(ErrCorruptPartition, err.Error())
+			}
+			err = op.apply(tx)
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+//apply makes the put or delete in tx, creating the bucket of puts if needed
+func (op *deltaop) apply(tx *bolt.Tx) error {
+	if op.Delete {
+		if b := tx.Bucket(op.Bucket); b != nil {
+			return b.Delete(op.Key)
+		}
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists(op.Bucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(op.Key, op.Value)
+}
+
+//newdeltapartition loads partid with its deltas applied
+func (db *DB) newdeltapartition(partid string) (*cachepartition, error) {
+	m, err := db.materialize(partid)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		//404, same as newcachepartition
+		return &cachepartition{RWMutex: &sync.RWMutex{}, mutable: true, lastModified: time.Unix(2, 2)}, nil
+	}
+	cp, err := opencachepartition(partid, m.fname, m.engine, m.mutable, m.lastmod, db.engines)
+	if err != nil {
+		return nil, err
+	}
+	cp.deltas, cp.deltagen = m.deltas, m.gen
+	return cp, nil
+}
@@ -0,0 +1,227 @@
+package infreqdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestIsDelta(t *testing.T) {
+	for part, expected := range map[string]bool{
+		"2017-01-01.delta.0.1":                    true,
+		"2017-01-01.delta.1483228800000000000.12": true,
+		"2017-01-01.delta.5.0":                    false,
+		"2017-01-01.delta.-5.1":                   false,
+		"2017-01-01.delta.1":                      false,
+		"2017-01-01.delta.x.1":                    false,
+		"2017-01-01":                              false,
+	} {
+		if isdelta(part) != expected {
+			t.Errorf("isdelta(%q) should be %v", part, expected)
+		}
+	}
+}
+
+func TestDeltas(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	storage := NewS3Storage(bucket, "/")
+	writer, err := NewWithStorage(storage, 10, WithDeltas(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	reader, err := NewWithStorage(storage, 10, WithDeltas(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k1"), []byte("v1"))
+	bld.Put([]byte("b"), []byte("k2"), []byte("v2"))
+	err = bld.Commit(writer, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(db *DB, key, value string) {
+		v, err := db.Get("part", []byte("b"), []byte(key))
+		if value == "" {
+			if err == nil {
+				t.Errorf("%s: expected not found, got %s", key, v)
+			}
+			return
+		}
+		if err != nil || string(v) != value {
+			t.Errorf("%s: expected %s, got %s %v", key, value, v, err)
+		}
+	}
+	expect(reader, "k1", "v1")
+
+	d := writer.NewDelta("part")
+	d.Put([]byte("b"), []byte("k3"), []byte("v3"))
+	d.Delete([]byte("b"), []byte("k1"))
+	err = d.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(writer, "k1", "")
+	expect(writer, "k3", "v3")
+	//The base did not change, the reader finds the delta
+	report := reader.CheckExpiry()
+	if len(report.Expired) != 1 {
+		t.Errorf("expected part to expire, got %+v", report)
+	}
+	expect(reader, "k1", "")
+	expect(reader, "k2", "v2")
+	expect(reader, "k3", "v3")
+	entries, err := storage.List("")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("deltas must not be listed, got %+v %v", entries, err)
+	}
+
+	//The third delta compacts
+	for _, k := range []string{"k4", "k5"} {
+		d = writer.NewDelta("part")
+		d.Put([]byte("b"), []byte(k), []byte("v"))
+		err = d.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, _, err := writer.listdeltas("part")
+	if err != nil || len(names) != 0 {
+		t.Errorf("expected deltas to be compacted, got %v %v", names, err)
+	}
+	//Compacted into the partition itself
+	plain, err := NewWithStorage(storage, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	expect(plain, "k1", "")
+	expect(plain, "k3", "v3")
+	expect(plain, "k5", "v")
+
+	//Deltas without a partition start an empty one
+	d = writer.NewDelta("new")
+	d.Put([]byte("b"), []byte("k"), []byte("v"))
+	err = d.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := reader.Get("new", []byte("b"), []byte("k"))
+	if err != nil || string(v) != "v" {
+		t.Errorf("expected v, got %s %v", v, err)
+	}
+	err = plain.NewDelta("part").Commit()
+	if errors.Cause(err) != ErrNoDeltas {
+		t.Errorf("expected ErrNoDeltas, got %v", err)
+	}
+}
+
+func TestDeltaGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-deltas-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Listing storage, and storage that can only be probed
+	for name, storage := range map[string]Storage{"list": fs, "probe": &flakystorage{Storage: fs}} {
+		partid := "part-" + name
+		db, err := NewWithStorage(storage, 10, WithDeltas(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		setpart := func(v string) {
+			bld, err := NewBuilder(partid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bld.Put([]byte("b"), []byte("k"), []byte(v))
+			err = bld.Commit(db, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		commit := func(k, v string) {
+			d := db.NewDelta(partid)
+			d.Put([]byte("b"), []byte(k), []byte(v))
+			err := d.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect := func(k, value string) {
+			v, err := db.Get(partid, []byte("b"), []byte(k))
+			if value == "" && err == nil {
+				t.Errorf("%s %s: expected not found, got %s", name, k, v)
+			}
+			if value != "" && (err != nil || string(v) != value) {
+				t.Errorf("%s %s: expected %s, got %s %v", name, k, value, v, err)
+			}
+		}
+		setpart("v1")
+		commit("k", "d1")
+		commit("old", "d2")
+		old, err := db.deltagen(partid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect("k", "d1")
+		expect("old", "d2")
+		//A failed cleanup leaves a delta of the old partition behind
+		tf := gettmpfile(t)
+		fname, _, _, _, err := fs.Get(deltaname(partid, old, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Rename(fname, tf)
+		time.Sleep(10 * time.Millisecond)
+		setpart("v2")
+		err = fs.Put(deltaname(partid, old, 2), tf, true)
+		os.Remove(tf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//The new partition ignores it, and gets its own first delta
+		expect("k", "v2")
+		expect("old", "")
+		commit("new", "d3")
+		expect("new", "d3")
+		expect("old", "")
+		gen, err := db.deltagen(partid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, found, _ := fs.Stat(deltaname(partid, gen, 1)); !found {
+			t.Errorf("%s: expected the first delta of the new partition", name)
+		}
+		//Removed by the next replacement when listing, the probe only finds its own generation
+		setpart("v3")
+		_, found, _ := fs.Stat(deltaname(partid, old, 2))
+		if found != (name == "probe") {
+			t.Errorf("%s: unexpected stale delta %v", name, found)
+		}
+		if _, found, _ := fs.Stat(deltaname(partid, gen, 1)); found {
+			t.Errorf("%s: expected the delta of the replaced partition to be removed", name)
+		}
+		expect("new", "")
+		err = db.DeletePart(partid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
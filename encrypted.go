@@ -0,0 +1,508 @@
+package infreqdb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//encmagic starts every encrypted partition file
+var encmagic = []byte("IFQENC\x01")
+
+const (
+	//encchunk is the plaintext size of one sealed chunk
+	encchunk = 64 * 1024
+	//encsalt is the size of the random salt the key of each file is derived with
+	encsalt = 32
+	//metakeyid and metaplainsum are the user metadata EncryptedStorage records, see MetaStorage
+	metakeyid    = "key-id"
+	metaplainsum = "plain-sha256"
+)
+
+//KeyProvider hands out AES keys for EncryptedStorage.
+//Keys are 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	//CurrentKey returns the key new partitions are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	//Key returns the key with id, used to decrypt partitions written earlier
+	Key(id string) ([]byte, error)
+}
+
+//StaticKeys is a KeyProvider backed by a fixed set of keys
+type StaticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+//NewStaticKeys creates a KeyProvider that encrypts with keys[current].
+//Keep retired keys in the map until every partition has been re-encrypted.
+func NewStaticKeys(current string, keys map[string][]byte) *StaticKeys {
+	return &StaticKeys{current: current, keys: keys}
+}
+
+//CurrentKey returns the current key
+func (sk *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := sk.Key(sk.current)
+	return sk.current, key, err
+}
+
+//Key looks up a key by id
+func (sk *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := sk.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Key id %q not found", id)
+	}
+	return key, nil
+}
+
+//EncryptedStorage wraps a Storage and encrypts partitions before they are handed to it.
+//Files are compressed, then sealed with AES-GCM in 64KiB chunks so they are never held in
+//memory as a whole. Every file is sealed with its own key, derived from the current key
+//and a random salt, so chunk nonces never repeat under a key.
+//The id of the key used is recorded in the object metadata if the wrapped storage is a
+//MetaStorage, with the checksum of the plain partition, and in the authenticated file header,
+//so keys can be rotated while older partitions remain readable.
+//Ciphertext does not compress, it is put with PartMeta.Raw.
+type EncryptedStorage struct {
+	storage Storage
+	keys    KeyProvider
+}
+
+//NewEncryptedStorage creates an EncryptedStorage on top of storage
+func NewEncryptedStorage(storage Storage, keys KeyProvider) *EncryptedStorage {
+	return &EncryptedStorage{storage: storage, keys: keys}
+}
+
+//Get retrieves and decrypts a partition
+func (es *EncryptedStorage) Get(part string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	fname, found, mutable, lastmod, _, err = es.GetEngine(part)
+	return
+}
+
+//GetEngine retrieves and decrypts a partition, returning the engine recorded by the wrapped storage
+func (es *EncryptedStorage) GetEngine(part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	encname, found, mutable, lastmod, engine, err := getengine(es.storage, part)
+	if err != nil || !found {
+		return
+	}
+	defer os.Remove(encname)
+	fname, _, err = es.decrypt(encname)
+	if err != nil {
+		err = errors.Wrap(err, part)
+	}
+	return
+}
+
+//Put encrypts a partition with the current key and stores it
+func (es *EncryptedStorage) Put(part, fname string, mutable bool) error {
+	return es.PutEngine(part, fname, mutable, enginename(fname, nil))
+}
+
+//PutEngine is Put recording the engine of the plain partition, the wrapped storage can't tell
+func (es *EncryptedStorage) PutEngine(part, fname string, mutable bool, engine string) error {
+	return es.PutMeta(part, fname, PartMeta{Mutable: mutable, Engine: engine})
+}
+
+//PutMeta encrypts a partition and stores it recording meta, see MetaStorage
+func (es *EncryptedStorage) PutMeta(part, fname string, meta PartMeta) error {
+	encname, meta, err := es.encrypt(fname, meta)
+	if err != nil {
+		return errors.Wrap(err, part)
+	}
+	defer os.Remove(encname)
+	return putmeta(es.storage, part, encname, meta)
+}
+
+//Meta returns the metadata of the plain partition, see MetaStorage
+func (es *EncryptedStorage) Meta(part string) (PartMeta, bool, error) {
+	ms, err := metaof(es.storage)
+	if err != nil {
+		return PartMeta{}, false, err
+	}
+	meta, found, err := ms.Meta(part)
+	if err != nil || !found {
+		return meta, found, err
+	}
+	user := make(map[string]string)
+	for k, v := range meta.User {
+		user[k] = v
+	}
+	meta.SHA256 = user[metaplainsum]
+	meta.Raw = false
+	delete(user, metakeyid)
+	delete(user, metaplainsum)
+	meta.User = user
+	return meta, true, nil
+}
+
+//GetTag retrieves and decrypts a partition, the tag is of the encrypted object
+func (es *EncryptedStorage) GetTag(part string) (fname string, found, mutable bool, tag string, err error) {
+	c, err := conditionalof(es.storage)
+	if err != nil {
+		return
+	}
+	encname, found, mutable, tag, err := c.GetTag(part)
+	if err != nil || !found {
+		return
+	}
+	defer os.Remove(encname)
+	fname, _, err = es.decrypt(encname)
+	if err != nil {
+		err = errors.Wrap(err, part)
+	}
+	return
+}
+
+//PutIf encrypts a partition and stores it if the encrypted object still has tag
+func (es *EncryptedStorage) PutIf(part, fname string, mutable bool, tag string) error {
+	if _, err := conditionalof(es.storage); err != nil {
+		return err
+	}
+	encname, meta, err := es.encrypt(fname, PartMeta{Mutable: mutable, Engine: enginename(fname, nil)})
+	if err != nil {
+		return errors.Wrap(err, part)
+	}
+	defer os.Remove(encname)
+	return putmetaif(es.storage, part, encname, meta, tag)
+}
+
+//Delete passes through to the wrapped storage
+func (es *EncryptedStorage) Delete(part string) error {
+	return es.storage.Delete(part)
+}
+
+//Stat passes through to the wrapped storage
+func (es *EncryptedStorage) Stat(part string) (time.Time, bool, error) {
+	return es.storage.Stat(part)
+}
+
+//List passes through to the wrapped storage, sizes are of the encrypted files
+func (es *EncryptedStorage) List(prefix string) ([]PartEntry, error) {
+	l, err := listerof(es.storage)
+	if err != nil {
+		return nil, err
+	}
+	return l.List(prefix)
+}
+
+//ListNames passes through to the wrapped storage
+func (es *EncryptedStorage) ListNames(prefix string) ([]string, error) {
+	l, err := namelisterof(es.storage)
+	if err != nil {
+		return nil, err
+	}
+	return l.ListNames(prefix)
+}
+
+//GetVersion retrieves and decrypts a version of a partition
+func (es *EncryptedStorage) GetVersion(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	fname, found, mutable, lastmod, _, err = es.GetVersionEngine(part, versionID)
+	return
+}
+
+//GetVersionEngine retrieves and decrypts a version of a partition, returning the engine
+//recorded by the wrapped storage, see EngineVersioner
+func (es *EncryptedStorage) GetVersionEngine(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	v, err := versionerof(es.storage)
+	if err != nil {
+		return
+	}
+	encname, found, mutable, lastmod, engine, err := getversionengine(v, part, versionID)
+	if err != nil || !found {
+		return
+	}
+	defer os.Remove(encname)
+	fname, _, err = es.decrypt(encname)
+	if err != nil {
+		err = errors.Wrap(err, part)
+	}
+	return
+}
+
+//ListVersions passes through to the wrapped storage
+func (es *EncryptedStorage) ListVersions(part string) ([]PartVersion, error) {
+	v, err := versionerof(es.storage)
+	if err != nil {
+		return nil, err
+	}
+	return v.ListVersions(part)
+}
+
+//Reencrypt rewrites a partition with the current key if it was encrypted with an older one.
+//Returns true if the partition was rewritten. Partitions whose metadata already names
+//the current key are not downloaded.
+func (es *EncryptedStorage) Reencrypt(part string) (bool, error) {
+	current, _, err := es.keys.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+	if ms, ok := es.storage.(MetaStorage); ok {
+		meta, found, err := ms.Meta(part)
+		if err != nil || !found {
+			return false, err
+		}
+		if meta.User[metakeyid] == current {
+			return false, nil
+		}
+	}
+	encname, found, mutable, _, engine, err := getengine(es.storage, part)
+	if err != nil || !found {
+		return false, err
+	}
+	defer os.Remove(encname)
+	fname, id, err := es.decrypt(encname)
+	if err != nil {
+		return false, errors.Wrap(err, part)
+	}
+	defer os.Remove(fname)
+	if id == current {
+		return false, nil
+	}
+	return true, es.PutMeta(part, fname, PartMeta{Mutable: mutable, Engine: engine})
+}
+
+//encheader builds the file header which is also the additional data of every chunk
+func encheader(id string, salt []byte) []byte {
+	var hdr bytes.Buffer
+	hdr.Write(encmagic)
+	binary.Write(&hdr, binary.BigEndian, uint16(len(id)))
+	hdr.WriteString(id)
+	binary.Write(&hdr, binary.BigEndian, uint32(encchunk))
+	hdr.Write(salt)
+	return hdr.Bytes()
+}
+
+//encnonce is the chunk counter and a flag marking the last chunk, unique as every file has its own key.
+//The flag stops an attacker from truncating the file at a chunk boundary.
+func encnonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+//filegcm creates the AES-GCM cipher of one file, keyed with HMAC-SHA256 of salt under key
+func filegcm(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("infreqdb file key"))
+	mac.Write(salt)
+	filekey := mac.Sum(nil)
+	if len(key) < len(filekey) {
+		//Same strength as key, AES-128 stays AES-128
+		filekey = filekey[:len(key)]
+	}
+	block, err := aes.NewCipher(filekey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//encrypt seals fname into a new temp file, returning meta with what EncryptedStorage records added
+func (es *EncryptedStorage) encrypt(fname string, meta PartMeta) (string, PartMeta, error) {
+	id, key, err := es.keys.CurrentKey()
+	if err != nil {
+		return "", meta, err
+	}
+	if len(id) > 0xffff {
+		return "", meta, fmt.Errorf("Key id too long")
+	}
+	salt := make([]byte, encsalt)
+	if _, err = rand.Read(salt); err != nil {
+		return "", meta, err
+	}
+	gcm, err := filegcm(key, salt)
+	if err != nil {
+		return "", meta, err
+	}
+	in, err := os.Open(fname)
+	if err != nil {
+		return "", meta, err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile("", "infreqdb-enc-")
+	if err != nil {
+		return "", meta, err
+	}
+	//Compress on the way in, closing pr stops the compressor if sealing fails
+	sum := sha256.New()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		zw, err := flate.NewWriter(pw, flate.DefaultCompression)
+		if err == nil {
+			_, err = io.Copy(io.MultiWriter(zw, sum), in)
+		}
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err = sealchunks(gcm, encheader(id, salt), bufio.NewReader(pr), out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", meta, err
+	}
+	user := map[string]string{metakeyid: id, metaplainsum: hex.EncodeToString(sum.Sum(nil))}
+	for k, v := range meta.User {
+		if _, ours := user[k]; !ours {
+			user[k] = v
+		}
+	}
+	meta.User = user
+	meta.Raw = true
+	return out.Name(), meta, nil
+}
+
+//sealchunks writes the header followed by sealed chunks of r
+func sealchunks(gcm cipher.AEAD, hdr []byte, r *bufio.Reader, w io.Writer) error {
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	buf := make([]byte, encchunk)
+	var sealed []byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		_, peek := r.Peek(1)
+		last := peek != nil
+		sealed = gcm.Seal(sealed[:0], encnonce(counter, last), buf[:n], hdr)
+		if _, err = w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if counter == 0xffffffff {
+			return fmt.Errorf("Partition too large to encrypt")
+		}
+	}
+}
+
+//decrypt opens encname into a new temp file, returning its name and the key id used
+func (es *EncryptedStorage) decrypt(encname string) (string, string, error) {
+	in, err := os.Open(encname)
+	if err != nil {
+		return "", "", err
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+	hdr, id, salt, err := readencheader(r)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := es.keys.Key(id)
+	if err != nil {
+		return "", "", err
+	}
+	gcm, err := filegcm(key, salt)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := ioutil.TempFile("", "infreqdb-")
+	if err != nil {
+		return "", "", err
+	}
+	err = openflatechunks(gcm, hdr, r, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", err
+	}
+	return out.Name(), id, nil
+}
+
+//openflatechunks decrypts sealed chunks from r and decompresses them into w
+func openflatechunks(gcm cipher.AEAD, hdr []byte, r *bufio.Reader, w io.Writer) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		zr := flate.NewReader(pr)
+		_, err := io.Copy(w, zr)
+		zr.Close()
+		//Unblocks openchunks if decompressing failed
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	err := openchunks(gcm, hdr, r, pw)
+	pw.CloseWithError(err)
+	zerr := <-done
+	if err == nil && zerr != nil {
+		//Authenticated, so this is not tampering but a broken writer
+		err = errors.Wrapf(ErrCorruptPartition, "decompress: %v", zerr)
+	}
+	return err
+}
+
+//readencheader parses the file header
+func readencheader(r io.Reader) (hdr []byte, id string, salt []byte, err error) {
+	magic := make([]byte, len(encmagic))
+	if _, err = io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, encmagic) {
+		return nil, "", nil, ErrNotEncrypted
+	}
+	var idlen uint16
+	if err = binary.Read(r, binary.BigEndian, &idlen); err != nil {
+		return nil, "", nil, errors.Wrap(ErrCorruptPartition, "header")
+	}
+	idb := make([]byte, idlen)
+	var chunk uint32
+	salt = make([]byte, encsalt)
+	if _, err = io.ReadFull(r, idb); err == nil {
+		err = binary.Read(r, binary.BigEndian, &chunk)
+	}
+	if err == nil {
+		_, err = io.ReadFull(r, salt)
+	}
+	if err != nil || chunk != encchunk {
+		return nil, "", nil, errors.Wrap(ErrCorruptPartition, "header")
+	}
+	id = string(idb)
+	return encheader(id, salt), id, salt, nil
+}
+
+//openchunks decrypts sealed chunks from r into w
+func openchunks(gcm cipher.AEAD, hdr []byte, r *bufio.Reader, w io.Writer) error {
+	buf := make([]byte, encchunk+gcm.Overhead())
+	var plain []byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		_, peek := r.Peek(1)
+		last := peek != nil
+		plain, err = gcm.Open(plain[:0], encnonce(counter, last), buf[:n], hdr)
+		if err != nil {
+			return errors.Wrapf(ErrCorruptPartition, "chunk %d: %v", counter, err)
+		}
+		if _, err = w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
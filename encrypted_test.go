@@ -0,0 +1,183 @@
+package infreqdb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	raw := NewS3Storage(bucket, "/")
+	k1 := bytes.Repeat([]byte{1}, 32)
+	k2 := bytes.Repeat([]byte{2}, 32)
+	storage := NewEncryptedStorage(raw, NewStaticKeys("k1", map[string][]byte{"k1": k1}))
+	//A few chunks plus a partial one
+	plain := make([]byte, 3*encchunk+123)
+	rand.Read(plain)
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	err = ioutil.WriteFile(tf, plain, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Put("foo", tf, true)
+	if err != nil {
+		t.Error(err)
+	}
+	//What the inner storage sees must not be the plaintext
+	encname, _, _, _, err := raw.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadFile(encname)
+	os.Remove(encname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plain[:64]) {
+		t.Error("plaintext leaked into storage")
+	}
+	fname, found, mutable, _, err := storage.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !mutable {
+		t.Errorf("expected found and mutable, got %v %v", found, mutable)
+	}
+	got, err := ioutil.ReadFile(fname)
+	os.Remove(fname)
+	if !bytes.Equal(got, plain) {
+		t.Error("decrypted partition differs from original")
+	}
+	//Rotate to k2, k1 partitions must stay readable until re-encrypted
+	storage = NewEncryptedStorage(raw, NewStaticKeys("k2", map[string][]byte{"k1": k1, "k2": k2}))
+	fname, _, _, _, err = storage.Get("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	os.Remove(fname)
+	rotated, err := storage.Reencrypt("foo")
+	if err != nil || !rotated {
+		t.Errorf("expected partition to be re-encrypted, got %v %v", rotated, err)
+	}
+	rotated, err = storage.Reencrypt("foo")
+	if err != nil || rotated {
+		t.Errorf("expected partition to be current, got %v %v", rotated, err)
+	}
+	storage = NewEncryptedStorage(raw, NewStaticKeys("k2", map[string][]byte{"k2": k2}))
+	fname, _, _, _, err = storage.Get("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	os.Remove(fname)
+	//Tampering is detected
+	sealed[len(sealed)-20] ^= 0xff
+	err = ioutil.WriteFile(tf, sealed, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = raw.Put("foo", tf, true)
+	if err != nil {
+		t.Error(err)
+	}
+	storage = NewEncryptedStorage(raw, NewStaticKeys("k1", map[string][]byte{"k1": k1}))
+	_, _, _, _, err = storage.Get("foo")
+	if errors.Cause(err) != ErrCorruptPartition {
+		t.Errorf("expected %v, got %v", ErrCorruptPartition, err)
+	}
+	//Truncation at a chunk boundary is detected
+	hdrlen := len(encheader("k1", make([]byte, encsalt)))
+	err = ioutil.WriteFile(tf, sealed[:hdrlen+encchunk+16], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Put("foo", tf, true)
+	_, _, _, _, err = storage.Get("foo")
+	if errors.Cause(err) != ErrCorruptPartition {
+		t.Errorf("expected %v, got %v", ErrCorruptPartition, err)
+	}
+	//Plain partitions are refused
+	err = raw.Put("foo", os.DevNull, true)
+	if err != nil {
+		t.Error(err)
+	}
+	_, _, _, _, err = storage.Get("foo")
+	if errors.Cause(err) != ErrNotEncrypted {
+		t.Errorf("expected %v, got %v", ErrNotEncrypted, err)
+	}
+}
+
+func TestEncryptedCompression(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := NewS3Storage(bucket, "/")
+	k1 := bytes.Repeat([]byte{1}, 32)
+	storage := NewEncryptedStorage(raw, NewStaticKeys("k1", map[string][]byte{"k1": k1}))
+	plain := bytes.Repeat([]byte("compressible "), encchunk)
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	err = ioutil.WriteFile(tf, plain, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Put("foo", tf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Compressed before sealing, stored as it is
+	resp, err := bucket.Head("/foo", map[string][]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("x-amz-meta-raw") == "" || resp.ContentLength >= int64(len(plain))/10 {
+		t.Errorf("expected a small raw object, got %d bytes raw %q", resp.ContentLength, resp.Header.Get("x-amz-meta-raw"))
+	}
+	fname, _, _, _, err := storage.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(fname)
+	os.Remove(fname)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("decrypted partition differs from original %v", err)
+	}
+
+	//Key id and plain checksum are in the metadata, every file has its own key
+	meta, found, err := raw.Meta("foo")
+	if err != nil || !found || meta.User[metakeyid] != "k1" || !meta.Raw {
+		t.Errorf("expected raw object with key id k1, got %+v %v %v", meta, found, err)
+	}
+	meta, _, err = storage.Meta("foo")
+	sum := sha256.Sum256(plain)
+	if err != nil || meta.SHA256 != hex.EncodeToString(sum[:]) || len(meta.User) != 0 {
+		t.Errorf("expected plain checksum, got %+v %v", meta, err)
+	}
+	first, _, err := storage.encrypt(tf, PartMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(first)
+	second, _, err := storage.encrypt(tf, PartMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(second)
+	b1, _ := ioutil.ReadFile(first)
+	b2, _ := ioutil.ReadFile(second)
+	hdrlen := len(encheader("k1", make([]byte, encsalt)))
+	if len(b1) != len(b2) || bytes.Equal(b1[:hdrlen], b2[:hdrlen]) || bytes.Equal(b1[hdrlen:hdrlen+16], b2[hdrlen:hdrlen+16]) {
+		t.Error("expected a different salt and ciphertext for every file")
+	}
+}
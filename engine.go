@@ -0,0 +1,487 @@
+package infreqdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/boltdb/bolt"
+	bbolt "go.etcd.io/bbolt"
+)
+
+//headerSize is how much of the start of a file Engine.Detect gets to see
+const headerSize = 64
+
+//Engine reads and writes partition files of one format. A partition is opened by the engine
+//recorded in its storage metadata, see EngineStorage. Without one, or if that engine is not
+//configured, by the first engine, in the order given to WithEngines, recognizing the start of
+//its file. So partitions of several engines live side by side while they are migrated,
+//e.g. by a Compactor.
+type Engine interface {
+	//Name identifies the engine. Storages record the name of the engine that built a
+	//partition in its metadata, see PartEntry.
+	Name() string
+	//Detect tells if a file starting with header is in the engine's format.
+	//header holds 64 bytes, fewer only if the file is shorter.
+	Detect(header []byte) bool
+	//Open opens fname read-only
+	Open(fname string) (PartReader, error)
+	//Build writes every bucket and key of src to a new file fname
+	Build(fname string, src PartReader) error
+}
+
+//PartReader reads a partition file opened by an Engine, it is safe for concurrent use.
+//Nested buckets are addressed by their path, a missing bucket is reported as *BucketNotFoundError.
+type PartReader interface {
+	//Get returns a copy of the value of key in the bucket at path, nil if there is no such key
+	Get(path [][]byte, key []byte) ([]byte, error)
+	//Iterate calls fn for keys in [start, end) of the bucket at path, in key order.
+	//nil start begins at the first key, nil end runs to the last one.
+	//v is nil for nested buckets, k and v are only valid during the call.
+	Iterate(path [][]byte, start, end []byte, fn func(k, v []byte) error) error
+	//Buckets describes the top level buckets in name order, Keys includes those of nested buckets
+	Buckets() ([]BucketRange, error)
+	//Size of the file in bytes
+	Size() int64
+	Close() error
+}
+
+//boltviewer is a PartReader running bolt transactions, needed by DB.View
+type boltviewer interface {
+	View(fn func(*bolt.Tx) error) error
+}
+
+var (
+	//BoltEngine reads and writes github.com/boltdb/bolt files, the format partitions always had
+	BoltEngine Engine = boltengine{}
+	//BBoltEngine reads and writes go.etcd.io/bbolt files, which are bolt files too.
+	//Partitions it opens only support engine neutral reads, DB.View needs BoltEngine.
+	BBoltEngine Engine = bboltengine{}
+	//TableEngine reads and writes immutable sorted tables of top level buckets. Keys are kept
+	//in blocks behind an index, opening a table reads the index and a Get a single block,
+	//from storage in place with WithRangeReads. Nested buckets can't be stored, DB.View is not supported.
+	TableEngine Engine = tableengine{}
+)
+
+//defaultEngines open partitions unless WithEngines says otherwise
+var defaultEngines = []Engine{BoltEngine, TableEngine}
+
+//WithEngines sets the engines partitions are opened with, tried in order.
+//Defaults to BoltEngine then TableEngine, put BBoltEngine first to read bolt files with bbolt.
+func WithEngines(engines ...Engine) Option {
+	return func(db *DB) {
+		db.engines = engines
+	}
+}
+
+//readheader reads the start of fname for Engine.Detect
+func readheader(fname string) ([]byte, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(f, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return header[:n], err
+}
+
+//detectengine returns the first of engines recognizing fname, nil if none does
+func detectengine(fname string, engines []Engine) (Engine, error) {
+	header, err := readheader(fname)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range engines {
+		if e.Detect(header) {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+//openpart opens fname with the one of engines named engine, or the first of engines recognizing
+//it if no engine was recorded or it is not among engines. nil engines are the defaults.
+func openpart(fname, engine string, engines []Engine) (PartReader, Engine, error) {
+	if engines == nil {
+		engines = defaultEngines
+	}
+	e := enginenamed(engine, engines)
+	if e == nil {
+		var err error
+		e, err = detectengine(fname, engines)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if e == nil {
+		return nil, nil, ErrUnknownEngine
+	}
+	r, err := e.Open(fname)
+	return r, e, err
+}
+
+//OpenPartFile opens a local partition file read-only, e.g. to inspect it, with the one of engines
+//named engine, or the first of engines recognizing it. No engines means the defaults.
+func OpenPartFile(fname, engine string, engines ...Engine) (PartReader, Engine, error) {
+	return openpart(fname, engine, engines)
+}
+
+//enginenamed returns the one of engines named name, nil if there is none
+func enginenamed(name string, engines []Engine) Engine {
+	if name == "" {
+		return nil
+	}
+	for _, e := range engines {
+		if e.Name() == name {
+			return e
+		}
+	}
+	return nil
+}
+
+//enginename names the engine of fname for storage metadata, the first of engines recognizing
+//it, nil engines are the defaults. "" if unknown.
+func enginename(fname string, engines []Engine) string {
+	if engines == nil {
+		engines = defaultEngines
+	}
+	e, err := detectengine(fname, engines)
+	if err != nil || e == nil {
+		return ""
+	}
+	return e.Name()
+}
+
+//copyvalue copies v, keeping missing and empty values apart
+func copyvalue(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+//walkpart calls fn for every bucket and key of r in order.
+//fn gets a nil k as a bucket starts, so empty buckets are seen too.
+func walkpart(r PartReader, fn func(path [][]byte, k, v []byte) error) error {
+	buckets, err := r.Buckets()
+	if err != nil {
+		return err
+	}
+	for _, br := range buckets {
+		err = walkbucket(r, [][]byte{[]byte(br.Name)}, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//walkbucket is walkpart for the bucket at path and its nested buckets
+func walkbucket(r PartReader, path [][]byte, fn func(path [][]byte, k, v []byte) error) error {
+	err := fn(path, nil, nil)
+	if err != nil {
+		return err
+	}
+	return r.Iterate(path, nil, nil, func(k, v []byte) error {
+		if v == nil {
+			return walkbucket(r, append(path[:len(path):len(path)], k), fn)
+		}
+		return fn(path, k, v)
+	})
+}
+
+//boltMagic identifies bolt files, it follows the page header of the first meta page
+const boltMagic = 0xED0CDAED
+
+//isbolt tells if header starts a bolt file, written in either byte order
+func isbolt(header []byte) bool {
+	if len(header) < 20 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(header[16:]) == boltMagic || binary.BigEndian.Uint32(header[16:]) == boltMagic
+}
+
+type boltengine struct{}
+
+func (boltengine) Name() string {
+	return "bolt"
+}
+
+func (boltengine) Detect(header []byte) bool {
+	return isbolt(header)
+}
+
+func (boltengine) Open(fname string) (PartReader, error) {
+	bdb, err := bolt.Open(fname, os.ModeExclusive, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return &boltreader{db: bdb}, nil
+}
+
+//Build packs pages full, see Compactor
+func (boltengine) Build(fname string, src PartReader) error {
+	dst, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		return err
+	}
+	p := &packer{dst: dst}
+	err = walkpart(src, p.put)
+	if err == nil {
+		err = p.commit()
+	} else if p.tx != nil {
+		p.tx.Rollback()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//boltreader reads a bolt file
+type boltreader struct {
+	db *bolt.DB
+}
+
+func (br *boltreader) View(fn func(*bolt.Tx) error) error {
+	return br.db.View(fn)
+}
+
+func (br *boltreader) Get(path [][]byte, key []byte) (v []byte, err error) {
+	err = br.db.View(func(tx *bolt.Tx) error {
+		b, err := bucketpath(tx, path)
+		if err != nil {
+			return err
+		}
+		//Values are only valid inside the transaction
+		v = copyvalue(b.Get(key))
+		return nil
+	})
+	return
+}
+
+func (br *boltreader) Iterate(path [][]byte, start, end []byte, fn func(k, v []byte) error) error {
+	return br.db.View(func(tx *bolt.Tx) error {
+		b, err := bucketpath(tx, path)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if start == nil {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(start)
+		}
+		for ; k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (br *boltreader) Buckets() (buckets []BucketRange, err error) {
+	err = br.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			r := BucketRange{Name: string(name), Keys: b.Stats().KeyN}
+			c := b.Cursor()
+			if k, _ := c.First(); k != nil {
+				r.Min = append([]byte(nil), k...)
+			}
+			if k, _ := c.Last(); k != nil {
+				r.Max = append([]byte(nil), k...)
+			}
+			buckets = append(buckets, r)
+			return nil
+		})
+	})
+	return
+}
+
+func (br *boltreader) Size() (size int64) {
+	br.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return
+}
+
+func (br *boltreader) Close() error {
+	return br.db.Close()
+}
+
+type bboltengine struct{}
+
+func (bboltengine) Name() string {
+	return "bbolt"
+}
+
+func (bboltengine) Detect(header []byte) bool {
+	return isbolt(header)
+}
+
+func (bboltengine) Open(fname string) (PartReader, error) {
+	bdb, err := bbolt.Open(fname, os.ModeExclusive, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return &bboltreader{db: bdb}, nil
+}
+
+//Build packs pages full, like BoltEngine does
+func (bboltengine) Build(fname string, src PartReader) error {
+	dst, err := bbolt.Open(fname, 0600, nil)
+	if err != nil {
+		return err
+	}
+	p := &bboltpacker{dst: dst}
+	err = walkpart(src, p.put)
+	if err == nil {
+		err = p.commit()
+	} else if p.tx != nil {
+		p.tx.Rollback()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//bboltreader reads a bolt file with bbolt
+type bboltreader struct {
+	db *bbolt.DB
+}
+
+//bucket walks nested buckets like bucketpath
+func (br *bboltreader) bucket(tx *bbolt.Tx, path [][]byte) (*bbolt.Bucket, error) {
+	if len(path) == 0 {
+		return nil, ErrEmptyPath
+	}
+	b := tx.Bucket(path[0])
+	if b == nil {
+		return nil, &BucketNotFoundError{Path: path, Depth: 0}
+	}
+	for i := 1; i < len(path); i++ {
+		if b = b.Bucket(path[i]); b == nil {
+			return nil, &BucketNotFoundError{Path: path, Depth: i}
+		}
+	}
+	return b, nil
+}
+
+func (br *bboltreader) Get(path [][]byte, key []byte) (v []byte, err error) {
+	err = br.db.View(func(tx *bbolt.Tx) error {
+		b, err := br.bucket(tx, path)
+		if err != nil {
+			return err
+		}
+		v = copyvalue(b.Get(key))
+		return nil
+	})
+	return
+}
+
+func (br *bboltreader) Iterate(path [][]byte, start, end []byte, fn func(k, v []byte) error) error {
+	return br.db.View(func(tx *bbolt.Tx) error {
+		b, err := br.bucket(tx, path)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if start == nil {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(start)
+		}
+		for ; k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (br *bboltreader) Buckets() (buckets []BucketRange, err error) {
+	err = br.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			r := BucketRange{Name: string(name), Keys: b.Stats().KeyN}
+			c := b.Cursor()
+			if k, _ := c.First(); k != nil {
+				r.Min = append([]byte(nil), k...)
+			}
+			if k, _ := c.Last(); k != nil {
+				r.Max = append([]byte(nil), k...)
+			}
+			buckets = append(buckets, r)
+			return nil
+		})
+	})
+	return
+}
+
+func (br *bboltreader) Size() (size int64) {
+	br.db.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return
+}
+
+func (br *bboltreader) Close() error {
+	return br.db.Close()
+}
+
+//bboltpacker is packer for bbolt
+type bboltpacker struct {
+	dst  *bbolt.DB
+	tx   *bbolt.Tx
+	size int
+}
+
+//put writes k and v into the bucket at path, creating buckets as needed. A nil k only creates them.
+func (p *bboltpacker) put(path [][]byte, k, v []byte) error {
+	if p.size >= packBatch {
+		err := p.commit()
+		if err != nil {
+			return err
+		}
+	}
+	if p.tx == nil {
+		var err error
+		p.tx, err = p.dst.Begin(true)
+		if err != nil {
+			return err
+		}
+	}
+	b, err := p.tx.CreateBucketIfNotExists(path[0])
+	for i := 1; err == nil && i < len(path); i++ {
+		b.FillPercent = 1
+		b, err = b.CreateBucketIfNotExists(path[i])
+	}
+	if err != nil || k == nil {
+		return err
+	}
+	b.FillPercent = 1
+	p.size += len(k) + len(v)
+	//Source keys and values are only valid during the walk
+	return b.Put(copyvalue(k), copyvalue(v))
+}
+
+//commit ends the current transaction
+func (p *bboltpacker) commit() error {
+	if p.tx == nil {
+		return nil
+	}
+	err := p.tx.Commit()
+	p.tx, p.size = nil, 0
+	return err
+}
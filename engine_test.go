@@ -0,0 +1,249 @@
+package infreqdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+func TestDetectEngine(t *testing.T) {
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k"), []byte("v"))
+	bld.close()
+	defer os.Remove(bld.fname)
+	table, err := packfile(bld.fname, "", nil, TableEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(table)
+	junk := gettmpfile(t)
+	defer os.Remove(junk)
+	err = ioutil.WriteFile(junk, []byte("not a partition"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fname, expected := range map[string]string{bld.fname: "bolt", table: "table", junk: ""} {
+		if name := enginename(fname, nil); name != expected {
+			t.Errorf("expected %q, got %q", expected, name)
+		}
+	}
+	e, err := detectengine(bld.fname, []Engine{TableEngine, BBoltEngine, BoltEngine})
+	if err != nil || e != BBoltEngine {
+		t.Errorf("expected the first engine recognizing bolt, got %v %v", e, err)
+	}
+	_, _, err = openpart(junk, "", nil)
+	if err != ErrUnknownEngine {
+		t.Errorf("expected ErrUnknownEngine, got %v", err)
+	}
+}
+
+func TestEngines(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	storage := NewS3Storage(bucket, "/")
+	db, err := NewWithStorage(storage, 10, WithManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k1"), []byte("v1"))
+	bld.Put([]byte("b"), []byte("k2"), []byte("v2"))
+	bld.close()
+	defer os.Remove(bld.fname)
+	table, err := packfile(bld.fname, "", nil, TableEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(table)
+	err = db.SetPart("table", table, true)
+	if err == nil {
+		err = db.SetPart("bolt", bld.fname, true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, partid := range []string{"table", "bolt"} {
+		v, err := db.Get(partid, []byte("b"), []byte("k2"))
+		if err != nil || string(v) != "v2" {
+			t.Errorf("%s: expected v2, got %s %v", partid, v, err)
+		}
+		n := 0
+		err = db.RangePath(partid, [][]byte{[]byte("b")}, []byte("k2"), nil, func(k, v []byte) error {
+			n++
+			return nil
+		})
+		if err != nil || n != 1 {
+			t.Errorf("%s: expected 1 key, got %d %v", partid, n, err)
+		}
+		info, err := db.PartInfo(partid)
+		if err != nil || info.Engine != partid || len(info.Buckets) != 1 || info.Buckets[0].Keys != 2 {
+			t.Errorf("%s: unexpected info %+v %v", partid, info, err)
+		}
+	}
+	_, err = db.View("table", func(tx *bolt.Tx) error {
+		return nil
+	})
+	if errors.Cause(err) != ErrNotBolt {
+		t.Errorf("expected ErrNotBolt, got %v", err)
+	}
+	entries, err := storage.List("")
+	if err != nil || len(entries) != 2 || entries[0].Engine != "bolt" || entries[1].Engine != "table" {
+		t.Errorf("expected engines in metadata, got %+v %v", entries, err)
+	}
+	me, found, err := db.ManifestEntry("table")
+	if err != nil || !found || me.Engine != "table" || me.Buckets[0].Keys != 2 {
+		t.Errorf("unexpected manifest entry %+v %v %v", me, found, err)
+	}
+
+	//Migrating readers to bbolt needs no change to the files
+	bb, err := NewWithStorage(storage, 10, WithEngines(BBoltEngine, TableEngine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bb.Close()
+	v, err := bb.Get("bolt", []byte("b"), []byte("k1"))
+	if err != nil || string(v) != "v1" {
+		t.Errorf("expected v1, got %s %v", v, err)
+	}
+	info, err := bb.PartInfo("bolt")
+	if err != nil || info.Engine != "bbolt" {
+		t.Errorf("expected bbolt, got %+v %v", info, err)
+	}
+}
+
+func TestCompactorEngine(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10, WithDeltas(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k1"), []byte("v1"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCompactor(db)
+	c.Engine = TableEngine
+	res, err := c.Compact("part")
+	if err != nil || !res.Uploaded {
+		t.Fatalf("expected a move to table, got %+v %v", res, err)
+	}
+	info, err := db.PartInfo("part")
+	if err != nil || info.Engine != "table" {
+		t.Errorf("expected table, got %+v %v", info, err)
+	}
+	//Nothing changes once moved
+	res, err = c.Compact("part")
+	if err != nil || res.Uploaded {
+		t.Errorf("expected no upload, got %+v %v", res, err)
+	}
+	//Deltas turn the table back into bolt
+	d := db.NewDelta("part")
+	d.Put([]byte("b"), []byte("k2"), []byte("v2"))
+	err = d.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, expected := range map[string]string{"k1": "v1", "k2": "v2"} {
+		v, err := db.Get("part", []byte("b"), []byte(k))
+		if err != nil || string(v) != expected {
+			t.Errorf("%s: expected %s, got %s %v", k, expected, v, err)
+		}
+	}
+	info, err = db.PartInfo("part")
+	if err != nil || info.Engine != "bolt" {
+		t.Errorf("expected bolt, got %+v %v", info, err)
+	}
+}
+
+func TestRecordedEngine(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewS3Storage(bucket, "/")
+	db, err := NewWithStorage(storage, 10, WithEngines(BoltEngine, BBoltEngine, TableEngine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k1"), []byte("v1"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Same file format, the recorded name makes the difference
+	c := NewCompactor(db)
+	c.Engine = BBoltEngine
+	res, err := c.Compact("part")
+	if err != nil || !res.Uploaded {
+		t.Fatalf("expected a move to bbolt, got %+v %v", res, err)
+	}
+	entries, err := storage.List("")
+	if err != nil || len(entries) != 1 || entries[0].Engine != "bbolt" {
+		t.Errorf("expected bbolt in metadata, got %+v %v", entries, err)
+	}
+	info, err := db.PartInfo("part")
+	if err != nil || info.Engine != "bbolt" {
+		t.Errorf("expected bbolt, got %+v %v", info, err)
+	}
+	res, err = c.Compact("part")
+	if err != nil || res.Uploaded {
+		t.Errorf("expected no upload, got %+v %v", res, err)
+	}
+	//Without a recorded engine the first one recognizing the file opens it
+	plain, err := NewWithStorage(&flakystorage{Storage: storage}, 10, WithEngines(BoltEngine, BBoltEngine, TableEngine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	info, err = plain.PartInfo("part")
+	if err != nil || info.Engine != "bolt" {
+		t.Errorf("expected bolt, got %+v %v", info, err)
+	}
+	//SetPart records the first configured engine recognizing the file
+	bld, err = NewBuilder("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k1"), []byte("v1"))
+	bld.close()
+	defer os.Remove(bld.fname)
+	bb, err := NewWithStorage(storage, 10, WithEngines(BBoltEngine, TableEngine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bb.Close()
+	err = bb.SetPart("other", bld.fname, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _, engine, err := storage.GetEngine("other")
+	if err != nil || engine != "bbolt" {
+		t.Errorf("expected bbolt, got %q %v", engine, err)
+	}
+}
@@ -1,7 +1,12 @@
 package infreqdb
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/goamz/goamz/s3"
 	"github.com/pkg/errors"
@@ -12,8 +17,57 @@ var (
 	ErrKeyNotString = errors.New("Key must be a string")
 	//ErrInvalidObject occurs when object in cache is invalid.
 	ErrInvalidObject = errors.New("Returned object is incorrect type")
+	//ErrEmptyPath when a nested bucket path has no elements.
+	ErrEmptyPath = errors.New("Bucket path must not be empty")
+	//ErrAttemptTimeout when a storage request exceeds RetryPolicy.AttemptTimeout.
+	ErrAttemptTimeout = errors.New("Storage request timed out")
+	//ErrAmbiguousWrite when a conditional write timed out after it was sent, it may or may not have happened.
+	ErrAmbiguousWrite = errors.New("Storage write timed out, it may have happened")
+	//ErrCorruptPartition when a downloaded partition does not match what was uploaded.
+	ErrCorruptPartition = errors.New("Partition is corrupt")
+	//ErrNotEncrypted when EncryptedStorage reads a partition that was stored in the clear.
+	ErrNotEncrypted = errors.New("Partition is not encrypted")
+	//ErrListNotSupported when a storage can not enumerate its partitions, see Lister.
+	ErrListNotSupported = errors.New("Storage can not list partitions")
+	//ErrNoManifest when asking for the manifest of a DB created without WithManifest.
+	ErrNoManifest = errors.New("Manifest not enabled")
+	//ErrVersionsNotSupported when a storage does not keep older versions, see Versioner.
+	ErrVersionsNotSupported = errors.New("Storage does not keep versions")
+	//ErrSnapshotReleased when reading through a Snapshot after Release.
+	ErrSnapshotReleased = errors.New("Snapshot was released")
+	//ErrNoDeltas when committing a Delta to a DB created without WithDeltas.
+	ErrNoDeltas = errors.New("Deltas not enabled")
+	//ErrUnknownEngine when none of the engines recognizes a partition file, see WithEngines.
+	ErrUnknownEngine = errors.New("No engine recognizes the partition")
+	//ErrNotBolt when View is asked for a partition opened by another engine than BoltEngine.
+	ErrNotBolt = errors.New("Partition is not opened with bolt")
+	//ErrPartitionChanged when a partition read in ranges changed in storage, see WithRangeReads.
+	ErrPartitionChanged = errors.New("Partition changed while reading")
+	//ErrConditionalNotSupported when a storage can not make conditional puts, see ConditionalStorage.
+	ErrConditionalNotSupported = errors.New("Storage does not support conditional puts")
+	//ErrPreconditionFailed when a conditional put finds the object changed, see ConditionalStorage.
+	ErrPreconditionFailed = errors.New("Object changed since it was read")
+	//ErrMetaNotSupported when a storage can not return partition metadata, see MetaStorage.
+	ErrMetaNotSupported = errors.New("Storage does not keep partition metadata")
+	//ErrNotFound is the cause of the error returned for a missing key, test it with errors.Cause.
+	ErrNotFound = errors.New("Key not found")
 )
 
+//causeerror keeps its own message while errors.Cause finds cause
+type causeerror struct {
+	msg   string
+	cause error
+}
+
+func (e *causeerror) Error() string {
+	return e.msg
+}
+
+//Cause is for errors.Cause
+func (e *causeerror) Cause() error {
+	return e.cause
+}
+
 //IsNotFound reflects on error and determines if its a real failure or not-found types
 func IsNotFound(err error) bool {
 	if err == nil {
@@ -31,3 +85,67 @@ func IsNotFound(err error) bool {
 	}
 	return false
 }
+
+//IsRetryable determines if err is transient: S3 5xx and throttling, timeouts and dropped connections
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	err = errors.Cause(err)
+	if err == ErrAttemptTimeout || err == io.ErrUnexpectedEOF || err == io.EOF {
+		return true
+	}
+	switch err := err.(type) {
+	case *s3.Error:
+		return err.StatusCode >= 500 || err.StatusCode == 429 ||
+			err.Code == "RequestTimeout" || err.Code == "SlowDown"
+	case net.Error:
+		if err.Timeout() {
+			return true
+		}
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe") ||
+		strings.Contains(msg, "connection refused")
+}
+
+//BucketNotFoundError is returned when an element of a nested bucket path is missing
+type BucketNotFoundError struct {
+	//Path is the full bucket path that was requested
+	Path [][]byte
+	//Depth is the index in Path of the first missing bucket
+	Depth int
+}
+
+func (e *BucketNotFoundError) Error() string {
+	return fmt.Sprintf("Bucket %s not found at depth %d of path %s", e.Path[e.Depth], e.Depth, bytes.Join(e.Path, []byte("/")))
+}
+
+//NotOwnerError is returned when a clustered DB is asked to open a partition another node owns
+type NotOwnerError struct {
+	Partition string
+	//Owners are the nodes holding the partition, primary first
+	Owners []string
+}
+
+func (e *NotOwnerError) Error() string {
+	return fmt.Sprintf("Partition %s is owned by %s", e.Partition, strings.Join(e.Owners, ", "))
+}
+
+//CodecError is returned by Table when a key or value fails its codec
+type CodecError struct {
+	Partition string
+	Bucket    []byte
+	//Key is the encoded key, nil when encoding it failed
+	Key []byte
+	//Op is what failed, e.g. "decode value"
+	Op  string
+	Err error
+}
+
+func (e *CodecError) Error() string {
+	if e.Key == nil {
+		return fmt.Sprintf("Can not %s in bucket %s of partition %s: %v", e.Op, e.Bucket, e.Partition, e.Err)
+	}
+	return fmt.Sprintf("Can not %s of key %x in bucket %s of partition %s: %v", e.Op, e.Key, e.Bucket, e.Partition, e.Err)
+}
@@ -1,8 +1,9 @@
+//go:build go1.18
+// +build go1.18
+
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -25,8 +26,13 @@ var (
 	prefill      = flag.Bool("prefill", false, "Prefill data in s3")
 	s3bucket     *s3.Bucket
 	db           *infreqdb.DB
+	parts        = infreqdb.NewTimePartitioner("2006-01-02")
+	routed       *infreqdb.RoutedDB
 	tmpdir       string
 	cities       = []string{"bangkok", "singapore", "new york", "amsterdam"}
+	//cityinfos reads buckets of cities, keys are times and values gob encoded CityInfo
+	cityinfos     *infreqdb.Table[time.Time, CityInfo]
+	cityinfoCodec = infreqdb.GobCodec[CityInfo]()
 )
 
 //CityInfo holds demo data for a particular hour
@@ -39,27 +45,6 @@ func randCityInfo() CityInfo {
 	return CityInfo{rand.Float64(), rand.Float64()}
 }
 
-func decodeCityInfo(b []byte) CityInfo {
-	ci := CityInfo{}
-	network := bytes.NewBuffer(b)
-	dec := gob.NewDecoder(network)
-	err := dec.Decode(&ci)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return ci
-}
-
-func (ci CityInfo) marshal() ([]byte, error) {
-	var network bytes.Buffer
-	enc := gob.NewEncoder(&network)
-	err := enc.Encode(&ci)
-	if err != nil {
-		return nil, err
-	}
-	return network.Bytes(), nil
-}
-
 func init() {
 	filenameHook := filename.NewHook()
 	log.AddHook(filenameHook)
@@ -85,10 +70,13 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	routed = infreqdb.NewRoutedDB(db, parts)
+	//Keys were written with time.Time.MarshalBinary
+	cityinfos = infreqdb.NewTable(db, infreqdb.BinaryCodec[time.Time](), cityinfoCodec)
 }
 
 func generatedb(t time.Time) {
-	partid := t.Format("2006-01-02")
+	partid := parts.PartitionTime(t)
 	log.Println("Creating partition for ", partid)
 	fname := fmt.Sprintf("%s/%s", tmpdir, partid)
 	defer os.Remove(fname)
@@ -105,22 +93,9 @@ func generatedb(t time.Time) {
 			log.Fatal("begin", err)
 		}
 
-		b, err := tx.CreateBucket([]byte(city))
-		if err != nil {
-			log.Fatal("createbucket", err)
-		}
 		cur := t
-		var bin, payload []byte
 		for cur.Before(end) {
-			bin, err = cur.MarshalBinary()
-			if err != nil {
-				log.Fatal(err)
-			}
-			payload, err = randCityInfo().marshal()
-			if err != nil {
-				log.Fatal(err)
-			}
-			err = b.Put(bin, payload)
+			err = cityinfos.PutTx(tx, []byte(city), cur, randCityInfo())
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -178,37 +153,35 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	//Get value of partition 2017-01-01 , bucket bangkok and key 2017-01-01T00:01:00
-	v, err := db.Get("2017-01-01", []byte("bangkok"), bin)
+	//Get value of bucket bangkok and key 2017-01-01T00:01:00, the partitioner finds partition 2017-01-01
+	v, err := routed.Get([]byte("bangkok"), bin)
 	if err != nil {
 		log.Fatal(err)
 	}
 	//Decode and print
-	log.Println(decodeCityInfo(v))
-
-	//Which was the hottest city at 2017-01-15T00:02:00
-	ts, err = time.Parse("2006-01-02T15:04:05", "2017-01-15T00:02:00")
+	ci, err := cityinfoCodec.Decode(v)
 	if err != nil {
 		log.Fatal(err)
 	}
-	bin, err = ts.MarshalBinary()
+	log.Println(ci)
+
+	//Which was the hottest city at 2017-01-15T00:02:00
+	ts, err = time.Parse("2006-01-02T15:04:05", "2017-01-15T00:02:00")
 	if err != nil {
 		log.Fatal(err)
 	}
 	hottest := ""
 	hottestTemp := 0.0
-	//Using View... proxy to bolt.DB.View
-	db.View("2017-01-15", func(tx *bolt.Tx) error {
-		for _, city := range cities {
-			b := tx.Bucket([]byte(city))
-			v := b.Get(bin)
-			ci := decodeCityInfo(v)
-			if ci.Temperature > hottestTemp {
-				hottest = city
-				hottestTemp = ci.Temperature
-			}
+	//The Table encodes keys and decodes values
+	for _, city := range cities {
+		ci, err := cityinfos.Get(parts.PartitionTime(ts), []byte(city), ts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ci.Temperature > hottestTemp {
+			hottest = city
+			hottestTemp = ci.Temperature
 		}
-		return nil
-	})
+	}
 	fmt.Printf("Hottest city was %v with temperature %v\n", hottest, hottestTemp)
 }
@@ -0,0 +1,264 @@
+package infreqdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+//ValueDecoder turns a stored value into something encoding/json can write
+type ValueDecoder func(bucket, key, value []byte) (interface{}, error)
+
+//TextDecoder exports values as text, those that are not UTF-8 base64 encoded, the default.
+//See TextKeyDecoder, ParseText reads them back.
+func TextDecoder(bucket, key, value []byte) (interface{}, error) {
+	return TextKeyDecoder(value), nil
+}
+
+//StringDecoder exports values as text, bytes that are not UTF-8 become U+FFFD
+func StringDecoder(bucket, key, value []byte) (interface{}, error) {
+	return string(value), nil
+}
+
+//BytesDecoder exports values base64 encoded, for binary data
+func BytesDecoder(bucket, key, value []byte) (interface{}, error) {
+	return append([]byte(nil), value...), nil
+}
+
+//JSONDecoder exports values that are json documents as is, e.g. those written by Importer
+func JSONDecoder(bucket, key, value []byte) (interface{}, error) {
+	var raw json.RawMessage
+	err := json.Unmarshal(value, &raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Key %s is not json", key)
+	}
+	return raw, nil
+}
+
+//GobDecoder decodes gob encoded values into a fresh value from newv,
+//e.g. a func returning &CityInfo{} for the toyexample
+func GobDecoder(newv func() interface{}) ValueDecoder {
+	return func(bucket, key, value []byte) (interface{}, error) {
+		v := newv()
+		err := gob.NewDecoder(bytes.NewReader(value)).Decode(v)
+		return v, err
+	}
+}
+
+//KeyDecoder turns keys and bucket names into text for an ExportWriter
+type KeyDecoder func(key []byte) string
+
+//textprefix marks base64 in the output of TextKeyDecoder
+const textprefix = "base64:"
+
+//TextKeyDecoder exports valid UTF-8 as is, anything else base64 encoded after "base64:",
+//as is text that already starts with it. The default, ParseText reads it back.
+func TextKeyDecoder(key []byte) string {
+	if utf8.Valid(key) && !bytes.HasPrefix(key, []byte(textprefix)) {
+		return string(key)
+	}
+	return textprefix + base64.StdEncoding.EncodeToString(key)
+}
+
+//StringKeyDecoder exports keys as text, bytes that are not UTF-8 become U+FFFD
+func StringKeyDecoder(key []byte) string {
+	return string(key)
+}
+
+//HexKeyDecoder exports keys hex encoded, ParseHex reads them back
+func HexKeyDecoder(key []byte) string {
+	return hex.EncodeToString(key)
+}
+
+//ExportWriter writes exported keys
+type ExportWriter interface {
+	Write(partid, bucket, key string, value interface{}) error
+	//Flush writes anything buffered
+	Flush() error
+}
+
+//jsonlwriter writes one json object per key
+type jsonlwriter struct {
+	enc *json.Encoder
+}
+
+//NewJSONLWriter writes {"partition", "bucket", "key", "value"} objects, one per line
+func NewJSONLWriter(w io.Writer) ExportWriter {
+	return &jsonlwriter{enc: json.NewEncoder(w)}
+}
+
+func (jw *jsonlwriter) Write(partid, bucket, key string, value interface{}) error {
+	return jw.enc.Encode(struct {
+		Partition string      `json:"partition"`
+		Bucket    string      `json:"bucket"`
+		Key       string      `json:"key"`
+		Value     interface{} `json:"value"`
+	}{partid, bucket, key, value})
+}
+
+func (jw *jsonlwriter) Flush() error {
+	return nil
+}
+
+//csvwriter writes a row per key
+type csvwriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+//NewCSVWriter writes partition,bucket,key,value rows with a header.
+//Values that are not strings are written as json.
+func NewCSVWriter(w io.Writer) ExportWriter {
+	return &csvwriter{w: csv.NewWriter(w)}
+}
+
+func (cw *csvwriter) Write(partid, bucket, key string, value interface{}) error {
+	if !cw.header {
+		cw.header = true
+		err := cw.w.Write([]string{"partition", "bucket", "key", "value"})
+		if err != nil {
+			return err
+		}
+	}
+	s, ok := value.(string)
+	if !ok {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		s = string(b)
+	}
+	return cw.w.Write([]string{partid, bucket, key, s})
+}
+
+func (cw *csvwriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+//Exporter streams the keys of partitions to an ExportWriter, reading through
+//DB.View so partitions in the cache are not downloaded again.
+type Exporter struct {
+	//Buckets limits the export to these top level buckets, all if empty
+	Buckets []string
+	//Decode converts values, TextDecoder if nil
+	Decode ValueDecoder
+	//DecodeKey converts keys and bucket names, TextKeyDecoder if nil
+	DecodeKey KeyDecoder
+
+	db *DB
+}
+
+//NewExporter creates an Exporter reading from db
+func NewExporter(db *DB) *Exporter {
+	return &Exporter{db: db}
+}
+
+//Partitions lists partitions in [start, end), end "" means no upper bound.
+//Needs a manifest or a storage implementing Lister, see DB.ListParts.
+func (ex *Exporter) Partitions(start, end string) ([]string, error) {
+	//Only list what both bounds have in common
+	common := 0
+	for end != "" && common < len(start) && common < len(end) && start[common] == end[common] {
+		common++
+	}
+	prefix := start[:common]
+	entries, err := ex.db.ListParts(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var partids []string
+	for _, e := range entries {
+		if e.Partition >= start && (end == "" || e.Partition < end) {
+			partids = append(partids, e.Partition)
+		}
+	}
+	return partids, nil
+}
+
+//Export writes every key of partids to w, in partition, bucket and key order.
+//Nested buckets are included, their bucket is the path joined by "/".
+//Returns the number of keys written.
+func (ex *Exporter) Export(partids []string, w ExportWriter) (int, error) {
+	decode := ex.Decode
+	if decode == nil {
+		decode = TextDecoder
+	}
+	decodekey := ex.DecodeKey
+	if decodekey == nil {
+		decodekey = TextKeyDecoder
+	}
+	n := 0
+	for _, partid := range partids {
+		if !ex.mayexport(partid) {
+			continue
+		}
+		err := ex.db.readpart(partid, func(r PartReader) error {
+			buckets, err := r.Buckets()
+			if err != nil {
+				return err
+			}
+			for _, br := range buckets {
+				if len(ex.Buckets) > 0 && !contains(ex.Buckets, br.Name) {
+					continue
+				}
+				err = ex.exportbucket(partid, r, [][]byte{[]byte(br.Name)}, decode, decodekey, w, &n)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if IsNotFound(err) {
+			//Nothing to export, like View
+			err = nil
+		}
+		if err != nil {
+			return n, errors.Wrap(err, partid)
+		}
+	}
+	return n, w.Flush()
+}
+
+//mayexport uses the manifest to skip partitions without any of the Buckets
+func (ex *Exporter) mayexport(partid string) bool {
+	me := ex.db.manifestentry(partid)
+	if me == nil || len(ex.Buckets) == 0 {
+		return true
+	}
+	for _, name := range ex.Buckets {
+		if br := me.bucket([]byte(name)); br != nil && br.Min != nil {
+			return true
+		}
+	}
+	return false
+}
+
+//exportbucket writes the keys of the bucket at path and its nested buckets
+func (ex *Exporter) exportbucket(partid string, r PartReader, path [][]byte, decode ValueDecoder, decodekey KeyDecoder, w ExportWriter, n *int) error {
+	name := bytes.Join(path, []byte("/"))
+	names := make([]string, len(path))
+	for i, p := range path {
+		names[i] = decodekey(p)
+	}
+	bucket := strings.Join(names, "/")
+	return r.Iterate(path, nil, nil, func(k, v []byte) error {
+		if v == nil {
+			return ex.exportbucket(partid, r, append(path[:len(path):len(path)], k), decode, decodekey, w, n)
+		}
+		value, err := decode(name, k, v)
+		if err != nil {
+			return err
+		}
+		*n++
+		return w.Write(partid, bucket, decodekey(k), value)
+	})
+}
@@ -0,0 +1,135 @@
+package infreqdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type exportinfo struct {
+	Temperature float64
+}
+
+func TestExporter(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, partid := range []string{"2017-01-01", "2017-01-02", "2017-02-01"} {
+		bld, err := NewBuilder(partid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(exportinfo{30.5})
+		bld.Put([]byte("bangkok"), []byte("00"), buf.Bytes())
+		bld.Put([]byte("singapore"), []byte("00"), buf.Bytes())
+		err = bld.Commit(db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ex := NewExporter(db)
+	partids, err := ex.Partitions("2017-01-01", "2017-02-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partids) != 2 || partids[1] != "2017-01-02" {
+		t.Errorf("expected January, got %v", partids)
+	}
+	ex.Buckets = []string{"bangkok"}
+	ex.Decode = GobDecoder(func() interface{} { return &exportinfo{} })
+	var out bytes.Buffer
+	n, err := ex.Export(partids, NewJSONLWriter(&out))
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 keys, got %v %v", n, err)
+	}
+	var line struct {
+		Partition, Bucket, Key string
+		Value                  exportinfo
+	}
+	err = json.Unmarshal([]byte(strings.SplitN(out.String(), "\n", 2)[0]), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.Partition != "2017-01-01" || line.Bucket != "bangkok" || line.Key != "00" || line.Value.Temperature != 30.5 {
+		t.Errorf("unexpected line %+v", line)
+	}
+	out.Reset()
+	ex = NewExporter(db)
+	ex.Decode = JSONDecoder
+	_, err = ex.Export([]string{"2017-02-01"}, NewCSVWriter(&out))
+	if err == nil {
+		t.Error("expected gob values not to be json")
+	}
+	out.Reset()
+	ex.Decode = BytesDecoder
+	n, err = ex.Export([]string{"2017-02-01", "nopart"}, NewCSVWriter(&out))
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 keys, got %v %v", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[0] != "partition,bucket,key,value" || !strings.HasPrefix(lines[2], "2017-02-01,singapore,00,\"") {
+		t.Errorf("unexpected csv %q", out.String())
+	}
+}
+
+func TestExportBinary(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	keys := [][]byte{{0xff, 0x00}, []byte("base64:looks encoded"), []byte("plain")}
+	bld, err := NewBuilder("bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		bld.Put([]byte{0x80}, k, append([]byte{0xfe}, k...))
+	}
+	err = bld.Commit(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	_, err = NewExporter(db).Export([]string{"bin"}, NewJSONLWriter(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "�") || !strings.Contains(out.String(), `"key":"plain"`) {
+		t.Errorf("unexpected export %s", out.String())
+	}
+	//Read back into another partition
+	im := NewImporter(db)
+	im.Partition, im.Bucket, im.Key, im.Value = "copy", "{bucket}", "{key}", "{value}"
+	im.ParseKey, im.ParseValue = ParseText, ParseText
+	_, err = im.Import(NewJSONLReader(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		v, err := db.Get("copy", []byte{0x80}, k)
+		if err != nil || !bytes.Equal(v, append([]byte{0xfe}, k...)) {
+			t.Errorf("%q: expected a round trip, got %q %v", k, v, err)
+		}
+	}
+	ex := NewExporter(db)
+	ex.DecodeKey = HexKeyDecoder
+	out.Reset()
+	_, err = ex.Export([]string{"bin"}, NewCSVWriter(&out))
+	if err != nil || !strings.Contains(out.String(), "bin,80,ff00,") {
+		t.Errorf("unexpected csv %q %v", out.String(), err)
+	}
+}
@@ -0,0 +1,516 @@
+package infreqdb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//FileStorage keeps partitions as plain files in a directory, e.g. a local disk or NFS mount.
+//Partition names are escaped so they can not point outside the directory.
+//Files are stored uncompressed with a small json sidecar holding the mutable flag, checksum and engine.
+type FileStorage struct {
+	dir string
+}
+
+//filemeta is the sidecar stored next to each partition file
+type filemeta struct {
+	Mutable bool   `json:"mutable"`
+	SHA256  string `json:"sha256"`
+	Engine  string `json:"engine,omitempty"`
+	//Source is the authoritative last modified time of a back-filled copy, see BackfillStorage
+	Source *time.Time `json:"source,omitempty"`
+	//User is the user metadata of PartMeta
+	User map[string]string `json:"user,omitempty"`
+}
+
+//NewFileStorage creates a FileStorage in dir, creating it if needed
+func NewFileStorage(dir string) (*FileStorage, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+//path returns the file name for partition
+func (fs *FileStorage) path(part string) string {
+	return filepath.Join(fs.dir, url.QueryEscape(part)+".part")
+}
+
+//metapath returns the sidecar file name for partition
+func (fs *FileStorage) metapath(part string) string {
+	return filepath.Join(fs.dir, url.QueryEscape(part)+".meta")
+}
+
+//Get copies a partition into a temp file, the cache deletes it when done
+func (fs *FileStorage) Get(part string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	fname, found, meta, lastmod, err := fs.get(part)
+	return fname, found, meta.Mutable, lastmod, err
+}
+
+//GetEngine is Get also returning the engine recorded in the sidecar, see EngineStorage
+func (fs *FileStorage) GetEngine(part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	fname, found, meta, lastmod, err := fs.get(part)
+	return fname, found, meta.Mutable, lastmod, meta.Engine, err
+}
+
+//GetBackfill is Get also returning the source recorded by PutBackfill and the engine, see BackfillStorage
+func (fs *FileStorage) GetBackfill(part string) (fname string, found, mutable bool, lastmod, source time.Time, engine string, err error) {
+	fname, found, meta, lastmod, err := fs.get(part)
+	if meta.Source != nil {
+		source = *meta.Source
+	}
+	return fname, found, meta.Mutable, lastmod, source, meta.Engine, err
+}
+
+//GetTag is Get also returning the checksum of the partition as tag, see ConditionalStorage
+func (fs *FileStorage) GetTag(part string) (fname string, found, mutable bool, tag string, err error) {
+	fname, found, meta, _, err := fs.get(part)
+	if err != nil || !found {
+		return "", false, true, "", err
+	}
+	return fname, true, meta.Mutable, meta.SHA256, nil
+}
+
+//get copies a partition into a temp file, returning its sidecar
+func (fs *FileStorage) get(part string) (fname string, found bool, meta filemeta, lastmod time.Time, err error) {
+	f, err := os.Open(fs.path(part))
+	if err != nil {
+		if os.IsNotExist(err) {
+			//Same as S3Storage, so partitions created later look newer
+			return "", false, filemeta{Mutable: true}, time.Unix(2, 2), nil
+		}
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(fs.metapath(part))
+	if err == nil {
+		err = json.Unmarshal(b, &meta)
+	}
+	if err != nil {
+		return
+	}
+	tmpfile, err := ioutil.TempFile("", "infreqdb-")
+	if err != nil {
+		return
+	}
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpfile, sum), f)
+	tmpfile.Close()
+	if err == nil && meta.SHA256 != "" && meta.SHA256 != hex.EncodeToString(sum.Sum(nil)) {
+		err = errors.Wrapf(ErrCorruptPartition, "%s: sha256 %x, expected %s", part, sum.Sum(nil), meta.SHA256)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return
+	}
+	return tmpfile.Name(), true, meta, fi.ModTime(), nil
+}
+
+//Put copies fname into the directory, replacing the partition atomically
+func (fs *FileStorage) Put(part, fname string, mutable bool) error {
+	return fs.put(part, fname, filemeta{Mutable: mutable}, nil)
+}
+
+//PutEngine is Put recording engine, see EngineStorage
+func (fs *FileStorage) PutEngine(part, fname string, mutable bool, engine string) error {
+	return fs.put(part, fname, filemeta{Mutable: mutable, Engine: engine}, nil)
+}
+
+//PutBackfill is Put recording the authoritative last modified time and the engine, see BackfillStorage
+func (fs *FileStorage) PutBackfill(part, fname string, mutable bool, source time.Time, engine string) error {
+	return fs.put(part, fname, filemeta{Mutable: mutable, Source: &source, Engine: engine}, nil)
+}
+
+//PutMeta is Put recording meta in the sidecar, see MetaStorage.
+//Files are never compressed, Raw is not recorded.
+func (fs *FileStorage) PutMeta(part, fname string, meta PartMeta) error {
+	return fs.put(part, fname, filemeta{Mutable: meta.Mutable, Engine: meta.Engine, User: meta.User}, nil)
+}
+
+//Meta reads the sidecar, see MetaStorage
+func (fs *FileStorage) Meta(part string) (PartMeta, bool, error) {
+	if _, err := os.Stat(fs.path(part)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return PartMeta{}, false, err
+	}
+	var meta filemeta
+	b, err := ioutil.ReadFile(fs.metapath(part))
+	if err == nil {
+		err = json.Unmarshal(b, &meta)
+	}
+	if err != nil {
+		return PartMeta{}, false, err
+	}
+	return PartMeta{Mutable: meta.Mutable, Engine: meta.Engine, SHA256: meta.SHA256, User: meta.User}, true, nil
+}
+
+//PutIf is Put unless the partition checksum is no longer tag, see ConditionalStorage.
+//Writers take a lock file next to the partition, so they must share the directory
+//and agree on the time for locks left behind by crashed writers to be broken.
+//Writers touch their lock while they hold it, a writer finding its lock broken fails.
+func (fs *FileStorage) PutIf(part, fname string, mutable bool, tag string) error {
+	return fs.putmetaif(part, fname, PartMeta{Mutable: mutable}, tag)
+}
+
+//putmetaif is PutIf recording meta
+func (fs *FileStorage) putmetaif(part, fname string, meta PartMeta, tag string) error {
+	fl, err := fs.lock(part)
+	if err != nil {
+		return err
+	}
+	defer fl.unlock()
+	current := ""
+	b, err := ioutil.ReadFile(fs.metapath(part))
+	if err == nil {
+		var meta filemeta
+		err = json.Unmarshal(b, &meta)
+		current = meta.SHA256
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := os.Stat(fs.path(part)); os.IsNotExist(err) {
+		//Sidecar of a partition being deleted
+		current = ""
+	}
+	if current != tag {
+		return errors.Wrapf(ErrPreconditionFailed, "%s: sha256 %s, expected %s", part, current, tag)
+	}
+	return fs.put(part, fname, filemeta{Mutable: meta.Mutable, Engine: meta.Engine, User: meta.User}, fl.held)
+}
+
+//lockwait is how long PutIf waits for the lock, locks older than lockstale are broken
+const (
+	lockwait  = 10 * time.Second
+	lockstale = 30 * time.Second
+)
+
+//filelock is a lock file holding a random token, see FileStorage.PutIf
+type filelock struct {
+	path  string
+	token string
+	done  chan struct{}
+}
+
+//lock creates the lock file of part, breaking it if it is stale
+func (fs *FileStorage) lock(part string) (*filelock, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	fl := &filelock{
+		path:  filepath.Join(fs.dir, url.QueryEscape(part)+".lock"),
+		token: hex.EncodeToString(token),
+		done:  make(chan struct{}),
+	}
+	deadline := time.Now().Add(lockwait)
+	for {
+		f, err := os.OpenFile(fl.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(fl.token)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(fl.path)
+				return nil, err
+			}
+			go fl.touch()
+			return fl, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		fi, err := os.Stat(fl.path)
+		if err == nil && time.Since(fi.ModTime()) > lockstale {
+			breaklock(fl.path, fl.token)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("%s: lock held by another writer", part)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//breaklock moves a stale lock out of the way, atomically so of several writers breaking it
+//only one gets it. The others move the lock that writer created since, or nothing, so a lock
+//that turns out to be fresh is put back, unless yet another one was created meanwhile.
+//Its holder then finds its token gone.
+func breaklock(path, token string) {
+	broken := path + "." + token
+	if os.Rename(path, broken) != nil {
+		return
+	}
+	defer os.Remove(broken)
+	fi, err := os.Stat(broken)
+	if err == nil && time.Since(fi.ModTime()) <= lockstale {
+		os.Link(broken, path)
+		return
+	}
+	log.Println("broke stale lock", path)
+}
+
+//touch keeps the lock fresh until unlock
+func (fl *filelock) touch() {
+	t := time.NewTicker(lockstale / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-fl.done:
+			return
+		case now := <-t.C:
+			if fl.held() == nil {
+				os.Chtimes(fl.path, now, now)
+			}
+		}
+	}
+}
+
+//held fails unless the lock file still holds our token
+func (fl *filelock) held() error {
+	b, err := ioutil.ReadFile(fl.path)
+	if err != nil || string(b) != fl.token {
+		return errors.Errorf("%s: lock was broken by another writer", fl.path)
+	}
+	return nil
+}
+
+//unlock removes the lock file if it is still ours
+func (fl *filelock) unlock() {
+	close(fl.done)
+	if fl.held() == nil {
+		os.Remove(fl.path)
+	}
+}
+
+//put copies fname into the directory with meta, the checksum is filled in and the engine if missing.
+//check, if not nil, runs right before the partition is replaced and can stop it.
+func (fs *FileStorage) put(part, fname string, meta filemeta, check func() error) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmpfile, err := ioutil.TempFile(fs.dir, ".infreqdb-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpfile, sum), f)
+	if err == nil {
+		err = tmpfile.Sync()
+	}
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	meta.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	if meta.Engine == "" {
+		meta.Engine = enginename(fname, nil)
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	metafile := tmpfile.Name() + ".meta"
+	defer os.Remove(metafile)
+	err = ioutil.WriteFile(metafile, b, 0644)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		err = check()
+		if err != nil {
+			return err
+		}
+	}
+	//Data first, so the sidecar never describes a file that is not there yet.
+	//A reader racing us sees a checksum mismatch and downloads again.
+	err = os.Rename(tmpfile.Name(), fs.path(part))
+	if err != nil {
+		return err
+	}
+	return os.Rename(metafile, fs.metapath(part))
+}
+
+//Delete removes the partition file and its sidecar
+func (fs *FileStorage) Delete(part string) error {
+	err := os.Remove(fs.path(part))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(fs.metapath(part))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//Stat uses the file modification time as last modified
+func (fs *FileStorage) Stat(part string) (lastmod time.Time, found bool, err error) {
+	fi, err := os.Stat(fs.path(part))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return fi.ModTime(), true, nil
+}
+
+//ReadTail reads the end of a partition file, see RangeStorage
+func (fs *FileStorage) ReadTail(part string, n int64) ([]byte, RangeInfo, bool, error) {
+	f, err := os.Open(fs.path(part))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, RangeInfo{}, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, RangeInfo{}, false, err
+	}
+	var meta filemeta
+	b, err := ioutil.ReadFile(fs.metapath(part))
+	if err == nil {
+		err = json.Unmarshal(b, &meta)
+	}
+	if err != nil {
+		return nil, RangeInfo{}, false, err
+	}
+	off := fi.Size() - n
+	if off < 0 {
+		off = 0
+	}
+	tail := make([]byte, fi.Size()-off)
+	_, err = f.ReadAt(tail, off)
+	if err != nil {
+		return nil, RangeInfo{}, false, err
+	}
+	info := RangeInfo{Size: fi.Size(), LastModified: fi.ModTime(), Mutable: meta.Mutable, Engine: meta.Engine, Ranged: true, Tag: filetag(fi)}
+	return tail, info, true, nil
+}
+
+//filetag tells copies of a partition file apart, files are replaced by renaming a new one over them
+func filetag(fi os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+//ReadRange reads part of a partition file, see RangeStorage
+func (fs *FileStorage) ReadRange(part string, off, length int64, tag string) ([]byte, time.Time, error) {
+	f, err := os.Open(fs.path(part))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if tag != "" && filetag(fi) != tag {
+		return nil, time.Time{}, errors.Wrap(ErrPartitionChanged, part)
+	}
+	b := make([]byte, length)
+	n, err := f.ReadAt(b, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return b[:n], fi.ModTime(), err
+}
+
+//ListNames reads the directory, see NameLister
+func (fs *FileStorage) ListNames(prefix string) ([]string, error) {
+	infos, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".part") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		part, err := url.QueryUnescape(strings.TrimSuffix(name, ".part"))
+		if err == nil && strings.HasPrefix(part, prefix) {
+			names = append(names, part)
+		}
+	}
+	//ReadDir sorts by escaped name
+	sort.Strings(names)
+	return names, nil
+}
+
+//List reads the directory
+func (fs *FileStorage) List(prefix string) ([]PartEntry, error) {
+	infos, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []PartEntry
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".part") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		part, err := url.QueryUnescape(strings.TrimSuffix(name, ".part"))
+		if err != nil || !strings.HasPrefix(part, prefix) || issidecar(part) {
+			continue
+		}
+		var meta filemeta
+		b, err := ioutil.ReadFile(fs.metapath(part))
+		if err == nil {
+			err = json.Unmarshal(b, &meta)
+		}
+		if os.IsNotExist(err) {
+			//Deleted while we were listing
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, part)
+		}
+		entries = append(entries, PartEntry{
+			Partition:    part,
+			Size:         fi.Size(),
+			LastModified: fi.ModTime(),
+			Mutable:      meta.Mutable,
+			Engine:       meta.Engine,
+		})
+	}
+	//ReadDir sorts by escaped name, which is not the order of partition names
+	sort.Sort(partentries(entries))
+	return entries, nil
+}
+
+//partentries sorts PartEntry by partition
+type partentries []PartEntry
+
+func (pe partentries) Len() int           { return len(pe) }
+func (pe partentries) Swap(i, j int)      { pe[i], pe[j] = pe[j], pe[i] }
+func (pe partentries) Less(i, j int) bool { return pe[i].Partition < pe[j].Partition }
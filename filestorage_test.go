@@ -0,0 +1,147 @@
+package infreqdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var storage Storage
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = fs
+	_, found, mutable, lastmod, err := storage.Get("../escape")
+	if err != nil {
+		t.Error(err)
+	}
+	if found || !mutable || lastmod != time.Unix(2, 2) {
+		t.Errorf("unexpected not found result %v %v %v", found, mutable, lastmod)
+	}
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	err = ioutil.WriteFile(tf, []byte("hello world"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Put("../escape", tf, false)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = os.Stat(fs.path("../escape"))
+	if err != nil {
+		t.Errorf("partition not stored inside dir: %v", err)
+	}
+	fname, found, mutable, _, err := storage.Get("../escape")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.Remove(fname)
+	if !found || mutable {
+		t.Errorf("expected found and immutable, got %v %v", found, mutable)
+	}
+	b, _ := ioutil.ReadFile(fname)
+	if string(b) != "hello world" {
+		t.Errorf("expected hello world, got %s", b)
+	}
+	_, found, err = storage.Stat("../escape")
+	if err != nil || !found {
+		t.Errorf("expected found, got %v %v", found, err)
+	}
+	err = fs.PutMeta("meta", tf, PartMeta{Mutable: true, Engine: "bolt", User: map[string]string{"key-id": "k1"}})
+	if err != nil {
+		t.Error(err)
+	}
+	meta, found, err := fs.Meta("meta")
+	if err != nil || !found || !meta.Mutable || meta.Engine != "bolt" || meta.SHA256 == "" || meta.User["key-id"] != "k1" {
+		t.Errorf("unexpected metadata %+v %v %v", meta, found, err)
+	}
+	_, found, err = fs.Meta("missing")
+	if err != nil || found {
+		t.Errorf("expected not found, got %v %v", found, err)
+	}
+	//Corrupt the stored file
+	err = ioutil.WriteFile(fs.path("../escape"), []byte("hello wrold"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _, err = storage.Get("../escape")
+	if errors.Cause(err) != ErrCorruptPartition {
+		t.Errorf("expected %v, got %v", ErrCorruptPartition, err)
+	}
+}
+
+func TestFileStorageList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testList(t, fs)
+}
+
+func TestFileStorageLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Left behind by a crashed writer
+	lockpath := filepath.Join(dir, "foo.lock")
+	err = ioutil.WriteFile(lockpath, []byte("crashed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * lockstale)
+	os.Chtimes(lockpath, old, old)
+	fl, err := fs.lock("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fl.held(); err != nil {
+		t.Error(err)
+	}
+	//Broken and taken over, our writes must stop
+	err = ioutil.WriteFile(lockpath, []byte("other"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fl.held() == nil {
+		t.Error("expected lock to be lost")
+	}
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	ioutil.WriteFile(tf, []byte("hello"), 0600)
+	err = fs.put("foo", tf, filemeta{}, fl.held)
+	if err == nil {
+		t.Error("expected put without the lock to fail")
+	}
+	if _, found, _ := fs.Stat("foo"); found {
+		t.Error("put without the lock must not write")
+	}
+	//Not ours anymore, unlock leaves it alone
+	fl.unlock()
+	b, _ := ioutil.ReadFile(lockpath)
+	if string(b) != "other" {
+		t.Errorf("expected the other lock to stay, got %q", b)
+	}
+}
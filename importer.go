@@ -0,0 +1,393 @@
+package infreqdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//Record is a single input record for an Importer
+type Record struct {
+	//Fields by name, values are always text
+	Fields map[string]string
+	//Raw is the whole record as json, filled in on demand if left nil
+	Raw []byte
+}
+
+//RecordReader reads records one at a time, returning io.EOF at the end
+type RecordReader interface {
+	Read() (*Record, error)
+}
+
+//JSONLReader reads one json object per line.
+//Strings are used as is, other values in their json form.
+type JSONLReader struct {
+	dec *json.Decoder
+}
+
+//NewJSONLReader creates a JSONLReader
+func NewJSONLReader(r io.Reader) *JSONLReader {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return &JSONLReader{dec: dec}
+}
+
+//Read returns the next record
+func (jr *JSONLReader) Read() (*Record, error) {
+	var raw json.RawMessage
+	err := jr.dec.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Record{Fields: make(map[string]string, len(obj)), Raw: raw}
+	for k, v := range obj {
+		switch v := v.(type) {
+		case string:
+			rec.Fields[k] = v
+		case json.Number:
+			rec.Fields[k] = v.String()
+		case bool:
+			rec.Fields[k] = strconv.FormatBool(v)
+		case nil:
+			rec.Fields[k] = ""
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			rec.Fields[k] = string(b)
+		}
+	}
+	return rec, nil
+}
+
+//CSVReader reads csv with a header row naming the fields
+type CSVReader struct {
+	//CSV can be tweaked, e.g. Comma, before the first Read
+	CSV    *csv.Reader
+	header []string
+}
+
+//NewCSVReader creates a CSVReader
+func NewCSVReader(r io.Reader) *CSVReader {
+	return &CSVReader{CSV: csv.NewReader(r)}
+}
+
+//Read returns the next record
+func (cr *CSVReader) Read() (*Record, error) {
+	if cr.header == nil {
+		header, err := cr.CSV.Read()
+		if err != nil {
+			return nil, err
+		}
+		cr.header = header
+	}
+	row, err := cr.CSV.Read()
+	if err != nil {
+		return nil, err
+	}
+	rec := &Record{Fields: make(map[string]string, len(row))}
+	for i, v := range row {
+		if i < len(cr.header) {
+			rec.Fields[cr.header[i]] = v
+		}
+	}
+	return rec, nil
+}
+
+//tmplpart is literal text or, if field is set, a placeholder naming a field
+type tmplpart struct {
+	text  string
+	field bool
+}
+
+//fieldtemplate is text with {field} placeholders
+type fieldtemplate []tmplpart
+
+//parsetemplate parses text like "{city}-{date}", "{.}" is the whole record
+func parsetemplate(text string) (fieldtemplate, error) {
+	var ft fieldtemplate
+	for text != "" {
+		open, end := strings.IndexByte(text, '{'), strings.IndexByte(text, '}')
+		switch {
+		case end >= 0 && (open < 0 || end < open):
+			return nil, fmt.Errorf("Unexpected } in template %q", text)
+		case open < 0:
+			return append(ft, tmplpart{text, false}), nil
+		case open > 0:
+			ft = append(ft, tmplpart{text[:open], false})
+			text = text[open:]
+		case end < 0:
+			return nil, fmt.Errorf("Unterminated { in template %q", text)
+		default:
+			ft = append(ft, tmplpart{text[1:end], true})
+			text = text[end+1:]
+		}
+	}
+	return ft, nil
+}
+
+//fill expands the template for rec
+func (ft fieldtemplate) fill(rec *Record) (string, error) {
+	var buf bytes.Buffer
+	for _, p := range ft {
+		switch {
+		case !p.field:
+			buf.WriteString(p.text)
+		case p.text == ".":
+			if rec.Raw == nil {
+				raw, err := json.Marshal(rec.Fields)
+				if err != nil {
+					return "", err
+				}
+				rec.Raw = raw
+			}
+			buf.Write(rec.Raw)
+		default:
+			v, ok := rec.Fields[p.text]
+			if !ok {
+				return "", fmt.Errorf("Field %s missing", p.text)
+			}
+			buf.WriteString(v)
+		}
+	}
+	return buf.String(), nil
+}
+
+//TextParser turns text filled in from a record into bytes, see Importer
+type TextParser func(text string) ([]byte, error)
+
+//ParseText reads text written by TextKeyDecoder or TextDecoder, decoding base64 after "base64:"
+func ParseText(text string) ([]byte, error) {
+	if !strings.HasPrefix(text, textprefix) {
+		return []byte(text), nil
+	}
+	return base64.StdEncoding.DecodeString(text[len(textprefix):])
+}
+
+//ParseHex reads text written by HexKeyDecoder
+func ParseHex(text string) ([]byte, error) {
+	return hex.DecodeString(text)
+}
+
+//Importer bulk loads records into partitions. Partition, Bucket, Key and Value are
+//templates filled from record fields, e.g. Bucket "{city}" and Key "{date}T{hour}".
+//Touched partitions are rewritten as a whole, like Batch.
+type Importer struct {
+	//Partition template, ignored if Partitioner is set
+	Partition string
+	//Partitioner computes partitions from bucket and key instead of a template
+	Partitioner Partitioner
+	Bucket      string
+	Key         string
+	//Value defaults to "{.}", the whole record as json
+	Value string
+	//ParseKey converts filled in buckets and keys, e.g. ParseText for keys exported with
+	//TextKeyDecoder. They are used as they are if nil.
+	ParseKey TextParser
+	//ParseValue converts filled in values like ParseKey
+	ParseValue TextParser
+	//Mutable is passed to SetPart
+	Mutable bool
+	//Parallelism is the number of partitions built and uploaded at once
+	Parallelism int
+
+	db *DB
+}
+
+//NewImporter creates an Importer writing to db
+func NewImporter(db *DB) *Importer {
+	return &Importer{Value: "{.}", Parallelism: 4, db: db}
+}
+
+//ImportReport is the outcome of Import
+type ImportReport struct {
+	//Records is the number of records read
+	Records int
+	//Partitions were uploaded
+	Partitions []string
+	//Errored partitions failed to build or upload
+	Errored map[string]error
+}
+
+//importentry is a single key waiting to be written
+type importentry struct {
+	bucket, key, value []byte
+}
+
+//importentries sorts by bucket and key, bolt is fastest when keys are appended in order
+type importentries []importentry
+
+func (ie importentries) Len() int      { return len(ie) }
+func (ie importentries) Swap(i, j int) { ie[i], ie[j] = ie[j], ie[i] }
+func (ie importentries) Less(i, j int) bool {
+	if c := bytes.Compare(ie[i].bucket, ie[j].bucket); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(ie[i].key, ie[j].key) < 0
+}
+
+//Import reads all records, then builds and uploads the partitions they map to.
+//Records are held in memory until every one has been read, so a bad record
+//aborts the import before anything is uploaded. If a key repeats, the last record wins.
+func (im *Importer) Import(rr RecordReader) (*ImportReport, error) {
+	var tmpls [4]fieldtemplate
+	for i, text := range []string{im.Partition, im.Bucket, im.Key, im.Value} {
+		if i == 0 && im.Partitioner != nil {
+			continue
+		}
+		if text == "" {
+			return nil, fmt.Errorf("Import: partition, bucket, key and value templates are required")
+		}
+		var err error
+		tmpls[i], err = parsetemplate(text)
+		if err != nil {
+			return nil, errors.Wrap(err, "Import")
+		}
+	}
+	report := &ImportReport{Errored: make(map[string]error)}
+	groups := make(map[string]importentries)
+	for {
+		rec, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = im.add(groups, tmpls, rec)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Import: record %d", report.Records+1)
+		}
+		report.Records++
+	}
+	partids := make([]string, 0, len(groups))
+	for partid := range groups {
+		partids = append(partids, partid)
+	}
+	sort.Strings(partids)
+	var mu sync.Mutex
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < im.Parallelism || i == 0; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partid := range work {
+				err := im.build(partid, groups[partid])
+				mu.Lock()
+				if err != nil {
+					report.Errored[partid] = err
+				} else {
+					report.Partitions = append(report.Partitions, partid)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, partid := range partids {
+		work <- partid
+	}
+	close(work)
+	wg.Wait()
+	sort.Strings(report.Partitions)
+	return report, nil
+}
+
+//add maps rec to its partition
+func (im *Importer) add(groups map[string]importentries, tmpls [4]fieldtemplate, rec *Record) error {
+	var vals [4]string
+	for i, ft := range tmpls {
+		if ft == nil {
+			continue
+		}
+		var err error
+		vals[i], err = ft.fill(rec)
+		if err != nil {
+			return err
+		}
+	}
+	var e importentry
+	var err error
+	e.bucket, err = parsetext(im.ParseKey, vals[1])
+	if err == nil {
+		e.key, err = parsetext(im.ParseKey, vals[2])
+	}
+	if err == nil {
+		e.value, err = parsetext(im.ParseValue, vals[3])
+	}
+	if err != nil {
+		return err
+	}
+	partid := vals[0]
+	if im.Partitioner != nil {
+		partid, err = im.Partitioner.Partition(e.bucket, e.key)
+		if err != nil {
+			return err
+		}
+	}
+	groups[partid] = append(groups[partid], e)
+	return nil
+}
+
+//parsetext converts text with parse, as it is if parse is nil
+func parsetext(parse TextParser, text string) ([]byte, error) {
+	if parse == nil {
+		return []byte(text), nil
+	}
+	b, err := parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %q", text)
+	}
+	return b, nil
+}
+
+//build writes entries into a fresh partition and uploads it
+func (im *Importer) build(partid string, entries importentries) error {
+	sort.Stable(entries)
+	bld, err := NewBuilder(partid)
+	if err != nil {
+		return err
+	}
+	err = bld.Update(func(tx *bolt.Tx) error {
+		var bkt *bolt.Bucket
+		for i, e := range entries {
+			if i == 0 || !bytes.Equal(e.bucket, entries[i-1].bucket) {
+				var err error
+				bkt, err = tx.CreateBucket(e.bucket)
+				if err != nil {
+					return errors.Wrapf(err, "bucket %q", e.bucket)
+				}
+				//Keys arrive sorted, pack pages full
+				bkt.FillPercent = 1
+			}
+			err := bkt.Put(e.key, e.value)
+			if err != nil {
+				return errors.Wrapf(err, "key %q", e.key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bld.Discard()
+		return err
+	}
+	return bld.Commit(im.db, im.Mutable)
+}
@@ -0,0 +1,94 @@
+package infreqdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	rec := &Record{Fields: map[string]string{"city": "bangkok", "date": "2017-01-01"}}
+	for text, expected := range map[string]string{
+		"{city}":          "bangkok",
+		"{city}-{date}":   "bangkok-2017-01-01",
+		"x{date}y":        "x2017-01-01y",
+		"plain":           "plain",
+		"{.}":             `{"city":"bangkok","date":"2017-01-01"}`,
+		"{city}{city}/":   "bangkokbangkok/",
+		"{date}T00:00:00": "2017-01-01T00:00:00",
+	} {
+		ft, err := parsetemplate(text)
+		if err != nil {
+			t.Errorf("%v: %v", text, err)
+			continue
+		}
+		v, err := ft.fill(rec)
+		if err != nil || v != expected {
+			t.Errorf("%v: expected %v, got %v %v", text, expected, v, err)
+		}
+	}
+	for _, text := range []string{"{city", "city}", "}{"} {
+		if _, err := parsetemplate(text); err == nil {
+			t.Errorf("%v: expected error", text)
+		}
+	}
+	ft, _ := parsetemplate("{nofield}")
+	if _, err := ft.fill(rec); err == nil {
+		t.Error("expected missing field error")
+	}
+}
+
+func TestImporter(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	im := NewImporter(db)
+	im.Partition = "{date}"
+	im.Bucket = "{city}"
+	im.Key = "{hour}"
+	jsonl := `{"date": "2017-01-01", "city": "bangkok", "hour": "01", "temp": 30.5}
+{"date": "2017-01-01", "city": "bangkok", "hour": "00", "temp": 29}
+{"date": "2017-01-02", "city": "singapore", "hour": "00", "temp": 28, "wind": {"speed": 3}}
+{"date": "2017-01-01", "city": "bangkok", "hour": "01", "temp": 31}
+`
+	report, err := im.Import(NewJSONLReader(strings.NewReader(jsonl)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 4 || len(report.Partitions) != 2 || len(report.Errored) != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	//Last record wins, values default to the record as read
+	v, err := db.Get("2017-01-01", []byte("bangkok"), []byte("01"))
+	if err != nil || string(v) != `{"date": "2017-01-01", "city": "bangkok", "hour": "01", "temp": 31}` {
+		t.Errorf("unexpected value %s %v", v, err)
+	}
+	//CSV with a partitioner instead of a template
+	im = NewImporter(db)
+	im.Partitioner = &PrefixPartitioner{Len: 4}
+	im.Bucket = "{city}"
+	im.Key = "{date}"
+	im.Value = "{temp}C"
+	csv := "city,date,temp\namsterdam,2017-03-01,5\namsterdam,2017-03-02,6\n"
+	report, err = im.Import(NewCSVReader(strings.NewReader(csv)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 2 || len(report.Partitions) != 1 || report.Partitions[0] != "2017" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	v, err = db.Get("2017", []byte("amsterdam"), []byte("2017-03-02"))
+	if err != nil || string(v) != "6C" {
+		t.Errorf("expected 6C, got %s %v", v, err)
+	}
+	//A bad record aborts before anything is uploaded
+	_, err = im.Import(NewCSVReader(strings.NewReader("city,temp\nparis,7\n")))
+	if err == nil || !strings.Contains(err.Error(), "record 1") {
+		t.Errorf("expected missing field error, got %v", err)
+	}
+}
@@ -1,7 +1,11 @@
 package infreqdb
 
 import (
+	"context"
 	"log"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluele/gcache"
@@ -12,111 +16,238 @@ import (
 
 //DB is an instance of InfreqDB
 type DB struct {
+	//stats first, atomic access needs 64-bit alignment
+	stats dbstats
 	//ttlFunc TTLMethod
 	cache   gcache.Cache
 	storage Storage
+	//loadmu guards loads and failures, keyed like the cache
+	loadmu     sync.Mutex
+	loads      map[interface{}]*loadcall
+	failures   map[interface{}]*loadfailure
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	//inv broadcasts changes to other nodes, nil when not clustered
+	inv Invalidator
+	//cluster decides which partitions we cache, nil when every partition is cached locally
+	cluster *Cluster
+	//size is the cache capacity in partitions
+	size int
+	//filters caches bloom filters by partid, nil when they are disabled
+	filters gcache.Cache
+	//usemanifest is set by WithManifest, manifestmu guards manifest, nil until loaded
+	usemanifest bool
+	manifestmu  sync.Mutex
+	manifest    *manifest
+	//usedeltas is set by WithDeltas, a Delta.Commit compacts once compactAt deltas piled up
+	usedeltas bool
+	compactAt int
+	//engines open partitions, see WithEngines
+	engines []Engine
+	//rangereads is set by WithRangeReads, engineof remembers the engine of partitions loaded
+	rangereads bool
+	engineof   gcache.Cache
 }
 
-func getfname(key interface{}) (string, error) {
-	partition, ok := key.(string)
-	if !ok {
-		return "", ErrKeyNotString
+//Option configures optional DB behaviour
+type Option func(*DB)
+
+//WithLoadBackoff sets how long a failed partition load is remembered.
+//The delay starts at min and doubles on every consecutive failure up to max.
+func WithLoadBackoff(min, max time.Duration) Option {
+	return func(db *DB) {
+		db.minBackoff = min
+		db.maxBackoff = max
+	}
+}
+
+//WithInvalidator makes SetPart, DeletePart and Seal tell other nodes about changes,
+//and expires partitions other nodes report. The DB closes inv on Close.
+func WithInvalidator(inv Invalidator) Option {
+	return func(db *DB) {
+		db.inv = inv
 	}
-	return partition, nil
 }
 
 //New creates a new InfreqDB instance
 //len is number of partitions to hold on disk.. use wisely...
 //Better to use NewWithStorage() instead. New() will remain for backwards compatibility
-func New(bucket *s3.Bucket, prefix string, len int) (*DB, error) {
-	return NewWithStorage(&S3Storage{bucket, prefix}, len)
+func New(bucket *s3.Bucket, prefix string, len int, opts ...Option) (*DB, error) {
+	return NewWithStorage(NewS3Storage(bucket, prefix), len, opts...)
 }
 
 //NewWithStorage creates new DB with user provided storage
-func NewWithStorage(storage Storage, len int) (*DB, error) {
-	gc := gcache.New(len).
+func NewWithStorage(storage Storage, len int, opts ...Option) (*DB, error) {
+	db := &DB{
+		storage:    storage,
+		size:       len,
+		loads:      make(map[interface{}]*loadcall),
+		failures:   make(map[interface{}]*loadfailure),
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	db.cache = gcache.New(len).
 		LRU().
-		LoaderFunc(func(key interface{}) (interface{}, error) {
-			partition, err := getfname(key)
-			if err != nil {
-				return nil, err
-			}
-			//Load data from S3 partition
-			log.Println("loading", key, partition)
-			st := time.Now()
-			data, err := newcachepartition(partition, storage)
-			if err != nil {
-				return nil, err
-			}
-			log.Println("loaded", key, partition, time.Since(st))
-			return data, nil
-		}).
 		EvictedFunc(func(k interface{}, v interface{}) {
-			//Close the cachepartition when evicting
+			//Close the cachepartition when evicting, snapshots may hold on to it a while longer
 			part, ok := v.(*cachepartition)
 			if ok {
 				log.Println("closing", k, part.fname)
-				part.close()
+				part.evict()
 			}
 		}).
 		Build()
-	return &DB{
-		cache:   gc,
-		storage: storage,
-	}, nil
+	if db.inv != nil {
+		err := db.inv.Listen(func(partid string) {
+			db.forgetengine(partid)
+			db.Expire(partid)
+			if db.usemanifest {
+				//Changed elsewhere, so was the manifest
+				db.reloadmanifest()
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
 }
 
 //Expire evicts the partition from disk
 func (db *DB) Expire(partid string) {
+	atomic.AddInt64(&db.stats.expired, 1)
+	if db.filters != nil {
+		db.filters.Remove(partid)
+	}
+	db.loadmu.Lock()
+	db.forget(partid)
+	db.loadmu.Unlock()
 	db.cache.Remove(partid)
 }
 
-//Silently fails... no evictions on network or parsing failure
-func (db *DB) gets3lastmod(partid string) time.Time {
-	return db.storage.GetLastMod(partid)
+//ExpiryReport is the outcome of a CheckExpiry round.
+//Immutable partitions are never checked and do not show up.
+type ExpiryReport struct {
+	//Expired partitions changed upstream and were evicted
+	Expired []string
+	//Unchanged partitions are still current
+	Unchanged []string
+	//Deleted partitions no longer exist upstream and were evicted
+	Deleted []string
+	//Errored partitions could not be checked and were kept
+	Errored map[string]error
 }
 
-//CheckExpiry expires items that have changed upstream
+//CheckExpiry expires items that have changed or were deleted upstream
 //Maybe unexport it and launch as loop
-func (db *DB) CheckExpiry() int {
-	count := 0
-	//TODO: Maybe listing the bucket is more efficient.
+func (db *DB) CheckExpiry() *ExpiryReport {
+	report := &ExpiryReport{Errored: make(map[string]error)}
+	if db.filters != nil {
+		//Cheaper to fetch filters again on demand than to check them
+		for k, v := range db.filters.GetALL() {
+			if bf, ok := v.(*bloomfilter); ok && bf.mutable {
+				db.filters.Remove(k)
+			}
+		}
+	}
+	if db.usemanifest {
+		//Keeps ListParts and range scans current. Changes are checked with storage,
+		//writers that don't update the manifest would go unnoticed otherwise.
+		if err := db.refreshmanifest(); err != nil {
+			log.Println("CheckExpiry manifest", err)
+		}
+	}
 	//Loop thru cache and compare last modified, expire if stale
 	for k, v := range db.cache.GetALL() {
 		partid, ok := k.(string)
-		if ok {
-			part, ok := v.(*cachepartition)
-			if ok {
-				//Only check mutable partitions to limit number of HEAD requests
-				if part.mutable && part.lastModified.Before(db.gets3lastmod(partid)) {
-					count++
-					db.Expire(partid)
-				}
-			}
+		if !ok {
+			continue
+		}
+		part, ok := v.(*cachepartition)
+		//Only check mutable partitions to limit number of HEAD requests
+		if !ok || !part.mutable {
+			continue
 		}
+		lastmod, found, err := db.storage.Stat(partid)
+		switch {
+		case err != nil:
+			log.Println("CheckExpiry", partid, err)
+			report.Errored[partid] = err
+		case !found && part.r != nil:
+			report.Deleted = append(report.Deleted, partid)
+			db.Expire(partid)
+		case found && part.lastModified.Before(lastmod):
+			report.Expired = append(report.Expired, partid)
+			db.Expire(partid)
+		case db.usedeltas && db.hasdelta(partid, part.deltagen, part.deltas+1):
+			report.Expired = append(report.Expired, partid)
+			db.Expire(partid)
+		default:
+			report.Unchanged = append(report.Unchanged, partid)
+		}
+	}
+	return report
+}
+
+//getpart returns the cached partition, loading it if needed
+func (db *DB) getpart(partid string) (*cachepartition, error) {
+	if db.cluster != nil && !db.cluster.IsOwner(partid) {
+		return nil, &NotOwnerError{Partition: partid, Owners: db.cluster.Owners(partid)}
+	}
+	cp, ok, err := db.cached(partid)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		atomic.AddInt64(&db.stats.hits, 1)
+		return cp, nil
 	}
-	return count
+	atomic.AddInt64(&db.stats.misses, 1)
+	return db.load(partid)
 }
 
 //Get gets single key from db
 func (db *DB) Get(partid string, bucket, key []byte) ([]byte, error) {
-	data, err := db.cache.Get(partid)
+	if db.cluster != nil && !db.cluster.IsOwner(partid) {
+		results, err := db.cluster.forward(context.Background(), partid, []Lookup{{partid, bucket, key}})
+		if err != nil {
+			return nil, err
+		}
+		return results[0].Value, results[0].Err
+	}
+	if db.ruledout(partid, bucket, key) {
+		return nil, errkeynotfound(bucket, key)
+	}
+	cp, err := db.getpart(partid)
 	if err != nil {
 		return nil, err
 	}
-	cp, ok := data.(*cachepartition)
-	if !ok {
-		return nil, ErrInvalidObject
+	v, err := cp.get(bucket, key)
+	if db.changed(partid, err) {
+		//Read in ranges and replaced since, once more with the new copy
+		cp, err = db.getpart(partid)
+		if err != nil {
+			return nil, err
+		}
+		v, err = cp.get(bucket, key)
 	}
-	return cp.get(bucket, key)
+	return v, err
 }
 
 //View inside individual bolt db
 //See https://godoc.org/github.com/boltdb/bolt#DB.View for more info
 //Second return argument indicates if the partition is mutable.
 //Helpful hint for downstream caching.
+//Partitions opened by another engine than BoltEngine return ErrNotBolt, read those with ReadPart,
+//GetPath, ForEachPath or RangePath.
 func (db *DB) View(partid string, fn func(*bolt.Tx) error) (bool, error) {
-	data, err := db.cache.Get(partid)
+	cp, err := db.getpart(partid)
+	if _, ok := err.(*NotOwnerError); ok || err == ErrInvalidObject {
+		return false, err
+	}
 	if err != nil {
 		if IsNotFound(err) {
 			//Not found errors should not propagate error.
@@ -125,26 +256,140 @@ func (db *DB) View(partid string, fn func(*bolt.Tx) error) (bool, error) {
 		}
 		return true, errors.Wrap(err, "View")
 	}
-	cp, ok := data.(*cachepartition)
-	if !ok {
-		return false, ErrInvalidObject
-	}
 	return cp.mutable, cp.view(fn)
 }
 
 //SetPart uploads the partition to S3 and expires local cache
-//fname is the path to an uncompressed boltdb file
-//Cache for this partition is invalidated. If running on a cluster you need to
-// propagate this and Expire(partid) somehow.
+//fname is the path to an uncompressed boltdb file, or a file of another engine, see WithEngines.
+//The first engine recognizing it is recorded as its engine, a Builder records BoltEngine.
+//Cache for this partition is invalidated, on other nodes too if an Invalidator is set.
+//Without one, if running on a cluster you need to propagate this and Expire(partid) somehow.
 // Set mutable to true in case you expect changes to this partition
 func (db *DB) SetPart(partid, fname string, mutable bool) error {
-	err := db.storage.Put(partid, fname, mutable)
+	return db.setpart(partid, fname, mutable, enginename(fname, db.engines))
+}
+
+//setpart is SetPart recording engine, the engine that built fname
+func (db *DB) setpart(partid, fname string, mutable bool, engine string) error {
+	var old int64
+	if db.usedeltas {
+		var err error
+		old, err = db.deltagen(partid)
+		if err != nil {
+			return errors.Wrap(err, "SetPart")
+		}
+	}
+	if db.filters != nil {
+		//An old filter would hide new keys, drop it before the partition changes
+		err := db.storage.Delete(partid + BloomSuffix)
+		if err != nil {
+			return errors.Wrap(err, "SetPart")
+		}
+	}
+	err := putengine(db.storage, partid, fname, mutable, engine)
+	if err == nil {
+		db.rememberengine(partid, engine)
+	}
+	if err == nil && db.filters != nil {
+		//Without a filter reads just download the partition
+		if ferr := db.putbloom(partid, fname, engine, mutable); ferr != nil {
+			log.Println("bloom", partid, ferr)
+		}
+	}
+	if err == nil && db.usemanifest {
+		err = db.putmanifestentry(partid, fname, engine, mutable)
+	}
+	if err == nil && db.usedeltas {
+		//Deltas were made against the old partition, readers already ignore them
+		var gen int64
+		gen, err = db.deltagen(partid)
+		if err == nil && gen == old {
+			//Replaced within the timestamp resolution, can't tell old deltas from new ones
+			gen = -1
+		}
+		if err == nil {
+			err = db.deletedeltas(partid, old, gen)
+		}
+	}
 	db.Expire(partid)
-	return errors.Wrap(err, "SetPart")
+	if err != nil {
+		return errors.Wrap(err, "SetPart")
+	}
+	return errors.Wrap(db.invalidate(partid), "SetPart")
+}
+
+//DeletePart removes the partition from storage and expires local cache
+func (db *DB) DeletePart(partid string) error {
+	var old int64
+	if db.usedeltas {
+		var err error
+		old, err = db.deltagen(partid)
+		if err != nil {
+			return errors.Wrap(err, "DeletePart")
+		}
+	}
+	err := db.storage.Delete(partid)
+	db.forgetengine(partid)
+	if err == nil && db.filters != nil {
+		err = db.storage.Delete(partid + BloomSuffix)
+	}
+	if err == nil && db.usemanifest {
+		err = errors.Wrap(db.updatemanifest(partid, nil), "manifest")
+	}
+	if err == nil && db.usedeltas {
+		err = db.deletedeltas(partid, old, -1)
+	}
+	db.Expire(partid)
+	if err != nil {
+		return errors.Wrap(err, "DeletePart")
+	}
+	return errors.Wrap(db.invalidate(partid), "DeletePart")
+}
+
+//Seal marks a partition immutable, so CheckExpiry stops checking it.
+//The partition is downloaded and uploaded again with the new flag, merging any deltas.
+func (db *DB) Seal(partid string) error {
+	var fname, engine string
+	var found, mutable bool
+	var err error
+	if db.usedeltas {
+		var m *materialized
+		m, err = db.materialize(partid)
+		if m != nil {
+			fname, engine, found, mutable = m.fname, m.engine, true, m.mutable
+		}
+	} else {
+		fname, found, mutable, _, engine, err = getengine(db.storage, partid)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Seal")
+	}
+	if !found {
+		return errors.Errorf("Seal: partition %s not found", partid)
+	}
+	defer os.Remove(fname)
+	if !mutable {
+		return nil
+	}
+	if engine == "" {
+		engine = enginename(fname, db.engines)
+	}
+	return db.setpart(partid, fname, false, engine)
+}
+
+//invalidate tells other nodes about a change to partid
+func (db *DB) invalidate(partid string) error {
+	if db.inv == nil {
+		return nil
+	}
+	return db.inv.Invalidate(partid)
 }
 
 //Close closes the db and deletes all local database fragments
 func (db *DB) Close() {
+	if db.inv != nil {
+		db.inv.Close()
+	}
 	for _, k := range db.cache.Keys() {
 		db.cache.Remove(k)
 	}
@@ -102,9 +102,9 @@ func TestDB(t *testing.T) {
 		t.Errorf("expected 42, got %s", item)
 	}
 	//Run CheckExpiry() loop and make sure nothing is expired
-	count := db.CheckExpiry()
-	if count != 0 {
-		t.Errorf("expected 0 expires, got %v", count)
+	report := db.CheckExpiry()
+	if len(report.Expired) != 0 {
+		t.Errorf("expected 0 expires, got %v", report.Expired)
 	}
 	//YIKES: Sleep a second since http time is at 1 second resolution
 	time.Sleep(time.Second)
@@ -151,9 +151,9 @@ func TestDB(t *testing.T) {
 		t.Error("Expected an error")
 	}
 	//Run CheckExpiry() loop and make sure nothing has expired
-	count = db.CheckExpiry()
-	if count != 0 {
-		t.Errorf("expected 0 expires, got %v", count)
+	report = db.CheckExpiry()
+	if len(report.Expired) != 0 {
+		t.Errorf("expected 0 expires, got %v", report.Expired)
 	}
 	//YIKES: Sleep a second since http time is at 1 second resolution
 	time.Sleep(time.Second)
@@ -185,9 +185,9 @@ func TestDB(t *testing.T) {
 		t.Error(err)
 	}
 	//Ensure expiry function catches the change
-	count = db.CheckExpiry()
-	if count != 1 {
-		t.Errorf("expected 1 expires, got %v", count)
+	report = db.CheckExpiry()
+	if len(report.Expired) != 1 {
+		t.Errorf("expected 1 expires, got %v", report.Expired)
 	}
 	//Ensure fresh value is available
 	item, err = db.Get("whatever", []byte("MyBucket"), []byte("answer"))
@@ -197,4 +197,25 @@ func TestDB(t *testing.T) {
 	if string(item) != "42" {
 		t.Errorf("expected 42, got %s", item)
 	}
+	//Delete upstream, must be noticed and evicted
+	err = bucket.Del("/foo/whatever")
+	if err != nil {
+		t.Error(err)
+	}
+	report = db.CheckExpiry()
+	if len(report.Deleted) != 1 || report.Deleted[0] != "whatever" {
+		t.Errorf("expected whatever to be deleted, got %+v", report)
+	}
+	item, err = db.Get("whatever", []byte("MyBucket"), []byte("answer"))
+	if err != nil {
+		t.Error(err)
+	}
+	if item != nil {
+		t.Errorf("expected nil after delete, got %s", item)
+	}
+	//Missing partition stays unchanged while it is still missing
+	report = db.CheckExpiry()
+	if len(report.Unchanged) != 1 || len(report.Deleted) != 0 {
+		t.Errorf("expected whatever to be unchanged, got %+v", report)
+	}
 }
@@ -0,0 +1,479 @@
+package infreqdb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//Invalidator tells the other nodes of a cluster that partitions changed.
+//DB broadcasts through it on SetPart, DeletePart and Seal, and expires
+//partitions reported by other nodes.
+type Invalidator interface {
+	//Invalidate tells other nodes that partid changed
+	Invalidate(partid string) error
+	//Listen delivers partids invalidated by other nodes to fn, until Close
+	Listen(fn func(partid string)) error
+	//Close stops listening
+	Close() error
+}
+
+//InvalidatePath is where an HTTPInvalidator expects to be mounted
+const InvalidatePath = "/infreqdb/invalidate"
+
+const (
+	//SignatureHeader carries the HMAC of requests between nodes sharing a secret
+	SignatureHeader = "X-Infreqdb-Signature"
+	//TimestampHeader carries when a request was signed, in nanoseconds since the epoch
+	TimestampHeader = "X-Infreqdb-Timestamp"
+	//NonceHeader carries a random value making every signed request unique
+	NonceHeader = "X-Infreqdb-Nonce"
+	//signskew is how far the time of a signed request may be from ours,
+	//older requests are refused and nonces are remembered that long
+	signskew = time.Minute
+)
+
+//mac is the HMAC-SHA256 of msg with secret
+func mac(secret []byte, msg ...string) []byte {
+	m := hmac.New(sha256.New, secret)
+	for _, s := range msg {
+		m.Write([]byte(s))
+		//Keeps ("ab", "c") and ("a", "bc") apart
+		m.Write([]byte{0})
+	}
+	return m.Sum(nil)
+}
+
+//sign sets SignatureHeader of r, nothing without a secret.
+//The signature also covers TimestampHeader and NonceHeader so it can't be replayed.
+func sign(r *http.Request, secret []byte, msg ...string) {
+	if secret == nil {
+		return
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		//Unsigned, the peer refuses it
+		log.Println("sign", err)
+		return
+	}
+	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+	r.Header.Set(TimestampHeader, ts)
+	r.Header.Set(NonceHeader, hex.EncodeToString(nonce))
+	msg = append(append([]string(nil), msg...), ts, r.Header.Get(NonceHeader))
+	r.Header.Set(SignatureHeader, hex.EncodeToString(mac(secret, msg...)))
+}
+
+//verify checks SignatureHeader of r, anything goes without a secret.
+//Requests signed more than signskew away from now and nonces seen before are refused.
+func verify(r *http.Request, secret []byte, msg ...string) bool {
+	if secret == nil {
+		return true
+	}
+	ts, nonce := r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader)
+	nanos, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || nonce == "" {
+		return false
+	}
+	if skew := time.Since(time.Unix(0, nanos)); skew > signskew || skew < -signskew {
+		return false
+	}
+	sig, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	msg = append(append([]string(nil), msg...), ts, nonce)
+	return err == nil && hmac.Equal(sig, mac(secret, msg...)) && nonces.firstseen(nonce)
+}
+
+//noncecache remembers the nonces of verified requests for signskew
+type noncecache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+//nonces is shared by every handler of the process, nonces are random so they don't collide
+var nonces = &noncecache{seen: make(map[string]time.Time)}
+
+//firstseen records nonce, returning false if it was seen before
+func (nc *noncecache) firstseen(nonce string) bool {
+	now := time.Now()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if _, ok := nc.seen[nonce]; ok {
+		return false
+	}
+	for k, t := range nc.seen {
+		//Twice the skew, a request from a clock ahead of ours stays valid that long
+		if now.Sub(t) > 2*signskew {
+			delete(nc.seen, k)
+		}
+	}
+	nc.seen[nonce] = now
+	return true
+}
+
+//HTTPInvalidator POSTs invalidations to every peer, webhook style.
+//It is also the http.Handler receiving them, mount it at InvalidatePath.
+//Without SetSecret anyone reaching the handler can expire partitions.
+type HTTPInvalidator struct {
+	self   string
+	client *http.Client
+	mu     sync.RWMutex
+	peers  []string
+	fn     func(partid string)
+	secret []byte
+}
+
+//NewHTTPInvalidator creates an HTTPInvalidator. self and peers are base urls like
+//http://10.0.0.1:8080, self is skipped when broadcasting.
+func NewHTTPInvalidator(self string, peers []string) *HTTPInvalidator {
+	hi := &HTTPInvalidator{
+		self:   self,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	hi.SetPeers(peers)
+	return hi
+}
+
+//SetPeers replaces the list of nodes to notify
+func (hi *HTTPInvalidator) SetPeers(peers []string) {
+	hi.mu.Lock()
+	hi.peers = append([]string(nil), peers...)
+	hi.mu.Unlock()
+}
+
+//SetSecret makes invalidations carry an HMAC of the partition with secret,
+//unsigned ones are refused. Every node needs the same secret.
+func (hi *HTTPInvalidator) SetSecret(secret []byte) {
+	hi.mu.Lock()
+	hi.secret = append([]byte(nil), secret...)
+	hi.mu.Unlock()
+}
+
+//Invalidate notifies all peers concurrently, returning an error if any of them failed
+func (hi *HTTPInvalidator) Invalidate(partid string) error {
+	hi.mu.RLock()
+	peers := hi.peers
+	secret := hi.secret
+	hi.mu.RUnlock()
+	errs := make(chan error, len(peers))
+	n := 0
+	for _, peer := range peers {
+		if peer == hi.self {
+			continue
+		}
+		n++
+		go func(peer string) {
+			req, err := http.NewRequest("POST", peer+InvalidatePath, strings.NewReader(url.Values{"part": {partid}}.Encode()))
+			var resp *http.Response
+			if err == nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				sign(req, secret, "invalidate", partid)
+				resp, err = hi.client.Do(req)
+			}
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusNoContent {
+					err = fmt.Errorf("%s", resp.Status)
+				}
+			}
+			if err != nil {
+				err = errors.Wrapf(err, "invalidate %s on %s", partid, peer)
+			}
+			errs <- err
+		}(peer)
+	}
+	var first error
+	failed := 0
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			log.Println(err)
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		return errors.Wrapf(first, "%d of %d peers failed", failed, n)
+	}
+	return nil
+}
+
+//Listen sets the function called for incoming invalidations
+func (hi *HTTPInvalidator) Listen(fn func(partid string)) error {
+	hi.mu.Lock()
+	hi.fn = fn
+	hi.mu.Unlock()
+	return nil
+}
+
+//Close stops delivering invalidations
+func (hi *HTTPInvalidator) Close() error {
+	return hi.Listen(nil)
+}
+
+//ServeHTTP receives an invalidation from a peer
+func (hi *HTTPInvalidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	partid := r.FormValue("part")
+	if partid == "" {
+		http.Error(w, "part missing", http.StatusBadRequest)
+		return
+	}
+	hi.mu.RLock()
+	fn := hi.fn
+	secret := hi.secret
+	hi.mu.RUnlock()
+	if !verify(r, secret, "invalidate", partid) {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	if fn == nil {
+		http.Error(w, "not listening", http.StatusServiceUnavailable)
+		return
+	}
+	fn(partid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//udpmagic starts every gossip packet
+var udpmagic = []byte("IFQI\x01")
+
+const (
+	//udpidlen is the size of the random message id used to drop duplicates
+	udpidlen = 16
+	//udpseen is how long messages are accepted after they were sent, ids are remembered twice that
+	//so a message from a clock ahead of ours can't be replayed once its id is forgotten
+	udpseen = time.Minute
+)
+
+//UDPInvalidator spreads invalidations by gossip over UDP, in the style of memberlist.
+//Each message goes to Fanout random peers which forward it until its TTL runs out,
+//duplicates are recognised by message id. There are no acks, so delivery is best effort,
+//CheckExpiry catches whatever gossip missed.
+//Without SetSecret anyone able to send packets to the node can expire partitions.
+type UDPInvalidator struct {
+	//Fanout is the number of peers each node sends a message to, 0 means all
+	Fanout int
+	//TTL is the number of hops a message travels
+	TTL int
+
+	conn   *net.UDPConn
+	mu     sync.Mutex
+	peers  []*net.UDPAddr
+	seen   map[string]time.Time
+	done   chan struct{}
+	secret []byte
+}
+
+//NewUDPInvalidator listens on self, a host:port, and gossips with peers.
+//self may appear in peers, it is skipped.
+func NewUDPInvalidator(self string, peers []string) (*UDPInvalidator, error) {
+	laddr, err := net.ResolveUDPAddr("udp", self)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	ui := &UDPInvalidator{
+		Fanout: 3,
+		TTL:    4,
+		conn:   conn,
+		seen:   make(map[string]time.Time),
+		done:   make(chan struct{}),
+	}
+	err = ui.SetPeers(peers)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ui, nil
+}
+
+//Addr returns the local address, handy when listening on port 0
+func (ui *UDPInvalidator) Addr() string {
+	return ui.conn.LocalAddr().String()
+}
+
+//SetPeers replaces the list of nodes to gossip with
+func (ui *UDPInvalidator) SetPeers(peers []string) error {
+	self := ui.conn.LocalAddr().String()
+	var addrs []*net.UDPAddr
+	for _, peer := range peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return err
+		}
+		if addr.String() == self {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	ui.mu.Lock()
+	ui.peers = addrs
+	ui.mu.Unlock()
+	return nil
+}
+
+//SetSecret makes packets end with an HMAC with secret, packets failing it are dropped.
+//Every node needs the same secret, call it before Listen.
+func (ui *UDPInvalidator) SetSecret(secret []byte) {
+	ui.mu.Lock()
+	ui.secret = append([]byte(nil), secret...)
+	ui.mu.Unlock()
+}
+
+//getsecret returns the secret, nil if there is none
+func (ui *UDPInvalidator) getsecret() []byte {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	return ui.secret
+}
+
+//Invalidate gossips partid to Fanout peers
+func (ui *UDPInvalidator) Invalidate(partid string) error {
+	id := make([]byte, udpidlen)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	ui.mu.Lock()
+	ui.seen[string(id)] = time.Now()
+	ui.mu.Unlock()
+	return ui.send(udpencode(ui.getsecret(), id, time.Now(), ui.TTL, partid))
+}
+
+//udpencode builds a packet: magic, id, sent, ttl, partid and the HMAC of all that if there is a secret
+func udpencode(secret, id []byte, sent time.Time, ttl int, partid string) []byte {
+	var msg bytes.Buffer
+	msg.Write(udpmagic)
+	msg.Write(id)
+	binary.Write(&msg, binary.BigEndian, sent.UnixNano())
+	msg.WriteByte(byte(ttl))
+	msg.WriteString(partid)
+	if secret != nil {
+		msg.Write(mac(secret, msg.String()))
+	}
+	return msg.Bytes()
+}
+
+//udpdecode parses a packet, checking its HMAC if there is a secret.
+//Packets sent more than udpseen away from now are dropped.
+func udpdecode(secret, msg []byte) (id []byte, sent time.Time, ttl int, partid string, ok bool) {
+	if secret != nil {
+		if len(msg) < sha256.Size {
+			return nil, time.Time{}, 0, "", false
+		}
+		sum := msg[len(msg)-sha256.Size:]
+		msg = msg[:len(msg)-sha256.Size]
+		if !hmac.Equal(sum, mac(secret, string(msg))) {
+			return nil, time.Time{}, 0, "", false
+		}
+	}
+	hdr := len(udpmagic) + udpidlen + 8 + 1
+	if len(msg) <= hdr || !bytes.Equal(msg[:len(udpmagic)], udpmagic) {
+		return nil, time.Time{}, 0, "", false
+	}
+	id = msg[len(udpmagic) : len(udpmagic)+udpidlen]
+	sent = time.Unix(0, int64(binary.BigEndian.Uint64(msg[len(udpmagic)+udpidlen:])))
+	if age := time.Since(sent); age > udpseen || age < -udpseen {
+		return nil, time.Time{}, 0, "", false
+	}
+	return id, sent, int(msg[hdr-1]), string(msg[hdr:]), true
+}
+
+//send writes msg to Fanout random peers
+func (ui *UDPInvalidator) send(msg []byte) error {
+	ui.mu.Lock()
+	peers := ui.peers
+	if ui.Fanout > 0 && ui.Fanout < len(peers) {
+		picked := make([]*net.UDPAddr, 0, ui.Fanout)
+		for _, i := range mrand.Perm(len(peers))[:ui.Fanout] {
+			picked = append(picked, peers[i])
+		}
+		peers = picked
+	}
+	ui.mu.Unlock()
+	var first error
+	for _, peer := range peers {
+		_, err := ui.conn.WriteToUDP(msg, peer)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+//Listen starts receiving gossip, fn is called once per message
+func (ui *UDPInvalidator) Listen(fn func(partid string)) error {
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, _, err := ui.conn.ReadFromUDP(buf)
+			if err != nil {
+				select {
+				case <-ui.done:
+					return
+				default:
+				}
+				log.Println("gossip", err)
+				continue
+			}
+			secret := ui.getsecret()
+			id, sent, ttl, partid, ok := udpdecode(secret, buf[:n])
+			if !ok || !ui.firstseen(id) {
+				continue
+			}
+			fn(partid)
+			if ttl > 1 {
+				ui.send(udpencode(secret, id, sent, ttl-1, partid))
+			}
+		}
+	}()
+	return nil
+}
+
+//firstseen records id, returning false if it was seen before
+func (ui *UDPInvalidator) firstseen(id []byte) bool {
+	now := time.Now()
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if _, ok := ui.seen[string(id)]; ok {
+		return false
+	}
+	for k, t := range ui.seen {
+		if now.Sub(t) > 2*udpseen {
+			delete(ui.seen, k)
+		}
+	}
+	ui.seen[string(id)] = now
+	return true
+}
+
+//Close stops listening and releases the socket
+func (ui *UDPInvalidator) Close() error {
+	select {
+	case <-ui.done:
+		return nil
+	default:
+		close(ui.done)
+	}
+	return ui.conn.Close()
+}
@@ -0,0 +1,309 @@
+package infreqdb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//noview is a View callback that reads nothing
+func noview(tx *bolt.Tx) error {
+	return nil
+}
+
+func TestHTTPInvalidator(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	var handlers [2]http.Handler
+	var urls []string
+	for i := range handlers {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	var dbs []*DB
+	for i := range handlers {
+		hi := NewHTTPInvalidator(urls[i], urls)
+		hi.SetSecret([]byte("s3cret"))
+		db, err := New(bucket, "/foo/", 10, WithInvalidator(hi))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		mux := http.NewServeMux()
+		mux.Handle(InvalidatePath, hi)
+		handlers[i] = mux
+		dbs = append(dbs, db)
+	}
+	put := func(value string) {
+		bld, err := NewBuilder("whatever")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bld.Put([]byte("MyBucket"), []byte("answer"), []byte(value))
+		err = bld.Commit(dbs[0], true)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	get := func(db *DB) string {
+		v, err := db.Get("whatever", []byte("MyBucket"), []byte("answer"))
+		if err != nil {
+			t.Error(err)
+		}
+		return string(v)
+	}
+	put("41")
+	if v := get(dbs[1]); v != "41" {
+		t.Errorf("expected 41, got %v", v)
+	}
+	//Node 1 has it cached, SetPart on node 0 must expire it there without CheckExpiry
+	put("42")
+	if v := get(dbs[1]); v != "42" {
+		t.Errorf("expected 42, got %v", v)
+	}
+	mutable, err := dbs[1].View("whatever", noview)
+	if err != nil || !mutable {
+		t.Errorf("expected mutable, got %v %v", mutable, err)
+	}
+	err = dbs[0].Seal("whatever")
+	if err != nil {
+		t.Error(err)
+	}
+	mutable, err = dbs[1].View("whatever", noview)
+	if err != nil || mutable {
+		t.Errorf("expected immutable after Seal, got %v %v", mutable, err)
+	}
+	err = dbs[0].DeletePart("whatever")
+	if err != nil {
+		t.Error(err)
+	}
+	if v := get(dbs[1]); v != "" {
+		t.Errorf("expected nothing after DeletePart, got %v", v)
+	}
+	//A dead peer is reported
+	hi := NewHTTPInvalidator(urls[0], append(urls, "http://127.0.0.1:1"))
+	if hi.Invalidate("whatever") == nil {
+		t.Error("Expected an error")
+	}
+	//Unsigned and wrongly signed invalidations are refused
+	hi = NewHTTPInvalidator(urls[0], urls)
+	if err := hi.Invalidate("whatever"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401, got %v", err)
+	}
+	hi.SetSecret([]byte("guess"))
+	if err := hi.Invalidate("whatever"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401, got %v", err)
+	}
+}
+
+func TestSignReplay(t *testing.T) {
+	secret := []byte("s3cret")
+	req, _ := http.NewRequest("POST", "http://127.0.0.1/", nil)
+	sign(req, secret, "invalidate", "foo")
+	if verify(req, secret, "invalidate", "bar") {
+		t.Error("expected another message to be refused")
+	}
+	if !verify(req, secret, "invalidate", "foo") {
+		t.Error("expected signed request to verify")
+	}
+	if verify(req, secret, "invalidate", "foo") {
+		t.Error("expected replayed request to be refused")
+	}
+	//Signed too long ago
+	sign(req, secret, "invalidate", "foo")
+	ts := strconv.FormatInt(time.Now().Add(-2*signskew).UnixNano(), 10)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(mac(secret, "invalidate", "foo", ts, req.Header.Get(NonceHeader))))
+	if verify(req, secret, "invalidate", "foo") {
+		t.Error("expected old request to be refused")
+	}
+	//Gossip too
+	id := make([]byte, udpidlen)
+	if _, _, _, _, ok := udpdecode(secret, udpencode(secret, id, time.Now(), 1, "foo")); !ok {
+		t.Error("expected packet to decode")
+	}
+	if _, _, _, _, ok := udpdecode(secret, udpencode(secret, id, time.Now().Add(-2*udpseen), 1, "foo")); ok {
+		t.Error("expected old packet to be dropped")
+	}
+}
+
+func TestUDPInvalidatorSecret(t *testing.T) {
+	recv, err := NewUDPInvalidator("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	recv.SetSecret([]byte("s3cret"))
+	got := make(chan string, 10)
+	recv.Listen(func(partid string) {
+		got <- partid
+	})
+	for _, secret := range []string{"", "guess", "s3cret"} {
+		send, err := NewUDPInvalidator("127.0.0.1:0", []string{recv.Addr()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		send.SetSecret([]byte(secret))
+		err = send.Invalidate("part-" + secret)
+		send.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case partid := <-got:
+		if partid != "part-s3cret" {
+			t.Errorf("expected only the signed invalidation, got %v", partid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("signed invalidation did not arrive")
+	}
+	select {
+	case partid := <-got:
+		t.Errorf("unexpected %v", partid)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+//TestUDPHelperProcess is not a real test, it is a gossip node run by TestUDPInvalidator
+func TestUDPHelperProcess(t *testing.T) {
+	if os.Getenv("INFREQDB_UDP_SELF") == "" {
+		return
+	}
+	ui, err := NewUDPInvalidator(os.Getenv("INFREQDB_UDP_SELF"), strings.Split(os.Getenv("INFREQDB_UDP_PEERS"), ","))
+	if err != nil {
+		fmt.Println("error", err)
+		os.Exit(1)
+	}
+	ui.Fanout, _ = strconv.Atoi(os.Getenv("INFREQDB_UDP_FANOUT"))
+	ui.Listen(func(partid string) {
+		fmt.Println("got", partid)
+	})
+	fmt.Println("ready")
+	//Parent closes stdin when done
+	io.Copy(ioutil.Discard, os.Stdin)
+	os.Exit(0)
+}
+
+func freeudpaddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestUDPInvalidator(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns processes")
+	}
+	self := freeudpaddr(t)
+	nodes := []string{self}
+	for i := 0; i < 4; i++ {
+		nodes = append(nodes, freeudpaddr(t))
+	}
+	ui, err := NewUDPInvalidator(self, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ui.Close()
+	//Send to a single node, the rest must learn about it through gossip
+	ui.Fanout = 1
+	got := make(chan string, 100)
+	ui.Listen(func(partid string) {
+		got <- "parent " + partid
+	})
+	for i, node := range nodes[1:] {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestUDPHelperProcess$")
+		cmd.Env = append(os.Environ(),
+			"INFREQDB_UDP_SELF="+node,
+			"INFREQDB_UDP_PEERS="+strings.Join(nodes, ","),
+			"INFREQDB_UDP_FANOUT=0",
+		)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			stdin.Close()
+			cmd.Wait()
+		}()
+		ready := make(chan struct{})
+		go func(i int) {
+			sc := bufio.NewScanner(stdout)
+			for sc.Scan() {
+				if sc.Text() == "ready" {
+					close(ready)
+					continue
+				}
+				got <- fmt.Sprintf("node%d %s", i, sc.Text())
+			}
+		}(i)
+		select {
+		case <-ready:
+		case <-time.After(10 * time.Second):
+			t.Fatal("helper did not start")
+		}
+	}
+	err = ui.Invalidate("part-1")
+	if err != nil {
+		t.Error(err)
+	}
+	seen := make(map[string]int)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 4 {
+		select {
+		case msg := <-got:
+			seen[msg]++
+		case <-timeout:
+			t.Fatalf("gossip did not reach every node: %v", seen)
+		}
+	}
+	//Give duplicates a chance to show up
+	linger := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case msg := <-got:
+			seen[msg]++
+		case <-linger:
+			done = true
+		}
+	}
+	for i := range nodes[1:] {
+		msg := fmt.Sprintf("node%d got part-1", i)
+		if seen[msg] != 1 {
+			t.Errorf("expected %q once, got %v", msg, seen)
+		}
+	}
+	if seen["parent part-1"] != 0 {
+		t.Error("parent must not deliver its own invalidation")
+	}
+}
@@ -0,0 +1,167 @@
+package infreqdb
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+//loadcall is a partition load in flight, shared by everyone asking for it
+type loadcall struct {
+	done chan struct{}
+	cp   *cachepartition
+	err  error
+	//expired is set when Expire runs during the load, the result may be stale
+	expired bool
+}
+
+//loadfailure remembers a failed load so we don't hammer storage
+type loadfailure struct {
+	err     error
+	retry   time.Time
+	backoff time.Duration
+}
+
+//cached returns the partition under key, a partid or versionkey, if it is in the cache, without loading it
+func (db *DB) cached(key interface{}) (*cachepartition, bool, error) {
+	data, err := db.cache.GetIFPresent(key)
+	if err != nil {
+		return nil, false, nil
+	}
+	cp, ok := data.(*cachepartition)
+	if !ok {
+		return nil, false, ErrInvalidObject
+	}
+	return cp, true, nil
+}
+
+//load returns partition partid, loading it from storage on a cache miss.
+//There is at most one load per partid in flight, concurrent callers wait for
+//it and share its result. A failed load is not retried before its backoff passed,
+//callers get the previous error instead.
+func (db *DB) load(partid string) (*cachepartition, error) {
+	return db.loadkey(partid, func() (*cachepartition, error) {
+		return db.loadpart(partid)
+	})
+}
+
+//loadkey is load for any cache key, fetch loads what goes under key
+func (db *DB) loadkey(key interface{}, fetch func() (*cachepartition, error)) (*cachepartition, error) {
+	db.loadmu.Lock()
+	cp, ok, err := db.cached(key)
+	if ok || err != nil {
+		db.loadmu.Unlock()
+		return cp, err
+	}
+	if call, ok := db.loads[key]; ok {
+		db.loadmu.Unlock()
+		<-call.done
+		return call.cp, call.err
+	}
+	if f, ok := db.failures[key]; ok && time.Now().Before(f.retry) {
+		db.loadmu.Unlock()
+		return nil, f.err
+	}
+	call := &loadcall{done: make(chan struct{})}
+	db.loads[key] = call
+	db.loadmu.Unlock()
+
+	for {
+		call.cp, call.err = fetch()
+		db.loadmu.Lock()
+		if call.err == nil && call.expired {
+			//Changed while we were downloading, fetch again
+			call.expired = false
+			db.loadmu.Unlock()
+			call.cp.close()
+			continue
+		}
+		break
+	}
+	delete(db.loads, key)
+	if call.err != nil {
+		db.fail(key, call.err)
+	} else {
+		delete(db.failures, key)
+		db.cache.Set(key, call.cp)
+	}
+	db.loadmu.Unlock()
+	close(call.done)
+	return call.cp, call.err
+}
+
+//loadpart fetches partid from storage
+func (db *DB) loadpart(partid string) (*cachepartition, error) {
+	log.Println("loading", partid)
+	atomic.AddInt64(&db.stats.loads, 1)
+	st := time.Now()
+	var cp *cachepartition
+	var err error
+	if db.rangereads {
+		cp, err = db.openranged(partid)
+	}
+	if err == nil && cp == nil {
+		cp, err = db.download(partid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cp.r != nil {
+		db.rememberengine(partid, cp.engine)
+	}
+	log.Println("loaded", partid, time.Since(st))
+	return cp, nil
+}
+
+//download fetches a copy of partid to disk, applying deltas
+func (db *DB) download(partid string) (*cachepartition, error) {
+	if db.usedeltas {
+		return db.newdeltapartition(partid)
+	}
+	return newcachepartition(partid, db.storage, db.engines)
+}
+
+//fail records a failed load of key, must hold loadmu
+func (db *DB) fail(key interface{}, err error) {
+	atomic.AddInt64(&db.stats.loadFailures, 1)
+	backoff := db.minBackoff
+	if f, ok := db.failures[key]; ok {
+		backoff = f.backoff * 2
+		if backoff > db.maxBackoff {
+			backoff = db.maxBackoff
+		}
+	}
+	log.Println("load failed", key, err, "retry in", backoff)
+	db.failures[key] = &loadfailure{
+		err:     err,
+		retry:   time.Now().Add(backoff),
+		backoff: backoff,
+	}
+}
+
+//forget drops load state for partid so the next access fetches it again, must hold loadmu
+func (db *DB) forget(partid string) {
+	if call, ok := db.loads[partid]; ok {
+		call.expired = true
+	}
+	delete(db.failures, partid)
+}
+
+//adopt caches a partition handed off by another node, fname is an uncompressed partition file.
+//A copy we already have or are loading wins, the handed off one is dropped.
+func (db *DB) adopt(partid, fname, engine string, mutable bool, lastmod time.Time) error {
+	cp, err := opencachepartition(partid, fname, engine, mutable, lastmod, db.engines)
+	if err != nil {
+		return err
+	}
+	db.loadmu.Lock()
+	defer db.loadmu.Unlock()
+	_, cached, _ := db.cached(partid)
+	if _, loading := db.loads[partid]; cached || loading {
+		cp.close()
+		return nil
+	}
+	delete(db.failures, partid)
+	db.cache.Set(partid, cp)
+	return nil
+}
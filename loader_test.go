@@ -0,0 +1,96 @@
+package infreqdb
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//flakystorage counts Get calls and fails while broken is set
+type flakystorage struct {
+	Storage
+	gets   int32
+	broken int32
+	delay  time.Duration
+}
+
+func (fs *flakystorage) Get(part string) (string, bool, bool, time.Time, error) {
+	atomic.AddInt32(&fs.gets, 1)
+	time.Sleep(fs.delay)
+	if atomic.LoadInt32(&fs.broken) != 0 {
+		return "", false, false, time.Time{}, errors.New("S3 is down")
+	}
+	return fs.Storage.Get(part)
+}
+
+func TestLoadSingleflight(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	fs := &flakystorage{Storage: NewS3Storage(bucket, "/"), delay: 100 * time.Millisecond}
+	db, err := NewWithStorage(fs, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.Get("whatever", []byte("foo"), []byte("bar"))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if fs.gets != 1 {
+		t.Errorf("expected 1 load, got %v", fs.gets)
+	}
+}
+
+func TestLoadBackoff(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	fs := &flakystorage{Storage: NewS3Storage(bucket, "/"), broken: 1}
+	db, err := NewWithStorage(fs, 10, WithLoadBackoff(200*time.Millisecond, time.Second))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		_, err = db.View("whatever", nil)
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	}
+	if fs.gets != 1 {
+		t.Errorf("expected 1 load during backoff, got %v", fs.gets)
+	}
+	//Backoff passes, S3 recovers
+	time.Sleep(250 * time.Millisecond)
+	atomic.StoreInt32(&fs.broken, 0)
+	_, err = db.Get("whatever", []byte("foo"), []byte("bar"))
+	if err != nil {
+		t.Error(err)
+	}
+	if fs.gets != 2 {
+		t.Errorf("expected 2 loads, got %v", fs.gets)
+	}
+	//Expire clears a recorded failure immediately
+	atomic.StoreInt32(&fs.broken, 1)
+	db.Expire("whatever")
+	db.Get("whatever", []byte("foo"), []byte("bar"))
+	atomic.StoreInt32(&fs.broken, 0)
+	db.Expire("whatever")
+	_, err = db.Get("whatever", []byte("foo"), []byte("bar"))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,363 @@
+package infreqdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//ManifestName is the storage object holding the manifest, next to the partitions
+const ManifestName = "_manifest"
+
+//manifestVersion is bumped on incompatible changes to the manifest format
+const manifestVersion = 1
+
+//BucketRange describes a top level bucket of a partition, see ManifestEntry and PartReader
+type BucketRange struct {
+	Name string
+	Keys int
+	//Min and Max are the first and last keys, nil for an empty bucket
+	Min, Max []byte
+}
+
+//ManifestEntry describes a partition in the manifest.
+//Size is of the uncompressed partition file.
+type ManifestEntry struct {
+	PartEntry
+	Buckets []BucketRange
+}
+
+//bucket returns the range of a top level bucket, nil if the partition does not have it
+func (me *ManifestEntry) bucket(name []byte) *BucketRange {
+	for i := range me.Buckets {
+		if me.Buckets[i].Name == string(name) {
+			return &me.Buckets[i]
+		}
+	}
+	return nil
+}
+
+//widen makes the bucket ranges cover the keys put by a delta.
+//Deleted keys are left in, ranges only need to include every key.
+func (me *ManifestEntry) widen(ops []deltaop) {
+	for _, op := range ops {
+		if op.Delete {
+			continue
+		}
+		br := me.bucket(op.Bucket)
+		if br == nil {
+			me.Buckets = append(me.Buckets, BucketRange{Name: string(op.Bucket)})
+			br = &me.Buckets[len(me.Buckets)-1]
+		}
+		br.Keys++
+		if br.Min == nil || bytes.Compare(op.Key, br.Min) < 0 {
+			br.Min = op.Key
+		}
+		if br.Max == nil || bytes.Compare(op.Key, br.Max) > 0 {
+			br.Max = op.Key
+		}
+	}
+}
+
+//overlaps tells if the bucket may have keys in [start, end), nil bounds are open
+func (br *BucketRange) overlaps(start, end []byte) bool {
+	if br.Min == nil {
+		return false
+	}
+	if start != nil && bytes.Compare(br.Max, start) < 0 {
+		return false
+	}
+	return end == nil || bytes.Compare(br.Min, end) < 0
+}
+
+//manifest is the content of the manifest object
+type manifest struct {
+	Version int
+	Parts   map[string]*ManifestEntry
+}
+
+//WithManifest keeps a manifest of all partitions in storage, describing their size,
+//modification time and the key range of every top level bucket. SetPart and DeletePart
+//update it, so every writer should use this option, the infreqdb command does when
+//storage has a manifest. The DB loads it once and uses it to answer ListParts and skip
+//partitions in range scans, CheckExpiry fetches it again. Partitions missing from the
+//manifest are handled as if there was none.
+//Updates are read-modify-write. On storage implementing ConditionalStorage, e.g. S3Storage
+//and FileStorage, they only replace the manifest if nobody else did since it was read
+//and are retried otherwise, so concurrent writers on different nodes don't lose each
+//other's updates. On other storage route writes through one node, CheckExpiry still
+//asks storage so readers are never served partitions the manifest missed.
+func WithManifest() Option {
+	return func(db *DB) {
+		db.usemanifest = true
+	}
+}
+
+//manifestattempts bounds the retries of a manifest update that raced another writer
+const manifestattempts = 10
+
+//readmanifest fetches the manifest, a missing one is empty
+func readmanifest(storage Storage) (*manifest, error) {
+	fname, found, _, _, err := storage.Get(ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	return decodemanifest(fname, found)
+}
+
+//readmanifesttag fetches the manifest with its tag for writemanifest.
+//conditional is false if the storage can't make conditional puts.
+func readmanifesttag(storage Storage) (m *manifest, tag string, conditional bool, err error) {
+	c, err := conditionalof(storage)
+	if err == nil {
+		var fname string
+		var found bool
+		fname, found, _, tag, err = c.GetTag(ManifestName)
+		if errors.Cause(err) != ErrConditionalNotSupported {
+			if err != nil {
+				return nil, "", true, err
+			}
+			m, err = decodemanifest(fname, found)
+			return m, tag, true, err
+		}
+	}
+	m, err = readmanifest(storage)
+	return m, "", false, err
+}
+
+//decodemanifest parses and removes the downloaded manifest, a missing one is empty
+func decodemanifest(fname string, found bool) (*manifest, error) {
+	m := &manifest{Version: manifestVersion, Parts: make(map[string]*ManifestEntry)}
+	if !found {
+		return m, nil
+	}
+	defer os.Remove(fname)
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "manifest")
+	}
+	if m.Version != manifestVersion {
+		return nil, errors.Errorf("manifest version %d not supported", m.Version)
+	}
+	if m.Parts == nil {
+		m.Parts = make(map[string]*ManifestEntry)
+	}
+	return m, nil
+}
+
+//writemanifest replaces the manifest object. With conditional it fails with
+//ErrPreconditionFailed if the manifest no longer has tag.
+func writemanifest(storage Storage, m *manifest, tag string, conditional bool) error {
+	tmpfile, err := ioutil.TempFile("", "infreqdb-manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	err = json.NewEncoder(tmpfile).Encode(m)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if conditional {
+		c, err := conditionalof(storage)
+		if err != nil {
+			return err
+		}
+		return c.PutIf(ManifestName, tmpfile.Name(), true, tag)
+	}
+	return storage.Put(ManifestName, tmpfile.Name(), true)
+}
+
+//buildmanifestentry describes the partition file fname, built by engine
+func buildmanifestentry(partid, fname, engine string, mutable bool, lastmod time.Time, engines []Engine) (*ManifestEntry, error) {
+	r, e, err := openpart(fname, engine, engines)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	me := &ManifestEntry{PartEntry: PartEntry{
+		Partition:    partid,
+		Size:         r.Size(),
+		LastModified: lastmod,
+		Mutable:      mutable,
+		Engine:       e.Name(),
+	}}
+	me.Buckets, err = r.Buckets()
+	return me, err
+}
+
+//putmanifestentry records the partition just stored from fname, built by engine
+func (db *DB) putmanifestentry(partid, fname, engine string, mutable bool) error {
+	//Storage decides the modification time
+	lastmod, _, err := db.storage.Stat(partid)
+	if err != nil {
+		return errors.Wrap(err, "manifest")
+	}
+	me, err := buildmanifestentry(partid, fname, engine, mutable, lastmod, db.engines)
+	if err != nil {
+		return errors.Wrap(err, "manifest")
+	}
+	return errors.Wrap(db.updatemanifest(partid, me), "manifest")
+}
+
+//getmanifest returns the manifest, loading it on first use. Call with manifestmu held.
+func (db *DB) getmanifest() (*manifest, error) {
+	if db.manifest != nil {
+		return db.manifest, nil
+	}
+	m, err := readmanifest(db.storage)
+	if err != nil {
+		return nil, err
+	}
+	db.manifest = m
+	return m, nil
+}
+
+//updatemanifest sets the entry of partid, nil removes it
+func (db *DB) updatemanifest(partid string, me *ManifestEntry) error {
+	return db.editmanifest(func(parts map[string]*ManifestEntry) {
+		if me == nil {
+			delete(parts, partid)
+		} else {
+			parts[partid] = me
+		}
+	})
+}
+
+//editmanifest changes the manifest with fn and stores it.
+//The manifest is fetched again first so updates by other nodes are kept, and fetched
+//again if another node replaced it before we could, so fn may be called more than once.
+func (db *DB) editmanifest(fn func(parts map[string]*ManifestEntry)) error {
+	db.manifestmu.Lock()
+	defer db.manifestmu.Unlock()
+	var err error
+	for i := 0; i < manifestattempts; i++ {
+		var m *manifest
+		var tag string
+		var conditional bool
+		m, tag, conditional, err = readmanifesttag(db.storage)
+		if err != nil {
+			break
+		}
+		fn(m.Parts)
+		err = writemanifest(db.storage, m, tag, conditional)
+		if err == nil {
+			db.manifest = m
+			return nil
+		}
+		if errors.Cause(err) != ErrPreconditionFailed {
+			break
+		}
+	}
+	//Whatever we had may be stale now
+	db.manifest = nil
+	return err
+}
+
+//reloadmanifest makes the next use of the manifest fetch it again
+func (db *DB) reloadmanifest() {
+	db.manifestmu.Lock()
+	db.manifest = nil
+	db.manifestmu.Unlock()
+}
+
+//refreshmanifest fetches the manifest again
+func (db *DB) refreshmanifest() error {
+	m, err := readmanifest(db.storage)
+	if err != nil {
+		return err
+	}
+	db.manifestmu.Lock()
+	db.manifest = m
+	db.manifestmu.Unlock()
+	return nil
+}
+
+//manifestentry returns the manifest entry of partid, nil if unknown or the manifest is unavailable
+func (db *DB) manifestentry(partid string) *ManifestEntry {
+	if !db.usemanifest {
+		return nil
+	}
+	db.manifestmu.Lock()
+	defer db.manifestmu.Unlock()
+	m, err := db.getmanifest()
+	if err != nil {
+		return nil
+	}
+	return m.Parts[partid]
+}
+
+//skipscan tells if a scan of path in [start, end) can't find anything in partid,
+//without loading it. Nested buckets are not in the manifest, only their parent is checked.
+func (db *DB) skipscan(partid string, path [][]byte, start, end []byte) (bool, error) {
+	me := db.manifestentry(partid)
+	if me == nil || len(path) == 0 {
+		return false, nil
+	}
+	br := me.bucket(path[0])
+	if br == nil {
+		return true, &BucketNotFoundError{Path: path, Depth: 0}
+	}
+	if len(path) > 1 {
+		return false, nil
+	}
+	return !br.overlaps(start, end), nil
+}
+
+//ListParts returns partitions whose name starts with prefix, sorted by name.
+//With WithManifest they come from the manifest, Size is then of the uncompressed file.
+//Otherwise the storage must implement Lister.
+func (db *DB) ListParts(prefix string) ([]PartEntry, error) {
+	if !db.usemanifest {
+		l, err := listerof(db.storage)
+		if err != nil {
+			return nil, err
+		}
+		return l.List(prefix)
+	}
+	db.manifestmu.Lock()
+	defer db.manifestmu.Unlock()
+	m, err := db.getmanifest()
+	if err != nil {
+		return nil, errors.Wrap(err, "ListParts")
+	}
+	entries := partentries{}
+	for partid, me := range m.Parts {
+		if strings.HasPrefix(partid, prefix) {
+			entries = append(entries, me.PartEntry)
+		}
+	}
+	sort.Sort(entries)
+	return entries, nil
+}
+
+//ManifestEntry returns what the manifest knows about partid, without loading it.
+//found is false if the partition is not in the manifest.
+func (db *DB) ManifestEntry(partid string) (me ManifestEntry, found bool, err error) {
+	if !db.usemanifest {
+		return me, false, ErrNoManifest
+	}
+	db.manifestmu.Lock()
+	defer db.manifestmu.Unlock()
+	m, err := db.getmanifest()
+	if err != nil {
+		return me, false, err
+	}
+	if e, ok := m.Parts[partid]; ok {
+		return *e, true, nil
+	}
+	return me, false, nil
+}
@@ -0,0 +1,185 @@
+package infreqdb
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//statstorage counts Stat calls
+type statstorage struct {
+	flakystorage
+	stats int32
+}
+
+func (ss *statstorage) Stat(part string) (time.Time, bool, error) {
+	atomic.AddInt32(&ss.stats, 1)
+	return ss.flakystorage.Stat(part)
+}
+
+func TestManifest(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	storage := &statstorage{flakystorage: flakystorage{Storage: NewS3Storage(bucket, "/")}}
+	writer, err := NewWithStorage(storage, 10, WithManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	plain, err := NewWithStorage(storage, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	for _, partid := range []string{"2017-01-01", "2017-01-02", "2017-02-01"} {
+		bld, err := NewBuilder(partid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bld.Put([]byte("a"), []byte("k1"), []byte("v1"))
+		bld.Put([]byte("a"), []byte("k5"), []byte("v5"))
+		err = bld.Commit(writer, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writer.DeletePart("2017-01-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewWithStorage(storage, 10, WithManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	//storage is no Lister, the manifest answers
+	entries, err := reader.ListParts("2017-01")
+	if err != nil || len(entries) != 1 || entries[0].Partition != "2017-01-01" || !entries[0].Mutable {
+		t.Fatalf("unexpected entries %+v %v", entries, err)
+	}
+	me, found, err := reader.ManifestEntry("2017-01-01")
+	if err != nil || !found || len(me.Buckets) != 1 || string(me.Buckets[0].Min) != "k1" || string(me.Buckets[0].Max) != "k5" {
+		t.Errorf("unexpected entry %+v %v %v", me, found, err)
+	}
+	gets := atomic.LoadInt32(&storage.gets)
+	//Outside the key range and missing buckets don't download
+	n := 0
+	err = reader.RangePath("2017-01-01", [][]byte{[]byte("a")}, []byte("k6"), nil, func(k, v []byte) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing, got %v keys %v", n, err)
+	}
+	err = reader.PrefixPath("2017-01-01", [][]byte{[]byte("a")}, []byte("j"), func(k, v []byte) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing, got %v keys %v", n, err)
+	}
+	err = reader.RangePath("2017-01-01", [][]byte{[]byte("b")}, nil, nil, func(k, v []byte) error { return nil })
+	if _, ok := errors.Cause(err).(*BucketNotFoundError); !ok {
+		t.Errorf("expected BucketNotFoundError, got %v", err)
+	}
+	if g := atomic.LoadInt32(&storage.gets); g != gets {
+		t.Errorf("expected no downloads, got %v", g-gets)
+	}
+	err = reader.PrefixPath("2017-01-01", [][]byte{[]byte("a")}, []byte("k"), func(k, v []byte) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Errorf("expected 2 keys, got %v %v", n, err)
+	}
+
+	//S3 timestamps have second granularity
+	time.Sleep(1100 * time.Millisecond)
+	bld, _ := NewBuilder("2017-01-01")
+	bld.Put([]byte("a"), []byte("k9"), []byte("v9"))
+	err = bld.Commit(writer, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := reader.CheckExpiry()
+	if len(report.Expired) != 1 || report.Expired[0] != "2017-01-01" {
+		t.Errorf("expected 2017-01-01 to expire, got %+v", report)
+	}
+	v, err := reader.Get("2017-01-01", []byte("a"), []byte("k9"))
+	if err != nil || string(v) != "v9" {
+		t.Errorf("expected v9, got %s %v", v, err)
+	}
+	//Written behind the manifest's back, still noticed
+	time.Sleep(1100 * time.Millisecond)
+	bld, _ = NewBuilder("2017-01-01")
+	bld.Put([]byte("a"), []byte("k8"), []byte("v8"))
+	err = bld.Commit(plain, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := atomic.LoadInt32(&storage.stats)
+	report = reader.CheckExpiry()
+	if len(report.Expired) != 1 || report.Expired[0] != "2017-01-01" {
+		t.Errorf("expected 2017-01-01 to expire, got %+v", report)
+	}
+	if s := atomic.LoadInt32(&storage.stats); s == stats {
+		t.Error("expected storage to be asked")
+	}
+	v, err = reader.Get("2017-01-01", []byte("a"), []byte("k8"))
+	if err != nil || string(v) != "v8" {
+		t.Errorf("expected v8, got %s %v", v, err)
+	}
+}
+
+func TestManifestConcurrent(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Writers on different nodes, nothing shared but storage
+	var dbs []*DB
+	for i := 0; i < 2; i++ {
+		db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10, WithManifest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		dbs = append(dbs, db)
+	}
+	var wg sync.WaitGroup
+	for i, db := range dbs {
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(db *DB, partid string) {
+				defer wg.Done()
+				err := db.updatemanifest(partid, &ManifestEntry{PartEntry: PartEntry{Partition: partid}})
+				if err != nil {
+					t.Error(err)
+				}
+			}(db, fmt.Sprintf("part-%d-%d", i, j))
+		}
+	}
+	wg.Wait()
+	m, err := readmanifest(dbs[0].storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Parts) != 20 {
+		t.Errorf("expected 20 entries, got %v", len(m.Parts))
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, end := range map[string]string{"": "", "a": "b", "a\xff": "b", "\xff\xff": ""} {
+		if got := string(prefixend([]byte(prefix))); got != end {
+			t.Errorf("prefixend(%q) = %q, expected %q", prefix, got, end)
+		}
+	}
+}
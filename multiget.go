@@ -0,0 +1,131 @@
+package infreqdb
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+//Lookup identifies a single key for GetMulti
+type Lookup struct {
+	Partition string
+	Bucket    []byte
+	Key       []byte
+}
+
+//Result of a single Lookup. Err is what Get would have returned for that key.
+type Result struct {
+	Value []byte
+	Err   error
+}
+
+//partresult carries the results of all lookups in one partition
+type partresult struct {
+	idx     []int
+	results []Result
+}
+
+//GetMulti gets many keys at once. Lookups are grouped by partition, missing
+//partitions are loaded concurrently and each partition is read in a single
+//transaction. Results are in the same order as lookups.
+//In a Cluster, lookups in partitions owned by other nodes are forwarded in one request per partition.
+//The returned error is only set if ctx is done before all partitions were read.
+func (db *DB) GetMulti(ctx context.Context, lookups []Lookup) ([]Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]int)
+	for i, l := range lookups {
+		groups[l.Partition] = append(groups[l.Partition], i)
+	}
+	//Buffered so stragglers can finish after we gave up on ctx
+	ch := make(chan partresult, len(groups))
+	for partid, idx := range groups {
+		go func(partid string, idx []int) {
+			ch <- db.multigetpart(ctx, partid, idx, lookups)
+		}(partid, idx)
+	}
+	results := make([]Result, len(lookups))
+	for range groups {
+		select {
+		case pr := <-ch:
+			for i, j := range pr.idx {
+				results[j] = pr.results[i]
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return results, nil
+}
+
+//multigetpart does the lookups idx which all live in partid
+func (db *DB) multigetpart(ctx context.Context, partid string, idx []int, lookups []Lookup) partresult {
+	pr := partresult{idx: idx, results: make([]Result, len(idx))}
+	//ruled are the keys the bloom filter rules out, they are answered whatever happens to the partition
+	ruled := make([]bool, len(idx))
+	seterr := func(err error) partresult {
+		for i := range pr.results {
+			if !ruled[i] {
+				pr.results[i].Err = err
+			}
+		}
+		return pr
+	}
+	if err := ctx.Err(); err != nil {
+		return seterr(err)
+	}
+	if db.cluster != nil && !db.cluster.IsOwner(partid) {
+		group := make([]Lookup, len(idx))
+		for i, j := range idx {
+			group[i] = lookups[j]
+		}
+		results, err := db.cluster.forward(ctx, partid, group)
+		if err != nil {
+			return seterr(err)
+		}
+		pr.results = results
+		return pr
+	}
+	//Keys the bloom filter rules out don't need the partition
+	remaining := 0
+	for i, j := range idx {
+		if db.ruledout(partid, lookups[j].Bucket, lookups[j].Key) {
+			pr.results[i].Err = errkeynotfound(lookups[j].Bucket, lookups[j].Key)
+			ruled[i] = true
+		} else {
+			remaining++
+		}
+	}
+	if remaining == 0 {
+		return pr
+	}
+	read := func() error {
+		cp, err := db.getpart(partid)
+		if err != nil {
+			return err
+		}
+		return cp.read(func(r PartReader) error {
+			for i, j := range idx {
+				if ruled[i] {
+					continue
+				}
+				v, err := getkey(r, lookups[j].Bucket, lookups[j].Key)
+				if errors.Cause(err) == ErrPartitionChanged {
+					return err
+				}
+				pr.results[i] = Result{Value: v, Err: err}
+			}
+			return nil
+		})
+	}
+	err := read()
+	if db.changed(partid, err) {
+		//Read in ranges and replaced since, once more with the new copy
+		err = read()
+	}
+	if err != nil {
+		return seterr(err)
+	}
+	return pr
+}
@@ -0,0 +1,69 @@
+package infreqdb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetMulti(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := New(bucket, "/foo/", 200)
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	for _, partid := range []string{"p1", "p2"} {
+		bld, err := NewBuilder(partid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bld.Put([]byte("MyBucket"), []byte("answer"), []byte(partid))
+		if err != nil {
+			t.Error(err)
+		}
+		err = bld.Commit(db, true)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	lookups := []Lookup{
+		{"p1", []byte("MyBucket"), []byte("answer")},
+		{"p2", []byte("MyBucket"), []byte("answer")},
+		{"p1", []byte("MyBucket"), []byte("question")},
+		{"p2", []byte("NoBucket"), []byte("answer")},
+		{"nopart", []byte("MyBucket"), []byte("answer")},
+	}
+	results, err := db.GetMulti(context.Background(), lookups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(lookups) {
+		t.Fatalf("expected %v results, got %v", len(lookups), len(results))
+	}
+	if string(results[0].Value) != "p1" || results[0].Err != nil {
+		t.Errorf("expected p1, got %s %v", results[0].Value, results[0].Err)
+	}
+	if string(results[1].Value) != "p2" || results[1].Err != nil {
+		t.Errorf("expected p2, got %s %v", results[1].Value, results[1].Err)
+	}
+	if results[2].Err == nil {
+		t.Error("Expected an error for missing key")
+	}
+	if results[3].Err == nil {
+		t.Error("Expected an error for missing bucket")
+	}
+	//Missing partition behaves like Get
+	if results[4].Value != nil || results[4].Err != nil {
+		t.Errorf("expected nil result for missing partition, got %s %v", results[4].Value, results[4].Err)
+	}
+	//Cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.GetMulti(ctx, lookups)
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,99 @@
+package infreqdb
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+//Partitioner decides which partition holds a key.
+//Keeping this in one place stops callers from duplicating partid logic
+//between the code that writes partitions and the code that reads them.
+type Partitioner interface {
+	//Partition returns the partid for key in bucket
+	Partition(bucket, key []byte) (string, error)
+}
+
+//TimePartitioner groups time keys into partitions, e.g. one per day.
+type TimePartitioner struct {
+	//Layout is the time.Format layout used as partid, e.g. "2006-01-02"
+	Layout string
+	//Location partition boundaries are computed in, defaults to UTC
+	Location *time.Location
+	//Decode extracts the time from a key, defaults to time.Time.UnmarshalBinary
+	Decode func(key []byte) (time.Time, error)
+}
+
+//NewTimePartitioner creates a TimePartitioner for keys made with time.Time.MarshalBinary
+func NewTimePartitioner(layout string) *TimePartitioner {
+	return &TimePartitioner{Layout: layout}
+}
+
+//PartitionTime returns the partid holding t
+func (tp *TimePartitioner) PartitionTime(t time.Time) string {
+	loc := tp.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	return t.In(loc).Format(tp.Layout)
+}
+
+//Partition decodes key into a time and formats it using Layout
+func (tp *TimePartitioner) Partition(bucket, key []byte) (string, error) {
+	var t time.Time
+	var err error
+	if tp.Decode != nil {
+		t, err = tp.Decode(key)
+	} else {
+		err = t.UnmarshalBinary(key)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Key %v is not a time: %v", key, err)
+	}
+	return tp.PartitionTime(t), nil
+}
+
+//HashPartitioner spreads keys evenly over N partitions named Prefix0..PrefixN-1.
+//Only the key is hashed, so the same key lands in the same partition in every bucket.
+type HashPartitioner struct {
+	N      uint32
+	Prefix string
+}
+
+//NewHashPartitioner creates a HashPartitioner with n partitions
+func NewHashPartitioner(prefix string, n uint32) *HashPartitioner {
+	return &HashPartitioner{N: n, Prefix: prefix}
+}
+
+//Partition hashes key with FNV-1a
+func (hp *HashPartitioner) Partition(bucket, key []byte) (string, error) {
+	if hp.N == 0 {
+		return "", fmt.Errorf("HashPartitioner needs at least one partition")
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return fmt.Sprintf("%s%d", hp.Prefix, h.Sum32()%hp.N), nil
+}
+
+//PrefixPartitioner uses the leading part of the key as partid.
+//With Separator set the key is cut at its first occurrence, otherwise after Len bytes.
+type PrefixPartitioner struct {
+	Len       int
+	Separator []byte
+}
+
+//Partition returns the key prefix
+func (pp *PrefixPartitioner) Partition(bucket, key []byte) (string, error) {
+	if len(pp.Separator) > 0 {
+		i := bytes.Index(key, pp.Separator)
+		if i < 0 {
+			return "", fmt.Errorf("Key %s has no separator %q", key, pp.Separator)
+		}
+		return string(key[:i]), nil
+	}
+	if pp.Len <= 0 || len(key) < pp.Len {
+		return "", fmt.Errorf("Key %s is shorter than prefix length %d", key, pp.Len)
+	}
+	return string(key[:pp.Len]), nil
+}
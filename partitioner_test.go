@@ -0,0 +1,70 @@
+package infreqdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimePartitioner(t *testing.T) {
+	tp := NewTimePartitioner("2006-01-02")
+	ts := time.Date(2017, 1, 15, 23, 59, 0, 0, time.UTC)
+	bin, err := ts.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	partid, err := tp.Partition([]byte("bangkok"), bin)
+	if err != nil {
+		t.Error(err)
+	}
+	if partid != "2017-01-15" {
+		t.Errorf("expected 2017-01-15, got %v", partid)
+	}
+	//Not a time
+	_, err = tp.Partition([]byte("bangkok"), []byte("foo"))
+	if err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestHashPartitioner(t *testing.T) {
+	hp := NewHashPartitioner("h", 16)
+	p1, err := hp.Partition([]byte("a"), []byte("answer"))
+	if err != nil {
+		t.Error(err)
+	}
+	//Bucket must not influence the partition
+	p2, err := hp.Partition([]byte("b"), []byte("answer"))
+	if err != nil {
+		t.Error(err)
+	}
+	if p1 != p2 {
+		t.Errorf("same key in different buckets routed to %v and %v", p1, p2)
+	}
+	_, err = (&HashPartitioner{}).Partition(nil, []byte("answer"))
+	if err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestPrefixPartitioner(t *testing.T) {
+	pp := &PrefixPartitioner{Len: 4}
+	partid, err := pp.Partition(nil, []byte("2017-01-15"))
+	if err != nil {
+		t.Error(err)
+	}
+	if partid != "2017" {
+		t.Errorf("expected 2017, got %v", partid)
+	}
+	pp = &PrefixPartitioner{Separator: []byte("/")}
+	partid, err = pp.Partition(nil, []byte("customer42/orders/1"))
+	if err != nil {
+		t.Error(err)
+	}
+	if partid != "customer42" {
+		t.Errorf("expected customer42, got %v", partid)
+	}
+	_, err = pp.Partition(nil, []byte("nocustomer"))
+	if err == nil {
+		t.Error("Expected an error")
+	}
+}
@@ -0,0 +1,102 @@
+package infreqdb
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+//bucketpath walks nested buckets, reporting the first missing element
+func bucketpath(tx *bolt.Tx, path [][]byte) (*bolt.Bucket, error) {
+	if len(path) == 0 {
+		return nil, ErrEmptyPath
+	}
+	b := tx.Bucket(path[0])
+	for i := 1; b != nil && i < len(path); i++ {
+		if b = b.Bucket(path[i]); b == nil {
+			return nil, &BucketNotFoundError{Path: path, Depth: i}
+		}
+	}
+	if b == nil {
+		return nil, &BucketNotFoundError{Path: path, Depth: 0}
+	}
+	return b, nil
+}
+
+//ReadPart is View for partitions of any engine, fn is not called for missing partitions.
+//fn may have seen part of the partition when it changed while read in ranges, so that is not retried.
+//Partitions owned by other nodes of a Cluster are read on their owners and count as mutable.
+func (db *DB) ReadPart(partid string, fn func(PartReader) error) (bool, error) {
+	if db.cluster != nil && !db.cluster.IsOwner(partid) {
+		return true, db.cluster.forwardread(partid, fn)
+	}
+	cp, err := db.getpart(partid)
+	if err != nil {
+		return true, err
+	}
+	err = cp.read(fn)
+	db.changed(partid, err)
+	return cp.mutable, err
+}
+
+//readpart is ReadPart for callers that don't care if the partition is mutable
+func (db *DB) readpart(partid string, fn func(PartReader) error) error {
+	_, err := db.ReadPart(partid, fn)
+	return err
+}
+
+//GetPath gets single key from a nested bucket, e.g. city/metric.
+//A missing bucket is reported as *BucketNotFoundError.
+func (db *DB) GetPath(partid string, bucketPath [][]byte, key []byte) (v []byte, err error) {
+	err = db.readpart(partid, func(r PartReader) error {
+		v, err = r.Get(bucketPath, key)
+		if err == nil && v == nil {
+			return &causeerror{fmt.Sprintf("Key %v not found in bucket %s", key, bytes.Join(bucketPath, []byte("/"))), ErrNotFound}
+		}
+		return err
+	})
+	return
+}
+
+//ForEachPath calls fn for every key in a nested bucket, in key order.
+//v is nil for keys that are buckets themselves.
+//k and v are only valid during the call, copy them to keep them.
+func (db *DB) ForEachPath(partid string, bucketPath [][]byte, fn func(k, v []byte) error) error {
+	return db.readpart(partid, func(r PartReader) error {
+		return r.Iterate(bucketPath, nil, nil, fn)
+	})
+}
+
+//prefixend returns the first key after all keys starting with prefix, nil if there is none
+func prefixend(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+//RangePath calls fn for keys in [start, end) of a nested bucket, in key order.
+//nil start begins at the first key, nil end runs to the last one.
+func (db *DB) RangePath(partid string, bucketPath [][]byte, start, end []byte, fn func(k, v []byte) error) error {
+	if skip, err := db.skipscan(partid, bucketPath, start, end); skip {
+		return err
+	}
+	return db.readpart(partid, func(r PartReader) error {
+		return r.Iterate(bucketPath, start, end, fn)
+	})
+}
+
+//PrefixPath calls fn for keys starting with prefix in a nested bucket, in key order.
+func (db *DB) PrefixPath(partid string, bucketPath [][]byte, prefix []byte, fn func(k, v []byte) error) error {
+	if skip, err := db.skipscan(partid, bucketPath, prefix, prefixend(prefix)); skip {
+		return err
+	}
+	return db.readpart(partid, func(r PartReader) error {
+		return r.Iterate(bucketPath, prefix, prefixend(prefix), fn)
+	})
+}
@@ -0,0 +1,95 @@
+package infreqdb
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPath(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := New(bucket, "/foo/", 200)
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bld.Update(func(tx *bolt.Tx) error {
+		city, e := tx.CreateBucket([]byte("bangkok"))
+		if e != nil {
+			return e
+		}
+		metric, e := city.CreateBucket([]byte("temperature"))
+		if e != nil {
+			return e
+		}
+		for _, k := range []string{"a1", "a2", "b1", "b2", "c1"} {
+			if e = metric.Put([]byte(k), []byte("v"+k)); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Error(err)
+	}
+	path := [][]byte{[]byte("bangkok"), []byte("temperature")}
+	v, err := db.GetPath("nested", path, []byte("b1"))
+	if err != nil {
+		t.Error(err)
+	}
+	if string(v) != "vb1" {
+		t.Errorf("expected vb1, got %s", v)
+	}
+	//Missing element must be reported with its depth
+	_, err = db.GetPath("nested", [][]byte{[]byte("bangkok"), []byte("windspeed")}, []byte("b1"))
+	bnf, ok := err.(*BucketNotFoundError)
+	if !ok {
+		t.Fatalf("expected *BucketNotFoundError, got %v", err)
+	}
+	if bnf.Depth != 1 {
+		t.Errorf("expected depth 1, got %v", bnf.Depth)
+	}
+	_, err = db.GetPath("nested", nil, []byte("b1"))
+	if err != ErrEmptyPath {
+		t.Errorf("expected %v, got %v", ErrEmptyPath, err)
+	}
+	var keys []string
+	collect := func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}
+	err = db.ForEachPath("nested", path, collect)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(keys) != 5 {
+		t.Errorf("expected 5 keys, got %v", keys)
+	}
+	keys = nil
+	err = db.RangePath("nested", path, []byte("a2"), []byte("c1"), collect)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(keys) != 3 || keys[0] != "a2" || keys[2] != "b2" {
+		t.Errorf("expected [a2 b1 b2], got %v", keys)
+	}
+	keys = nil
+	err = db.PrefixPath("nested", path, []byte("b"), collect)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(keys) != 2 || keys[0] != "b1" || keys[1] != "b2" {
+		t.Errorf("expected [b1 b2], got %v", keys)
+	}
+}
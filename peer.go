@@ -0,0 +1,331 @@
+package infreqdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	//PeerPath is where NewPeerHandler expects to be mounted
+	PeerPath = "/infreqdb/parts/"
+	//peer response headers
+	hdrMutable = "X-Infreqdb-Mutable"
+	hdrLastMod = "X-Infreqdb-Last-Modified"
+	hdrEngine  = "X-Infreqdb-Engine"
+)
+
+//PeerStorage lets a group of nodes share downloaded partitions.
+//Every partition has an owner picked by consistent hashing on partid. Get asks the
+//owner for its cached copy and only falls back to the wrapped storage if the owner
+//can't help or we are the owner ourselves. Put and Stat go straight to the wrapped storage.
+//A copy from the owner is only used if it matches the checksum the wrapped storage
+//records, so the wrapped storage must be a MetaStorage for peers to be asked at all.
+type PeerStorage struct {
+	self    string
+	storage Storage
+	client  *http.Client
+	vnodes  int
+	mu      sync.RWMutex
+	ring    *Ring
+	secret  []byte
+}
+
+//NewPeerStorage creates a PeerStorage. self and peers are base urls like http://10.0.0.1:8080,
+//self must be part of peers and every node must use the same list.
+func NewPeerStorage(self string, peers []string, storage Storage) *PeerStorage {
+	ps := &PeerStorage{
+		self:    self,
+		storage: storage,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+		vnodes:  64,
+	}
+	ps.SetPeers(peers)
+	return ps
+}
+
+//SetPeers replaces the cluster membership
+func (ps *PeerStorage) SetPeers(peers []string) {
+	ring := NewRing(peers, ps.vnodes)
+	ps.mu.Lock()
+	ps.ring = ring
+	ps.mu.Unlock()
+}
+
+//SetSecret makes nodes sign requests for partitions with an HMAC with secret,
+//unsigned ones are refused. Every node needs the same secret.
+func (ps *PeerStorage) SetSecret(secret []byte) {
+	ps.mu.Lock()
+	ps.secret = append([]byte(nil), secret...)
+	ps.mu.Unlock()
+}
+
+//getsecret returns the secret, nil if there is none
+func (ps *PeerStorage) getsecret() []byte {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.secret
+}
+
+//Owner returns the base url of the node owning part
+func (ps *PeerStorage) Owner(part string) string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.ring.Owner(part)
+}
+
+//IsOwner tells if this node owns part
+func (ps *PeerStorage) IsOwner(part string) bool {
+	owner := ps.Owner(part)
+	return owner == "" || owner == ps.self
+}
+
+//Get fetches part from its owner, or from the wrapped storage if that fails
+func (ps *PeerStorage) Get(part string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	fname, found, mutable, lastmod, _, err = ps.GetEngine(part)
+	return
+}
+
+//GetEngine is Get also returning the engine the owner opened part with, or the one
+//recorded by the wrapped storage, see EngineStorage
+func (ps *PeerStorage) GetEngine(part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	//Peers only serve cached partitions, not sidecars
+	if _, ok := ps.storage.(MetaStorage); ok && !ps.IsOwner(part) && !issidecar(part) {
+		owner := ps.Owner(part)
+		fname, found, mutable, lastmod, engine, err = ps.getpeer(owner, part)
+		if err == nil {
+			return
+		}
+		log.Println("peer", owner, part, err)
+	}
+	return getengine(ps.storage, part)
+}
+
+//errPeerMiss when a peer does not have the partition cached
+var errPeerMiss = errors.New("Partition not cached by peer")
+
+//getpeer downloads a cached partition from peer, checking it against the checksum in the wrapped storage
+func (ps *PeerStorage) getpeer(peer, part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	meta, found, err := ps.storage.(MetaStorage).Meta(part)
+	if err != nil {
+		return
+	}
+	if !found {
+		//Same as the wrapped storage, no need to bother the owner
+		return "", false, true, time.Unix(2, 2), "", nil
+	}
+	if meta.SHA256 == "" {
+		err = errors.Errorf("no checksum to verify a copy from peer")
+		return
+	}
+	req, err := http.NewRequest("GET", peer+PeerPath+url.QueryEscape(part), nil)
+	if err != nil {
+		return
+	}
+	sign(req, ps.getsecret(), "peer", part)
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		//Including partitions the owner found missing, the wrapped storage just said otherwise
+		err = errPeerMiss
+		return
+	}
+	lastmod, err = time.Parse(time.RFC3339Nano, resp.Header.Get(hdrLastMod))
+	if err != nil {
+		return
+	}
+	tmpfile, err := ioutil.TempFile("", "infreqdb-")
+	if err != nil {
+		return
+	}
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmpfile, sum), resp.Body)
+	tmpfile.Close()
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && hex.EncodeToString(sum.Sum(nil)) != meta.SHA256 {
+		//Stale or tampered with
+		err = errors.Wrapf(ErrCorruptPartition, "sha256 %x, expected %s", sum.Sum(nil), meta.SHA256)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return
+	}
+	engine = meta.Engine
+	if engine == "" {
+		engine = resp.Header.Get(hdrEngine)
+	}
+	return tmpfile.Name(), true, meta.Mutable, lastmod, engine, nil
+}
+
+//Put stores part in the wrapped storage
+func (ps *PeerStorage) Put(part, fname string, mutable bool) error {
+	return ps.storage.Put(part, fname, mutable)
+}
+
+//PutEngine stores part in the wrapped storage, recording engine if it can
+func (ps *PeerStorage) PutEngine(part, fname string, mutable bool, engine string) error {
+	return putengine(ps.storage, part, fname, mutable, engine)
+}
+
+//PutMeta stores part in the wrapped storage, recording as much of meta as it can
+func (ps *PeerStorage) PutMeta(part, fname string, meta PartMeta) error {
+	return putmeta(ps.storage, part, fname, meta)
+}
+
+//Meta asks the wrapped storage, see MetaStorage
+func (ps *PeerStorage) Meta(part string) (PartMeta, bool, error) {
+	ms, err := metaof(ps.storage)
+	if err != nil {
+		return PartMeta{}, false, err
+	}
+	return ms.Meta(part)
+}
+
+//Delete removes part from the wrapped storage
+func (ps *PeerStorage) Delete(part string) error {
+	return ps.storage.Delete(part)
+}
+
+//Stat asks the wrapped storage, peers only serve data
+func (ps *PeerStorage) Stat(part string) (time.Time, bool, error) {
+	return ps.storage.Stat(part)
+}
+
+//List asks the wrapped storage
+func (ps *PeerStorage) List(prefix string) ([]PartEntry, error) {
+	l, err := listerof(ps.storage)
+	if err != nil {
+		return nil, err
+	}
+	return l.List(prefix)
+}
+
+//ListNames asks the wrapped storage
+func (ps *PeerStorage) ListNames(prefix string) ([]string, error) {
+	l, err := namelisterof(ps.storage)
+	if err != nil {
+		return nil, err
+	}
+	return l.ListNames(prefix)
+}
+
+//GetVersion asks the wrapped storage, peers only cache current partitions
+func (ps *PeerStorage) GetVersion(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	v, err := versionerof(ps.storage)
+	if err != nil {
+		return
+	}
+	return v.GetVersion(part, versionID)
+}
+
+//GetVersionEngine asks the wrapped storage, see EngineVersioner
+func (ps *PeerStorage) GetVersionEngine(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	v, err := versionerof(ps.storage)
+	if err != nil {
+		return
+	}
+	return getversionengine(v, part, versionID)
+}
+
+//ListVersions asks the wrapped storage
+func (ps *PeerStorage) ListVersions(part string) ([]PartVersion, error) {
+	v, err := versionerof(ps.storage)
+	if err != nil {
+		return nil, err
+	}
+	return v.ListVersions(part)
+}
+
+//peerhandler serves cached partitions of a DB to its peers
+type peerhandler struct {
+	db *DB
+	ps *PeerStorage
+}
+
+//NewPeerHandler serves partitions cached by db to other nodes, mount it at PeerPath.
+//Partitions this node owns are loaded on demand, others are only served if already cached,
+//so nodes that disagree on membership can't bounce requests between each other.
+//db must be using ps as its storage. Partitions are served as they are cached, decrypted
+//if ps wraps an EncryptedStorage, so without SetSecret anyone reaching the handler can read them.
+func NewPeerHandler(db *DB, ps *PeerStorage) http.Handler {
+	return &peerhandler{db: db, ps: ps}
+}
+
+func (ph *peerhandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	if r.Method != "GET" || !strings.HasPrefix(path, PeerPath) {
+		http.NotFound(w, r)
+		return
+	}
+	partid, err := url.QueryUnescape(strings.TrimPrefix(path, PeerPath))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !verify(r, ph.ps.getsecret(), "peer", partid) {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	cp, ok, err := ph.db.cached(partid)
+	if err == nil && !ok {
+		if !ph.ps.IsOwner(partid) {
+			http.NotFound(w, r)
+			return
+		}
+		cp, err = ph.db.getpart(partid)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if cp.r == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if cp.ranged {
+		//No file to send, the peer falls back to storage
+		http.NotFound(w, r)
+		return
+	}
+	//Whatever the engine, the file is the partition
+	f, err := cp.openfile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mutable := "no"
+	if cp.mutable {
+		mutable = "yes"
+	}
+	w.Header().Set(hdrMutable, mutable)
+	w.Header().Set(hdrLastMod, cp.lastModified.Format(time.RFC3339Nano))
+	w.Header().Set(hdrEngine, cp.engine)
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = io.Copy(w, f)
+	if err != nil {
+		log.Println("peer serve", partid, err)
+	}
+}
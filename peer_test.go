@@ -0,0 +1,124 @@
+package infreqdb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+//metaflaky is a flakystorage passing Meta through
+type metaflaky struct {
+	*flakystorage
+	meta MetaStorage
+}
+
+func (mf *metaflaky) Meta(part string) (PartMeta, bool, error) {
+	return mf.meta.Meta(part)
+}
+
+func (mf *metaflaky) PutMeta(part, fname string, meta PartMeta) error {
+	return mf.meta.PutMeta(part, fname, meta)
+}
+
+func TestPeerStorage(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	s3s := NewS3Storage(bucket, "/")
+	upstream := &metaflaky{flakystorage: &flakystorage{Storage: s3s}, meta: s3s}
+	//Two nodes sharing one upstream
+	var handlers [2]http.Handler
+	var urls []string
+	for i := range handlers {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	var dbs []*DB
+	var pss []*PeerStorage
+	for i := range handlers {
+		ps := NewPeerStorage(urls[i], urls, upstream)
+		ps.SetSecret([]byte("s3cret"))
+		pss = append(pss, ps)
+		db, err := NewWithStorage(ps, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		handlers[i] = NewPeerHandler(db, ps)
+		dbs = append(dbs, db)
+	}
+	//Populate upstream
+	bld, err := NewBuilder("foo/bar+baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("MyBucket"), []byte("answer"), []byte("42"))
+	err = bld.Commit(dbs[0], true)
+	if err != nil {
+		t.Error(err)
+	}
+	//Every node reads, upstream must only be hit once
+	for _, db := range dbs {
+		v, err := db.Get("foo/bar+baz", []byte("MyBucket"), []byte("answer"))
+		if err != nil {
+			t.Error(err)
+		}
+		if string(v) != "42" {
+			t.Errorf("expected 42, got %s", v)
+		}
+	}
+	if upstream.gets != 1 {
+		t.Errorf("expected 1 upstream download, got %v", upstream.gets)
+	}
+	//Unsigned requests are refused
+	resp, err := http.Get(urls[0] + PeerPath + url.QueryEscape("foo/bar+baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %v", resp.Status)
+	}
+	//Missing partitions are answered by the owner too
+	for _, db := range dbs {
+		v, err := db.Get("nopart", []byte("MyBucket"), []byte("answer"))
+		if err != nil || v != nil {
+			t.Errorf("expected nil, got %s %v", v, err)
+		}
+	}
+	if upstream.gets != 2 {
+		t.Errorf("expected 2 upstream downloads, got %v", upstream.gets)
+	}
+	//Both nodes agree on lastmod, so nothing expires
+	for _, db := range dbs {
+		report := db.CheckExpiry()
+		if len(report.Expired) != 0 || len(report.Errored) != 0 {
+			t.Errorf("expected nothing to expire, got %+v", report)
+		}
+	}
+	//A copy not matching the checksum upstream is not used
+	owner := 0
+	if pss[1].IsOwner("foo/bar+baz") {
+		owner = 1
+	}
+	handlers[owner] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrLastMod, time.Now().Format(time.RFC3339Nano))
+		w.Write([]byte("not the partition"))
+	})
+	other := dbs[1-owner]
+	other.Expire("foo/bar+baz")
+	v, err := other.Get("foo/bar+baz", []byte("MyBucket"), []byte("answer"))
+	if err != nil || string(v) != "42" {
+		t.Errorf("expected 42, got %s %v", v, err)
+	}
+	if upstream.gets != 3 {
+		t.Errorf("expected 3 upstream downloads, got %v", upstream.gets)
+	}
+}
@@ -0,0 +1,158 @@
+package infreqdb
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/pkg/errors"
+)
+
+//tableTail is how much of the end of a table is read when opening it in ranges,
+//enough for the index of most tables so opening takes a single request
+const tableTail = 64 << 10
+
+const (
+	//rangeEngines is how many partitions have the engine they were loaded with remembered
+	rangeEngines = 10000
+	//rangeRecheck is how long that is trusted, a partition turned into a table
+	//by another node is read in ranges once it passed
+	rangeRecheck = 10 * time.Minute
+)
+
+//WithRangeReads opens tables in place when the storage is a RangeStorage, instead of
+//downloading them. Opening reads the index at the end of the table, every Get then reads
+//a single block. Bolt partitions, tables with deltas and storages that can't read ranges
+//are downloaded as usual. Partitions loaded recently are known not to be tables and are
+//downloaded right away, other partitions take an extra request to find out, unless the
+//manifest tells, see WithManifest.
+//Blocks are not cached, reads of a partition that changed in storage fail with
+//ErrPartitionChanged and expire it, DB.Get tries once more with the new copy.
+func WithRangeReads() Option {
+	return func(db *DB) {
+		db.rangereads = true
+		db.engineof = gcache.New(rangeEngines).LRU().Build()
+	}
+}
+
+//rangereader reads a partition through a RangeStorage, the tail is kept in memory
+type rangereader struct {
+	rs      RangeStorage
+	part    string
+	lastmod time.Time
+	//tag is the RangeInfo.Tag of the copy the tail came from
+	tag  string
+	tail []byte
+	//tailoff is the offset of tail in the partition
+	tailoff int64
+}
+
+//ReadAt fails with ErrPartitionChanged if the partition is not the one the tail came from,
+//checked by the storage against tag and by us against lastmod
+func (rr *rangereader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= rr.tailoff && off+int64(len(p)) <= rr.tailoff+int64(len(rr.tail)) {
+		return copy(p, rr.tail[off-rr.tailoff:]), nil
+	}
+	b, lastmod, err := rr.rs.ReadRange(rr.part, off, int64(len(p)), rr.tag)
+	if IsNotFound(err) || os.IsNotExist(err) {
+		return 0, errors.Wrap(ErrPartitionChanged, rr.part+" deleted")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !lastmod.Equal(rr.lastmod) {
+		return 0, errors.Wrap(ErrPartitionChanged, rr.part)
+	}
+	n := copy(p, b)
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+//hasengine tells if e opens partitions of db
+func (db *DB) hasengine(e Engine) bool {
+	engines := db.engines
+	if engines == nil {
+		engines = defaultEngines
+	}
+	for _, de := range engines {
+		if de == e {
+			return true
+		}
+	}
+	return false
+}
+
+//openranged opens partid in place if it is a table, nil if it has to be downloaded
+func (db *DB) openranged(partid string) (*cachepartition, error) {
+	rs, ok := db.storage.(RangeStorage)
+	if !ok || !db.hasengine(TableEngine) {
+		return nil, nil
+	}
+	//Saves asking storage
+	if me := db.manifestentry(partid); me != nil {
+		if me.Engine != TableEngine.Name() {
+			return nil, nil
+		}
+	} else if engine, err := db.engineof.GetIFPresent(partid); err == nil && engine != TableEngine.Name() {
+		return nil, nil
+	}
+	st := time.Now()
+	tail, info, found, err := rs.ReadTail(partid, tableTail)
+	if err != nil {
+		return nil, err
+	}
+	if db.usedeltas && (!found || db.hasdelta(partid, deltagen(info.LastModified, true), 1)) {
+		//Deltas are applied to a bolt copy
+		return nil, nil
+	}
+	if !found {
+		//404, same as newcachepartition
+		return &cachepartition{RWMutex: &sync.RWMutex{}, mutable: true, lastModified: time.Unix(2, 2)}, nil
+	}
+	if !info.Ranged || info.Engine != TableEngine.Name() {
+		return nil, nil
+	}
+	rr := &rangereader{rs: rs, part: partid, lastmod: info.LastModified, tag: info.Tag, tail: tail, tailoff: info.Size - int64(len(tail))}
+	t, err := readtable(rr, info.Size)
+	if err != nil {
+		return nil, errors.Wrap(err, partid)
+	}
+	log.Println("loadedranged", partid, time.Since(st))
+	return &cachepartition{
+		RWMutex:      &sync.RWMutex{},
+		r:            t,
+		engine:       TableEngine.Name(),
+		lastModified: info.LastModified,
+		mutable:      info.Mutable,
+		ranged:       true,
+	}, nil
+}
+
+//rememberengine remembers the engine partid is stored with, see openranged
+func (db *DB) rememberengine(partid, engine string) {
+	if db.engineof != nil {
+		db.engineof.SetWithExpire(partid, engine, rangeRecheck)
+	}
+}
+
+//forgetengine drops what rememberengine knows about partid, it changed elsewhere
+func (db *DB) forgetengine(partid string) {
+	if db.engineof != nil {
+		db.engineof.Remove(partid)
+	}
+}
+
+//changed expires partid if err says it changed while read in ranges
+func (db *DB) changed(partid string, err error) bool {
+	if errors.Cause(err) != ErrPartitionChanged {
+		return false
+	}
+	log.Println("changed", partid, err)
+	db.Expire(partid)
+	return true
+}
@@ -0,0 +1,348 @@
+package infreqdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//countingstorage counts full downloads and range reads
+type countingstorage struct {
+	*S3Storage
+	gets, tails, ranges int64
+}
+
+func (cs *countingstorage) Get(part string) (string, bool, bool, time.Time, error) {
+	atomic.AddInt64(&cs.gets, 1)
+	return cs.S3Storage.Get(part)
+}
+
+func (cs *countingstorage) GetEngine(part string) (string, bool, bool, time.Time, string, error) {
+	atomic.AddInt64(&cs.gets, 1)
+	return cs.S3Storage.GetEngine(part)
+}
+
+func (cs *countingstorage) ReadTail(part string, n int64) ([]byte, RangeInfo, bool, error) {
+	atomic.AddInt64(&cs.tails, 1)
+	return cs.S3Storage.ReadTail(part, n)
+}
+
+func (cs *countingstorage) ReadRange(part string, off, length int64, tag string) ([]byte, time.Time, error) {
+	atomic.AddInt64(&cs.ranges, 1)
+	return cs.S3Storage.ReadRange(part, off, length, tag)
+}
+
+//buildrandomtable builds a table too big to be read with its tail, values are prefix and random bytes
+func buildrandomtable(t *testing.T, prefix string) string {
+	rnd := rand.New(rand.NewSource(1))
+	return buildtable(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("b"))
+		for i := 0; err == nil && i < 2000; i++ {
+			v := make([]byte, 100)
+			rnd.Read(v)
+			err = b.Put([]byte(fmt.Sprintf("k%05d", i)), append([]byte(prefix), v...))
+		}
+		return err
+	})
+}
+
+func TestRangeReads(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &countingstorage{S3Storage: NewS3Storage(bucket, "/")}
+	db, err := NewWithStorage(cs, 10, WithRangeReads())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	table := buildrandomtable(t, "old")
+	defer os.Remove(table)
+	fi, err := os.Stat(table)
+	if err != nil || fi.Size() < 2*tableTail {
+		t.Fatalf("expected a big table, got %v", err)
+	}
+	err = db.SetPart("part", table, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get("part", []byte("b"), []byte("k00001"))
+	if err != nil || string(v[:3]) != "old" {
+		t.Fatalf("expected old value, got %q %v", v, err)
+	}
+	if cs.gets != 0 || cs.tails != 1 || cs.ranges != 1 {
+		t.Errorf("expected 1 tail and 1 range read, got %d gets %d tails %d ranges", cs.gets, cs.tails, cs.ranges)
+	}
+	info, err := db.PartInfo("part")
+	if err != nil || !info.Ranged || info.Engine != "table" || info.Size != fi.Size() || info.Buckets[0].Keys != 2000 {
+		t.Errorf("unexpected info %+v %v", info, err)
+	}
+	n := 0
+	err = db.ForEachPath("part", [][]byte{[]byte("b")}, func(k, v []byte) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 2000 {
+		t.Errorf("expected 2000 keys, got %d %v", n, err)
+	}
+
+	//Replaced behind our back, the next Get sees the change and reopens
+	table = buildrandomtable(t, "new")
+	defer os.Remove(table)
+	time.Sleep(1100 * time.Millisecond)
+	err = cs.S3Storage.Put("part", table, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = db.Get("part", []byte("b"), []byte("k00001"))
+	if err != nil || string(v[:3]) != "new" {
+		t.Errorf("expected new value, got %q %v", v, err)
+	}
+	_, err = db.GetPath("part", [][]byte{[]byte("b")}, []byte("k01999"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	//Downloading works as before
+	plain, err := NewWithStorage(cs.S3Storage, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	v, err = plain.Get("part", []byte("b"), []byte("k01999"))
+	if err != nil || string(v[:3]) != "new" {
+		t.Errorf("expected new value, got %q %v", v, err)
+	}
+	info, err = plain.PartInfo("part")
+	if err != nil || info.Ranged {
+		t.Errorf("expected a download, got %+v %v", info, err)
+	}
+}
+
+func TestRangeReadsFallback(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &countingstorage{S3Storage: NewS3Storage(bucket, "/")}
+	db, err := NewWithStorage(cs, 10, WithRangeReads(), WithDeltas(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k"), []byte("v"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := buildrandomtable(t, "tbl")
+	defer os.Remove(table)
+	err = db.SetPart("table", table, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := db.NewDelta("table")
+	d.Put([]byte("b"), []byte("k00000"), []byte("delta"))
+	err = d.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for partid, expected := range map[string]string{"bolt": "v", "table": "delta"} {
+		k := "k"
+		if partid == "table" {
+			k = "k00000"
+		}
+		v, err := db.Get(partid, []byte("b"), []byte(k))
+		if err != nil || string(v) != expected {
+			t.Errorf("%s: expected %s, got %q %v", partid, expected, v, err)
+		}
+		info, err := db.PartInfo(partid)
+		if err != nil || info.Ranged || info.Engine != "bolt" {
+			t.Errorf("%s: expected a bolt download, got %+v %v", partid, info, err)
+		}
+	}
+	if cs.gets == 0 || cs.ranges != 0 {
+		t.Errorf("expected downloads only, got %d gets %d ranges", cs.gets, cs.ranges)
+	}
+	info, err := db.PartInfo("missing")
+	if err != nil || info.Found {
+		t.Errorf("expected not found, got %+v %v", info, err)
+	}
+	//Loaded before, no need to look at the tail again
+	tails := cs.tails
+	db.Expire("bolt")
+	_, err = db.Get("bolt", []byte("b"), []byte("k"))
+	if err != nil || cs.tails != tails {
+		t.Errorf("expected no tail read, got %d more %v", cs.tails-tails, err)
+	}
+
+	//An empty object can't be a table
+	empty, err := ioutil.TempFile("", "infreqdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty.Close()
+	defer os.Remove(empty.Name())
+	err = cs.S3Storage.PutEngine("empty", empty.Name(), false, TableEngine.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Get("empty", []byte("b"), []byte("k"))
+	if errors.Cause(err) != ErrCorruptPartition {
+		t.Errorf("expected ErrCorruptPartition, got %v", err)
+	}
+}
+
+func TestRangeReadsFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewWithStorage(fs, 10, WithRangeReads())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	table := buildrandomtable(t, "old")
+	defer os.Remove(table)
+	err = db.SetPart("part", table, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get("part", []byte("b"), []byte("k00001"))
+	if err != nil || string(v[:3]) != "old" {
+		t.Errorf("expected old value, got %q %v", v, err)
+	}
+	info, err := db.PartInfo("part")
+	if err != nil || !info.Ranged {
+		t.Errorf("expected ranged, got %+v %v", info, err)
+	}
+	//Deleted behind our back
+	err = fs.Delete("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetPath("part", [][]byte{[]byte("b")}, []byte("k00002"))
+	if errors.Cause(err) != ErrPartitionChanged {
+		t.Errorf("expected ErrPartitionChanged, got %v", err)
+	}
+	info, err = db.PartInfo("part")
+	if err != nil || info.Found {
+		t.Errorf("expected not found once expired, got %+v %v", info, err)
+	}
+}
+
+func TestRangeReadsSameSecond(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &countingstorage{S3Storage: NewS3Storage(bucket, "/")}
+	db, err := NewWithStorage(cs, 10, WithRangeReads())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	old := buildrandomtable(t, "old")
+	defer os.Remove(old)
+	err = db.SetPart("part", old, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Get("part", []byte("b"), []byte("k00001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Replaced within the Last-Modified resolution, only the ETag tells
+	table := buildrandomtable(t, "new")
+	defer os.Remove(table)
+	_, lastmod, err := cs.S3Storage.ReadRange("part", 0, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cs.S3Storage.Put("part", table, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, info, _, err := cs.S3Storage.ReadTail("part", 1)
+	if err != nil || !info.LastModified.Equal(lastmod) {
+		t.Skipf("replaced in another second, %v", err)
+	}
+	_, _, err = cs.S3Storage.ReadRange("part", 0, 1, "\"stale\"")
+	if errors.Cause(err) != ErrPartitionChanged {
+		t.Errorf("expected ErrPartitionChanged, got %v", err)
+	}
+	v, err := db.Get("part", []byte("b"), []byte("k00002"))
+	if err != nil || string(v[:3]) != "new" {
+		t.Errorf("expected new value, got %q %v", v, err)
+	}
+}
+
+func TestRangeReadsMulti(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewS3Storage(bucket, "/")
+	db, err := NewWithStorage(storage, 10, WithRangeReads())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	old := buildrandomtable(t, "old")
+	defer os.Remove(old)
+	err = db.SetPart("part", old, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Get("part", []byte("b"), []byte("k00001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := buildrandomtable(t, "new")
+	defer os.Remove(table)
+	err = storage.Put("part", table, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//k00002 needs a block read, which finds the partition replaced
+	done := make(chan []Result, 1)
+	go func() {
+		results, err := db.GetMulti(context.Background(), []Lookup{
+			{"part", []byte("b"), []byte("k00002")},
+			{"part", []byte("b"), []byte("k01999")},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- results
+	}()
+	select {
+	case results := <-done:
+		for _, res := range results {
+			if res.Err != nil || string(res.Value[:3]) != "new" {
+				t.Errorf("expected new value, got %q %v", res.Value, res.Err)
+			}
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("GetMulti hangs")
+	}
+}
@@ -0,0 +1,238 @@
+package infreqdb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//RetryPolicy controls how storage operations are retried.
+//Backoff doubles after every attempt, each delay is jittered between half and full length.
+type RetryPolicy struct {
+	//MaxAttempts including the first one, 1 disables retries
+	MaxAttempts int
+	//BaseDelay is the backoff before the first retry
+	BaseDelay time.Duration
+	//MaxDelay caps the backoff
+	MaxDelay time.Duration
+	//AttemptTimeout bounds a single attempt, 0 means no limit.
+	//Conditional writes timing out once sent are not retried, see ErrAmbiguousWrite.
+	AttemptTimeout time.Duration
+	//Timeout bounds the whole operation including retries, 0 means no limit
+	Timeout time.Duration
+	//Retryable decides if an error is worth another attempt, defaults to IsRetryable
+	Retryable func(error) bool
+}
+
+//DefaultRetryPolicy is used by NewS3Storage
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    4,
+		BaseDelay:      100 * time.Millisecond,
+		MaxDelay:       5 * time.Second,
+		AttemptTimeout: 5 * time.Minute,
+		Timeout:        15 * time.Minute,
+	}
+}
+
+//StorageStats counts storage operations
+type StorageStats struct {
+	//Attempts is the number of requests made, including retries
+	Attempts int64
+	//Retries is the number of attempts that were repeated
+	Retries int64
+	//Timeouts is the number of attempts abandoned after AttemptTimeout
+	Timeouts int64
+	//Failures is the number of operations that failed for good
+	Failures int64
+}
+
+//snapshot reads the counters atomically
+func (s *StorageStats) snapshot() StorageStats {
+	return StorageStats{
+		Attempts: atomic.LoadInt64(&s.Attempts),
+		Retries:  atomic.LoadInt64(&s.Retries),
+		Timeouts: atomic.LoadInt64(&s.Timeouts),
+		Failures: atomic.LoadInt64(&s.Failures),
+	}
+}
+
+//retryable applies the classifier
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+//do runs fn until it succeeds, fails with a permanent error or runs out of attempts or time.
+//fn gets a context that is cancelled when its attempt is abandoned on timeout.
+//Results of attempts abandoned on timeout are handed to discard once they finish,
+//so temp files and the like can be cleaned up. A nil policy makes a single attempt.
+func (p *RetryPolicy) do(op string, stats *StorageStats, fn func(ctx context.Context) (interface{}, error), discard func(interface{})) (interface{}, error) {
+	return p.run(op, stats, false, fn, discard)
+}
+
+//dowrite is do for uploading body with fn, which must read it from the reader it gets.
+//The reader fails once the attempt is abandoned, so a timed out upload can't complete after
+//a retry. Unless the whole body was sent already: then the write may or may not happen.
+//Writing the same again is fine, but a conditional write could fail on its own earlier attempt,
+//so it is not retried and fails with ErrAmbiguousWrite.
+func (p *RetryPolicy) dowrite(op string, stats *StorageStats, conditional bool, body []byte, fn func(r io.Reader) error) error {
+	_, err := p.run(op, stats, conditional, func(ctx context.Context) (interface{}, error) {
+		return nil, fn(&uploadreader{a: ctx.Value(attemptkey{}).(*attempt), r: bytes.NewReader(body)})
+	}, nil)
+	return err
+}
+
+//run is do, conditional writes are not retried after a timeout once they sent their body
+func (p *RetryPolicy) run(op string, stats *StorageStats, conditional bool, fn func(ctx context.Context) (interface{}, error), discard func(interface{})) (interface{}, error) {
+	if p == nil {
+		p = &RetryPolicy{MaxAttempts: 1}
+	}
+	var deadline time.Time
+	if p.Timeout > 0 {
+		deadline = time.Now().Add(p.Timeout)
+	}
+	delay := p.BaseDelay
+	for attempt := 1; ; attempt++ {
+		timeout := p.AttemptTimeout
+		if !deadline.IsZero() && (timeout <= 0 || deadline.Sub(time.Now()) < timeout) {
+			timeout = deadline.Sub(time.Now())
+		}
+		atomic.AddInt64(&stats.Attempts, 1)
+		res, sent, err := runattempt(fn, discard, timeout)
+		if err == nil {
+			return res, nil
+		}
+		if err == ErrAttemptTimeout {
+			atomic.AddInt64(&stats.Timeouts, 1)
+			if conditional && sent {
+				atomic.AddInt64(&stats.Failures, 1)
+				return nil, errors.Wrapf(ErrAmbiguousWrite, "%s timed out after sending it", op)
+			}
+		}
+		if attempt >= p.MaxAttempts || !p.retryable(err) {
+			if !IsNotFound(err) {
+				atomic.AddInt64(&stats.Failures, 1)
+			}
+			return nil, err
+		}
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if !deadline.IsZero() && time.Now().Add(sleep).After(deadline) {
+			atomic.AddInt64(&stats.Failures, 1)
+			return nil, errors.Wrapf(err, "%s gave up after %d attempts", op, attempt)
+		}
+		log.Println("retrying", op, "in", sleep, err)
+		atomic.AddInt64(&stats.Retries, 1)
+		time.Sleep(sleep)
+		delay *= 2
+		if delay > p.MaxDelay && p.MaxDelay > 0 {
+			delay = p.MaxDelay
+		}
+	}
+}
+
+//attemptkey is the context key of the *attempt running
+type attemptkey struct{}
+
+//attempt is shared by a running attempt and runattempt, so abandoning it
+//and uploading its last bytes can't interleave
+type attempt struct {
+	mu        sync.Mutex
+	abandoned bool
+	//sent is set once an upload handed over its whole body
+	sent bool
+}
+
+//abandon stops uploads of the attempt, telling if the body was sent already
+func (a *attempt) abandon() (sent bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.abandoned = true
+	return a.sent
+}
+
+//uploadreader is the body of an upload, failing once its attempt is abandoned
+type uploadreader struct {
+	a *attempt
+	r *bytes.Reader
+}
+
+func (ur *uploadreader) Read(p []byte) (int, error) {
+	ur.a.mu.Lock()
+	defer ur.a.mu.Unlock()
+	if ur.a.abandoned {
+		return 0, ErrAttemptTimeout
+	}
+	n, err := ur.r.Read(p)
+	if ur.r.Len() == 0 {
+		ur.a.sent = true
+	}
+	return n, err
+}
+
+//ctxreader reads r until ctx is done
+type ctxreader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxreader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+//runattempt runs fn, giving up after timeout if it is positive.
+//sent tells if an upload abandoned on timeout had sent its whole body.
+func runattempt(fn func(ctx context.Context) (interface{}, error), discard func(interface{}), timeout time.Duration) (res interface{}, sent bool, err error) {
+	a := &attempt{}
+	ctx := context.WithValue(context.Background(), attemptkey{}, a)
+	if timeout <= 0 {
+		res, err = fn(ctx)
+		return res, false, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		res interface{}
+		err error
+	}
+	ch := make(chan result)
+	abandoned := make(chan struct{})
+	go func() {
+		res, err := fn(ctx)
+		select {
+		case ch <- result{res, err}:
+		case <-abandoned:
+			if err == nil && discard != nil {
+				discard(res)
+			}
+		}
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.res, false, r.err
+	case <-t.C:
+		sent = a.abandon()
+		close(abandoned)
+		//fn may have finished right at the deadline
+		select {
+		case r := <-ch:
+			return r.res, false, r.err
+		default:
+		}
+		return nil, sent, ErrAttemptTimeout
+	}
+}
@@ -0,0 +1,133 @@
+package infreqdb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/pkg/errors"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	var stats StorageStats
+	calls := 0
+	//Fails twice with a 503 then succeeds
+	res, err := p.do("test", &stats, func(ctx context.Context) (interface{}, error) {
+		calls++
+		if calls < 3 {
+			return nil, &s3.Error{StatusCode: 503, Code: "ServiceUnavailable"}
+		}
+		return "ok", nil
+	}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if res != "ok" {
+		t.Errorf("expected ok, got %v", res)
+	}
+	if stats.Attempts != 3 || stats.Retries != 2 || stats.Failures != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	//Permanent errors are not retried
+	stats = StorageStats{}
+	_, err = p.do("test", &stats, func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("Access denied")
+	}, nil)
+	if err == nil {
+		t.Error("Expected an error")
+	}
+	if stats.Attempts != 1 || stats.Failures != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	//Attempt timeout, abandoned result must be discarded
+	p.AttemptTimeout = 20 * time.Millisecond
+	stats = StorageStats{}
+	discarded := make(chan interface{}, 3)
+	_, err = p.do("test", &stats, func(ctx context.Context) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "late", nil
+	}, func(res interface{}) {
+		discarded <- res
+	})
+	if err != ErrAttemptTimeout {
+		t.Errorf("expected %v, got %v", ErrAttemptTimeout, err)
+	}
+	if stats.Timeouts != 3 {
+		t.Errorf("expected 3 timeouts, got %+v", stats)
+	}
+	select {
+	case res := <-discarded:
+		if res != "late" {
+			t.Errorf("expected late, got %v", res)
+		}
+	case <-time.After(time.Second):
+		t.Error("abandoned result was not discarded")
+	}
+	//Abandoned uploads can't send the rest of their body
+	stats = StorageStats{}
+	var uploads int32
+	late := make(chan error, 3)
+	err = p.dowrite("test", &stats, true, []byte("ab"), func(r io.Reader) error {
+		n := atomic.AddInt32(&uploads, 1)
+		buf := make([]byte, 1)
+		if _, err := r.Read(buf); err != nil {
+			return err
+		}
+		if n < 3 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		_, err := ioutil.ReadAll(r)
+		if n < 3 {
+			late <- err
+		}
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if stats.Attempts != 3 || stats.Timeouts != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-late; err != ErrAttemptTimeout {
+			t.Errorf("expected abandoned upload to fail with %v, got %v", ErrAttemptTimeout, err)
+		}
+	}
+	//Sent but no answer in time, only unconditional writes are tried again
+	for _, conditional := range []bool{true, false} {
+		stats = StorageStats{}
+		err = p.dowrite("test", &stats, conditional, []byte("ab"), func(r io.Reader) error {
+			ioutil.ReadAll(r)
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+		if conditional && (errors.Cause(err) != ErrAmbiguousWrite || stats.Attempts != 1) {
+			t.Errorf("expected %v after 1 attempt, got %v %+v", ErrAmbiguousWrite, err, stats)
+		}
+		if !conditional && (err != ErrAttemptTimeout || stats.Attempts != 3) {
+			t.Errorf("expected %v after 3 attempts, got %v %+v", ErrAttemptTimeout, err, stats)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := map[error]bool{
+		nil:                        false,
+		&s3.Error{StatusCode: 500}: true,
+		&s3.Error{StatusCode: 404}: false,
+		&s3.Error{StatusCode: 400, Code: "RequestTimeout"}: true,
+		ErrAttemptTimeout: true,
+		errors.New("read: connection reset by peer"): true,
+		errors.New("Access denied"):                  false,
+	}
+	for err, expected := range cases {
+		if IsRetryable(err) != expected {
+			t.Errorf("IsRetryable(%v) expected %v", err, expected)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package infreqdb
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+//Ring maps partitions to nodes using consistent hashing with virtual nodes.
+//Adding or removing a node only moves the partitions next to its points on the ring.
+//A Ring is immutable, build a new one when membership changes.
+type Ring struct {
+	points ringpoints
+	nodes  []string
+}
+
+//ringpoint is one virtual node
+type ringpoint struct {
+	hash uint32
+	node string
+}
+
+//ringpoints sorts by hash, ties broken by node so every member builds the same ring
+type ringpoints []ringpoint
+
+func (rp ringpoints) Len() int      { return len(rp) }
+func (rp ringpoints) Swap(i, j int) { rp[i], rp[j] = rp[j], rp[i] }
+func (rp ringpoints) Less(i, j int) bool {
+	if rp[i].hash == rp[j].hash {
+		return rp[i].node < rp[j].node
+	}
+	return rp[i].hash < rp[j].hash
+}
+
+//ringhash places a string on the ring
+func ringhash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+//NewRing creates a ring with vnodes points per node, nodes listed twice count once
+func NewRing(nodes []string, vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	r := &Ring{}
+	for _, node := range nodes {
+		if !contains(r.nodes, node) {
+			r.nodes = append(r.nodes, node)
+		}
+	}
+	sort.Strings(r.nodes)
+	for _, node := range r.nodes {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringpoint{ringhash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Sort(r.points)
+	return r
+}
+
+//Nodes returns the members of the ring, sorted
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+//Owner returns the node owning partid, empty if the ring has no nodes
+func (r *Ring) Owner(partid string) string {
+	owners := r.Owners(partid, 1)
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+//Owners returns the n distinct nodes holding replicas of partid, primary first.
+//Walks the ring clockwise from partid, skipping nodes already picked.
+func (r *Ring) Owners(partid string, n int) []string {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n < 1 {
+		return nil
+	}
+	h := ringhash(partid)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	owners := make([]string, 0, n)
+	//One turn of the ring visits every node
+	for j := 0; len(owners) < n && j < len(r.points); j++ {
+		node := r.points[(i+j)%len(r.points)].node
+		if !contains(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+//contains tells if s is in list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package infreqdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d"}
+	r := NewRing(nodes, 64)
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 4000; i++ {
+		partid := fmt.Sprintf("part-%d", i)
+		owners[partid] = r.Owner(partid)
+		counts[owners[partid]]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 500 {
+			t.Errorf("node %v owns only %v of 4000 partitions", node, counts[node])
+		}
+	}
+	//Same membership in a different order builds the same ring
+	r2 := NewRing([]string{"d", "c", "b", "a"}, 64)
+	//Removing a node only moves its own partitions
+	r3 := NewRing([]string{"a", "b", "c"}, 64)
+	for partid, owner := range owners {
+		if r2.Owner(partid) != owner {
+			t.Errorf("%v moved from %v to %v", partid, owner, r2.Owner(partid))
+		}
+		if owner != "d" && r3.Owner(partid) != owner {
+			t.Errorf("%v moved from %v to %v", partid, owner, r3.Owner(partid))
+		}
+	}
+	if NewRing(nil, 64).Owner("foo") != "" {
+		t.Error("empty ring must not have owners")
+	}
+}
+
+func TestRingOwners(t *testing.T) {
+	r := NewRing([]string{"a", "b", "c"}, 64)
+	for i := 0; i < 100; i++ {
+		partid := fmt.Sprintf("part-%d", i)
+		owners := r.Owners(partid, 2)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			t.Fatalf("expected 2 distinct owners, got %v", owners)
+		}
+		if owners[0] != r.Owner(partid) {
+			t.Errorf("primary %v is not the owner %v", owners[0], r.Owner(partid))
+		}
+	}
+	if owners := r.Owners("foo", 5); len(owners) != 3 {
+		t.Errorf("expected every node, got %v", owners)
+	}
+}
+
+func TestRingDuplicateNodes(t *testing.T) {
+	r := NewRing([]string{"a", "b", "a"}, 64)
+	if nodes := r.Nodes(); len(nodes) != 2 {
+		t.Errorf("expected 2 nodes, got %v", nodes)
+	}
+	plain := NewRing([]string{"a", "b"}, 64)
+	for i := 0; i < 100; i++ {
+		partid := fmt.Sprintf("part-%d", i)
+		//Used to walk the ring forever looking for a third node
+		owners := r.Owners(partid, 3)
+		if len(owners) != 2 || owners[0] != plain.Owner(partid) {
+			t.Fatalf("expected the owners of %v, got %v", plain.Owners(partid, 2), owners)
+		}
+	}
+}
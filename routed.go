@@ -0,0 +1,134 @@
+package infreqdb
+
+import (
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//RoutedDB wraps DB and computes the partition of each key using a Partitioner.
+type RoutedDB struct {
+	db   *DB
+	part Partitioner
+}
+
+//NewRoutedDB creates a RoutedDB on top of db
+func NewRoutedDB(db *DB, part Partitioner) *RoutedDB {
+	return &RoutedDB{db: db, part: part}
+}
+
+//DB returns the underlying DB
+func (rdb *RoutedDB) DB() *DB {
+	return rdb.db
+}
+
+//Partition returns the partid holding key
+func (rdb *RoutedDB) Partition(bucket, key []byte) (string, error) {
+	return rdb.part.Partition(bucket, key)
+}
+
+//Get gets single key from the partition the key routes to
+func (rdb *RoutedDB) Get(bucket, key []byte) ([]byte, error) {
+	partid, err := rdb.part.Partition(bucket, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get")
+	}
+	return rdb.db.Get(partid, bucket, key)
+}
+
+//NewBatch starts collecting writes, see Batch
+func (rdb *RoutedDB) NewBatch(mutable bool) *Batch {
+	return &Batch{
+		rdb:     rdb,
+		mutable: mutable,
+		puts:    make(map[string][]deltaop),
+	}
+}
+
+//Batch collects Puts, grouped by partition, and merges them into their partitions on Commit.
+//Keys of a touched partition that are not in the batch are kept. Each partition is
+//downloaded, changed and uploaded again, so have a single writer per partition,
+//concurrent commits can overwrite each other's changes.
+type Batch struct {
+	rdb     *RoutedDB
+	mutable bool
+	puts    map[string][]deltaop
+}
+
+//Put stages value for key in the partition the key routes to.
+//The caller must not modify bucket, key or value afterwards.
+func (b *Batch) Put(bucket, key, value []byte) error {
+	partid, err := b.rdb.part.Partition(bucket, key)
+	if err != nil {
+		return errors.Wrap(err, "Put")
+	}
+	b.puts[partid] = append(b.puts[partid], deltaop{Bucket: bucket, Key: key, Value: value})
+	return nil
+}
+
+//Partitions returns the partids touched by the batch
+func (b *Batch) Partitions() []string {
+	parts := make([]string, 0, len(b.puts))
+	for partid := range b.puts {
+		parts = append(parts, partid)
+	}
+	return parts
+}
+
+//Commit merges the staged puts into every touched partition and uploads them with
+//SetPart, recording BoltEngine. Partitions of other engines are rebuilt as bolt files.
+//It stops at the first failure, puts of partitions not yet uploaded are discarded.
+func (b *Batch) Commit() error {
+	var err error
+	for partid, puts := range b.puts {
+		delete(b.puts, partid)
+		if err == nil {
+			err = errors.Wrap(b.merge(partid, puts), partid)
+		}
+	}
+	return err
+}
+
+//merge downloads partid with its deltas applied, applies puts and uploads it
+func (b *Batch) merge(partid string, puts []deltaop) error {
+	db := b.rdb.db
+	m, err := db.materialize(partid)
+	if err != nil {
+		return err
+	}
+	var fname, engine string
+	if m != nil {
+		fname, engine = m.fname, m.engine
+	}
+	bdb, fname, err := db.openforupdate(fname, engine)
+	if fname != "" {
+		defer os.Remove(fname)
+	}
+	if err != nil {
+		return err
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for i := range puts {
+			err := puts[i].apply(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if cerr := bdb.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return db.setpart(partid, fname, b.mutable, BoltEngine.Name())
+}
+
+//Discard drops all staged writes
+func (b *Batch) Discard() {
+	for partid := range b.puts {
+		delete(b.puts, partid)
+	}
+}
@@ -0,0 +1,76 @@
+package infreqdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoutedDB(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := New(bucket, "/foo/", 200)
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	tp := NewTimePartitioner("2006-01-02")
+	rdb := NewRoutedDB(db, tp)
+	day1 := time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	k1, _ := day1.MarshalBinary()
+	k2, _ := day2.MarshalBinary()
+	batch := rdb.NewBatch(true)
+	err = batch.Put([]byte("bangkok"), k1, []byte("31"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = batch.Put([]byte("bangkok"), k2, []byte("32"))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(batch.Partitions()) != 2 {
+		t.Errorf("expected 2 partitions, got %v", batch.Partitions())
+	}
+	err = batch.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+	v, err := rdb.Get([]byte("bangkok"), k2)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(v) != "32" {
+		t.Errorf("expected 32, got %s", v)
+	}
+	//Key must have landed in its own day partition
+	v, err = db.Get("2017-01-01", []byte("bangkok"), k1)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(v) != "31" {
+		t.Errorf("expected 31, got %s", v)
+	}
+	//Unroutable key
+	_, err = rdb.Get([]byte("bangkok"), []byte("foo"))
+	if err == nil {
+		t.Error("Expected an error")
+	}
+	//A later batch merges into the partition, keys it does not touch survive
+	k3, _ := day1.Add(time.Hour).MarshalBinary()
+	batch = rdb.NewBatch(true)
+	err = batch.Put([]byte("bangkok"), k3, []byte("33"))
+	if err == nil {
+		err = batch.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, expected := range map[string]string{string(k1): "31", string(k3): "33"} {
+		v, err = rdb.Get([]byte("bangkok"), []byte(k))
+		if err != nil || string(v) != expected {
+			t.Errorf("expected %s, got %s %v", expected, v, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package infreqdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//Snapshot gives reads spanning several partitions a consistent view. Every partition is
+//pinned as it is first read, later reads through the Snapshot use the same copy even if
+//the partition changes or is evicted meanwhile. Pinned copies stay on disk until Release,
+//so keep snapshots short lived. Partitions read in ranges, see WithRangeReads, are downloaded
+//to be pinned.
+//Partitions owned by other nodes of a Cluster can't be pinned and return NotOwnerError.
+type Snapshot struct {
+	db *DB
+	//mu guards parts, nil once released
+	mu    sync.Mutex
+	parts map[string]*cachepartition
+}
+
+//Snapshot starts a snapshot, Release it when done
+func (db *DB) Snapshot() *Snapshot {
+	return &Snapshot{db: db, parts: make(map[string]*cachepartition)}
+}
+
+//partition returns the pinned copy of partid, pinning the current one on first use
+func (s *Snapshot) partition(partid string) (*cachepartition, error) {
+	s.mu.Lock()
+	cp, ok := s.parts[partid]
+	released := s.parts == nil
+	s.mu.Unlock()
+	if released {
+		return nil, ErrSnapshotReleased
+	}
+	if ok {
+		return cp, nil
+	}
+	for {
+		var err error
+		cp, err = s.db.getpart(partid)
+		if err != nil {
+			return nil, err
+		}
+		if cp.retain() {
+			break
+		}
+		//Evicted before we got hold of it, the cache has a fresher copy by now
+	}
+	if cp.ranged {
+		//Reads in place would see the partition change, pin a private copy instead
+		cp.release()
+		var err error
+		cp, err = s.db.download(partid)
+		if err != nil {
+			return nil, err
+		}
+		//Nobody else holds it, it goes away on release
+		cp.refs, cp.evicted = 1, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.parts == nil {
+		cp.release()
+		return nil, ErrSnapshotReleased
+	}
+	if first, ok := s.parts[partid]; ok {
+		//A concurrent read pinned it first
+		cp.release()
+		return first, nil
+	}
+	s.parts[partid] = cp
+	return cp, nil
+}
+
+//Get gets single key from the pinned partition.
+//Bloom filters are not consulted, they may describe a newer copy.
+func (s *Snapshot) Get(partid string, bucket, key []byte) ([]byte, error) {
+	cp, err := s.partition(partid)
+	if err != nil {
+		return nil, err
+	}
+	return cp.get(bucket, key)
+}
+
+//View is DB.View on the pinned partition
+func (s *Snapshot) View(partid string, fn func(*bolt.Tx) error) (bool, error) {
+	cp, err := s.partition(partid)
+	if _, ok := err.(*NotOwnerError); ok || err == ErrInvalidObject || err == ErrSnapshotReleased {
+		return false, err
+	}
+	if err != nil {
+		if IsNotFound(err) {
+			return true, nil
+		}
+		return true, errors.Wrap(err, "View")
+	}
+	return cp.mutable, cp.view(fn)
+}
+
+//Pinned returns the last modification time of every partition pinned so far
+func (s *Snapshot) Pinned() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pinned := make(map[string]time.Time, len(s.parts))
+	for partid, cp := range s.parts {
+		pinned[partid] = cp.lastModified
+	}
+	return pinned
+}
+
+//Release lets go of the pinned partitions, copies evicted meanwhile are deleted.
+//The Snapshot can't be used afterwards, releasing it again is a no-op.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	parts := s.parts
+	s.parts = nil
+	s.mu.Unlock()
+	for _, cp := range parts {
+		cp.release()
+	}
+}
@@ -0,0 +1,160 @@
+package infreqdb
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	write := func(partid, v string) {
+		bld, err := NewBuilder(partid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bld.Put([]byte("b"), []byte("k"), []byte(v))
+		err = bld.Commit(db, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", "1")
+	write("b", "1")
+	snap := db.Snapshot()
+	v, err := snap.Get("a", []byte("b"), []byte("k"))
+	if err != nil || string(v) != "1" {
+		t.Fatalf("expected 1, got %s %v", v, err)
+	}
+	write("a", "2")
+	write("b", "2")
+	//a stays as first read, b is pinned now
+	for partid, expected := range map[string]string{"a": "1", "b": "2"} {
+		v, err = snap.Get(partid, []byte("b"), []byte("k"))
+		if err != nil || string(v) != expected {
+			t.Errorf("%s: expected %s, got %s %v", partid, expected, v, err)
+		}
+	}
+	v, err = db.Get("a", []byte("b"), []byte("k"))
+	if err != nil || string(v) != "2" {
+		t.Errorf("expected 2 outside the snapshot, got %s %v", v, err)
+	}
+	if pinned := snap.Pinned(); len(pinned) != 2 {
+		t.Errorf("expected 2 pinned partitions, got %v", pinned)
+	}
+	old := snap.parts["a"].fname
+	if _, err = os.Stat(old); err != nil {
+		t.Errorf("pinned copy must be kept: %v", err)
+	}
+	snap.Release()
+	if _, err = os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("evicted copy must be deleted on release: %v", err)
+	}
+	_, err = snap.Get("a", []byte("b"), []byte("k"))
+	if err != ErrSnapshotReleased {
+		t.Errorf("expected ErrSnapshotReleased, got %v", err)
+	}
+	snap.Release()
+	//b is still cached, release must not close it
+	v, err = db.Get("b", []byte("b"), []byte("k"))
+	if err != nil || string(v) != "2" {
+		t.Errorf("expected 2, got %s %v", v, err)
+	}
+}
+
+func TestSnapshotConcurrent(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k"), []byte("v"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				snap := db.Snapshot()
+				v, err := snap.Get("a", []byte("b"), []byte("k"))
+				if err != nil || string(v) != "v" {
+					t.Errorf("expected v, got %s %v", v, err)
+				}
+				db.Expire("a")
+				snap.Release()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSnapshotRanged(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewS3Storage(bucket, "/")
+	db, err := NewWithStorage(storage, 10, WithRangeReads())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	old := buildrandomtable(t, "old")
+	defer os.Remove(old)
+	err = db.SetPart("part", old, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := db.Snapshot()
+	v, err := snap.Get("part", []byte("b"), []byte("k00001"))
+	if err != nil || string(v[:3]) != "old" {
+		t.Fatalf("expected old value, got %q %v", v, err)
+	}
+	pinned := snap.parts["part"]
+	if pinned.ranged || pinned.fname == "" {
+		t.Errorf("expected a downloaded copy, got %+v", pinned)
+	}
+	table := buildrandomtable(t, "new")
+	defer os.Remove(table)
+	err = storage.Put("part", table, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Blocks not read yet still come from the pinned copy
+	v, err = snap.Get("part", []byte("b"), []byte("k01000"))
+	if err != nil || string(v[:3]) != "old" {
+		t.Errorf("expected old value, got %q %v", v, err)
+	}
+	v, err = db.Get("part", []byte("b"), []byte("k01000"))
+	if err != nil || string(v[:3]) != "new" {
+		t.Errorf("expected new value outside the snapshot, got %q %v", v, err)
+	}
+	info, err := db.PartInfo("part")
+	if err != nil || !info.Ranged {
+		t.Errorf("expected the cache to read in ranges, got %+v %v", info, err)
+	}
+	snap.Release()
+	if _, err = os.Stat(pinned.fname); !os.IsNotExist(err) {
+		t.Errorf("private copy must be deleted on release: %v", err)
+	}
+}
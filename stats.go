@@ -0,0 +1,104 @@
+package infreqdb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//Stats describes the cache of a DB, see DB.Stats
+type Stats struct {
+	//Cached is the number of partitions on disk, Capacity the most it will hold
+	Cached   int
+	Capacity int
+	//Hits and Misses count partition lookups served from and missing the cache
+	Hits   int64
+	Misses int64
+	//Loads is the number of partitions fetched from storage, LoadFailures how many of them failed
+	Loads        int64
+	LoadFailures int64
+	//Expired is the number of times a partition was evicted by Expire
+	Expired int64
+	//BloomSkips is the number of lookups answered by a bloom filter without a download
+	BloomSkips int64
+	//Storage holds the request counters of storages that keep them, like S3Storage
+	Storage *StorageStats `json:",omitempty"`
+}
+
+//dbstats are the counters behind Stats, updated atomically
+type dbstats struct {
+	hits, misses, loads, loadFailures, expired, bloomSkips int64
+}
+
+//statser is implemented by storages counting their requests
+type statser interface {
+	Stats() StorageStats
+}
+
+//Stats returns cache counters
+func (db *DB) Stats() Stats {
+	st := Stats{
+		Cached:       len(db.cache.Keys()),
+		Capacity:     db.size,
+		Hits:         atomic.LoadInt64(&db.stats.hits),
+		Misses:       atomic.LoadInt64(&db.stats.misses),
+		Loads:        atomic.LoadInt64(&db.stats.loads),
+		LoadFailures: atomic.LoadInt64(&db.stats.loadFailures),
+		Expired:      atomic.LoadInt64(&db.stats.expired),
+		BloomSkips:   atomic.LoadInt64(&db.stats.bloomSkips),
+	}
+	if s, ok := db.storage.(statser); ok {
+		ss := s.Stats()
+		st.Storage = &ss
+	}
+	return st
+}
+
+//PartInfo describes a partition, see DB.PartInfo
+type PartInfo struct {
+	Partition string
+	//Found is false if the partition does not exist in storage
+	Found        bool
+	Mutable      bool
+	LastModified time.Time
+	//Engine is the name of the engine that opened the partition, see WithEngines
+	Engine string
+	//Ranged partitions are read from storage in place, see WithRangeReads
+	Ranged bool
+	//Size of the uncompressed partition file in bytes
+	Size    int64
+	Buckets []BucketInfo
+}
+
+//BucketInfo describes a top level bucket of a partition
+type BucketInfo struct {
+	Name string
+	Keys int
+}
+
+//PartInfo returns metadata of a partition, loading it if needed
+func (db *DB) PartInfo(partid string) (*PartInfo, error) {
+	cp, err := db.getpart(partid)
+	if err != nil {
+		return nil, err
+	}
+	info := &PartInfo{
+		Partition:    partid,
+		Found:        cp.r != nil,
+		Engine:       cp.engine,
+		Ranged:       cp.ranged,
+		Mutable:      cp.mutable,
+		LastModified: cp.lastModified,
+	}
+	err = cp.read(func(r PartReader) error {
+		info.Size = r.Size()
+		buckets, err := r.Buckets()
+		for _, br := range buckets {
+			info.Buckets = append(info.Buckets, BucketInfo{Name: br.Name, Keys: br.Keys})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,60 @@
+package infreqdb
+
+import (
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("a"), []byte("k1"), []byte("v1"))
+	bld.Put([]byte("a"), []byte("k2"), []byte("v2"))
+	bld.Put([]byte("b"), []byte("k1"), []byte("v1"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.PartInfo("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Found || !info.Mutable || info.Size == 0 || len(info.Buckets) != 2 {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if info.Buckets[0].Name != "a" || info.Buckets[0].Keys != 2 {
+		t.Errorf("unexpected bucket %+v", info.Buckets[0])
+	}
+	db.Get("part", []byte("a"), []byte("k1"))
+	info, err = db.PartInfo("nopart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Found {
+		t.Error("nopart must not be found")
+	}
+	st := db.Stats()
+	if st.Cached != 2 || st.Capacity != 10 {
+		t.Errorf("expected 2 of 10 cached, got %+v", st)
+	}
+	if st.Hits != 1 || st.Misses != 2 || st.Loads != 2 || st.LoadFailures != 0 {
+		t.Errorf("unexpected counters %+v", st)
+	}
+	//Commit expired the partition
+	if st.Expired != 1 {
+		t.Errorf("expected 1 expiry, got %v", st.Expired)
+	}
+	if st.Storage == nil || st.Storage.Attempts == 0 {
+		t.Errorf("expected storage counters, got %+v", st.Storage)
+	}
+}
@@ -2,40 +2,309 @@ package infreqdb
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/goamz/goamz/s3"
+	"github.com/pkg/errors"
 )
 
 //Storage allows various operations against an object store.
 //Use any object/file store.
 //The Storage is responsible for [un]compression.
-//This might be a good place to hook in some sort of upstream cache layer.
+//This might be a good place to hook in some sort of upstream cache layer, see TieredStorage.
 type Storage interface {
 	//Get retrieves a partition file from object store
 	Get(part string) (fname string, found, mutable bool, lastmod time.Time, err error)
 	//Put stores partition into object store
 	Put(part, fname string, mutable bool) error
-	//GetLastMod gets the last modified time for a partition.
-	GetLastMod(part string) time.Time
+	//Delete removes partition from object store, deleting a missing partition is not an error
+	Delete(part string) error
+	//Stat gets the last modified time for a partition.
+	//found is false if the partition does not exist, err is only for failures.
+	Stat(part string) (lastmod time.Time, found bool, err error)
+}
+
+//PartEntry describes a stored partition, see Lister
+type PartEntry struct {
+	Partition string
+	//Size in bytes as stored, e.g. compressed or encrypted
+	Size         int64
+	LastModified time.Time
+	Mutable      bool
+	//Engine names the engine of the partition file, see Engine.Name. Empty if not recorded.
+	Engine string
+}
+
+//Lister is implemented by storages that can enumerate their partitions
+type Lister interface {
+	//List returns partitions whose name starts with prefix, sorted by name, without sidecars
+	List(prefix string) ([]PartEntry, error)
+}
+
+//NameLister is implemented by storages that can list the names of their objects,
+//sidecars included, without a request per object. Deltas are found with it, see WithDeltas.
+type NameLister interface {
+	//ListNames returns the objects whose name starts with prefix, sorted
+	ListNames(prefix string) ([]string, error)
+}
+
+//PartVersion describes a stored version of a partition, see Versioner
+type PartVersion struct {
+	VersionID    string
+	LastModified time.Time
+	//Size in bytes as stored
+	Size int64
+	//Latest is the version Get returns
+	Latest bool
+	//DeleteMarker is true if the partition was deleted at LastModified, there is no data to get
+	DeleteMarker bool
+}
+
+//Versioner is implemented by storages that keep older versions of partitions,
+//e.g. S3Storage on a bucket with versioning enabled
+type Versioner interface {
+	//GetVersion retrieves a specific version of a partition, like Get
+	GetVersion(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, err error)
+	//ListVersions returns the versions of a partition, newest first
+	ListVersions(part string) ([]PartVersion, error)
+}
+
+//EngineVersioner is implemented by Versioners that record the engine of every version, see EngineStorage
+type EngineVersioner interface {
+	//GetVersionEngine is GetVersion also returning the recorded engine name, "" if there is none
+	GetVersionEngine(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error)
+}
+
+//getversionengine is GetVersion also returning the recorded engine if v has one
+func getversionengine(v Versioner, part, versionID string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	if ev, ok := v.(EngineVersioner); ok {
+		return ev.GetVersionEngine(part, versionID)
+	}
+	fname, found, mutable, lastmod, err = v.GetVersion(part, versionID)
+	return
+}
+
+//versionerof returns storage as a Versioner, or ErrVersionsNotSupported
+func versionerof(storage Storage) (Versioner, error) {
+	v, ok := storage.(Versioner)
+	if !ok {
+		return nil, ErrVersionsNotSupported
+	}
+	return v, nil
+}
+
+//RangeInfo describes a partition read in ranges, see RangeStorage
+type RangeInfo struct {
+	//Size in bytes as stored
+	Size         int64
+	LastModified time.Time
+	Mutable      bool
+	//Engine as in PartEntry
+	Engine string
+	//Ranged is false if the partition is stored in a way ranges can't be read from, e.g. compressed as a whole
+	Ranged bool
+	//Tag identifies the copy read, e.g. its S3 ETag, ReadRange takes it to read from the same copy
+	Tag string
+}
+
+//RangeStorage is implemented by storages that can read byte ranges of a partition without
+//downloading all of it, see WithRangeReads
+type RangeStorage interface {
+	//ReadTail reads up to n bytes from the end of part. found is false if part does not exist.
+	//tail is nil unless info.Ranged.
+	ReadTail(part string, n int64) (tail []byte, info RangeInfo, found bool, err error)
+	//ReadRange reads length bytes of part starting at off, fewer at its end.
+	//Unless tag is "", reading a copy whose RangeInfo.Tag is not tag fails with ErrPartitionChanged.
+	//lastmod tells which copy of the partition was read, a missing part fails with an error
+	//IsNotFound or os.IsNotExist recognizes.
+	ReadRange(part string, off, length int64, tag string) (b []byte, lastmod time.Time, err error)
+}
+
+//ConditionalStorage is implemented by storages that can replace an object only if nobody
+//else replaced it since it was read, so read-modify-write updates like those of the
+//manifest don't lose concurrent updates. Tags are opaque, e.g. an S3 ETag.
+type ConditionalStorage interface {
+	//GetTag is Get also returning the tag of the object, "" if it does not exist
+	GetTag(part string) (fname string, found, mutable bool, tag string, err error)
+	//PutIf is Put failing with ErrPreconditionFailed unless the object still has tag,
+	//"" meaning it must not exist
+	PutIf(part, fname string, mutable bool, tag string) error
+}
+
+//issidecar tells if a storage object is a sidecar, e.g. a bloom filter, delta or the manifest, rather than a partition
+func issidecar(part string) bool {
+	return strings.HasSuffix(part, BloomSuffix) || part == ManifestName || isdelta(part)
+}
+
+//EngineStorage is implemented by storages that record the engine a partition was built with
+//in its metadata, so it is opened by that engine rather than the first one recognizing it.
+//Plain Put records the first default engine recognizing the file.
+type EngineStorage interface {
+	//PutEngine is Put recording engine, the Name of the engine that built fname
+	PutEngine(part, fname string, mutable bool, engine string) error
+	//GetEngine is Get also returning the recorded engine name, "" if there is none
+	GetEngine(part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error)
+}
+
+//putengine is Put recording engine if storage can
+func putengine(storage Storage, part, fname string, mutable bool, engine string) error {
+	if es, ok := storage.(EngineStorage); ok {
+		return es.PutEngine(part, fname, mutable, engine)
+	}
+	return storage.Put(part, fname, mutable)
+}
+
+//getengine is Get also returning the recorded engine if storage has one
+func getengine(storage Storage, part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	if es, ok := storage.(EngineStorage); ok {
+		return es.GetEngine(part)
+	}
+	fname, found, mutable, lastmod, err = storage.Get(part)
+	return
+}
+
+//PartMeta is the metadata a MetaStorage keeps with a partition
+type PartMeta struct {
+	Mutable bool
+	//Engine is the Name of the engine that built the partition, "" if not known
+	Engine string
+	//SHA256 is the hex checksum of the file as it was put, filled in by the storage
+	SHA256 string
+	//Raw stores the file as it is, for files that don't compress, e.g. ciphertext
+	Raw bool
+	//User is metadata of a wrapping storage, keys are lower case
+	User map[string]string
+}
+
+//MetaStorage is implemented by storages that keep PartMeta with every partition
+//and can return it without downloading the partition.
+type MetaStorage interface {
+	//PutMeta is Put recording meta
+	PutMeta(part, fname string, meta PartMeta) error
+	//Meta returns the metadata of part, found is false if it does not exist
+	Meta(part string) (meta PartMeta, found bool, err error)
+}
+
+//metaconditional is implemented by ConditionalStorages that can record PartMeta on PutIf
+type metaconditional interface {
+	putmetaif(part, fname string, meta PartMeta, tag string) error
+}
+
+//metaof returns storage as a MetaStorage, or ErrMetaNotSupported
+func metaof(storage Storage) (MetaStorage, error) {
+	ms, ok := storage.(MetaStorage)
+	if !ok {
+		return nil, ErrMetaNotSupported
+	}
+	return ms, nil
+}
+
+//putmeta is Put recording as much of meta as storage can
+func putmeta(storage Storage, part, fname string, meta PartMeta) error {
+	if ms, ok := storage.(MetaStorage); ok {
+		return ms.PutMeta(part, fname, meta)
+	}
+	return putengine(storage, part, fname, meta.Mutable, meta.Engine)
+}
+
+//putmetaif is PutIf recording as much of meta as storage can
+func putmetaif(storage Storage, part, fname string, meta PartMeta, tag string) error {
+	if mc, ok := storage.(metaconditional); ok {
+		return mc.putmetaif(part, fname, meta, tag)
+	}
+	c, err := conditionalof(storage)
+	if err != nil {
+		return err
+	}
+	return c.PutIf(part, fname, meta.Mutable, tag)
+}
+
+//conditionalof returns storage as a ConditionalStorage, or ErrConditionalNotSupported
+func conditionalof(storage Storage) (ConditionalStorage, error) {
+	c, ok := storage.(ConditionalStorage)
+	if !ok {
+		return nil, ErrConditionalNotSupported
+	}
+	return c, nil
+}
+
+//namelisterof returns storage as a NameLister, or ErrListNotSupported
+func namelisterof(storage Storage) (NameLister, error) {
+	l, ok := storage.(NameLister)
+	if !ok {
+		return nil, ErrListNotSupported
+	}
+	return l, nil
+}
+
+//listerof returns storage as a Lister, or ErrListNotSupported
+func listerof(storage Storage) (Lister, error) {
+	l, ok := storage.(Lister)
+	if !ok {
+		return nil, ErrListNotSupported
+	}
+	return l, nil
 }
 
 //S3Storage implements interface to access AWS S3.
-//Uses gzip for compression
+//Uses gzip for compression, except for tables which compress their blocks and are stored
+//as they are, so they can be read in ranges.
 type S3Storage struct {
+	//stats first, atomic access needs 64-bit alignment
+	stats  StorageStats
 	bucket *s3.Bucket
 	prefix string
+	retry  *RetryPolicy
+	//client makes the requests goamz has no call for
+	client *http.Client
 }
 
 //NewS3Storage creates new storage that talks to aws S3
+//Requests are retried using DefaultRetryPolicy
 func NewS3Storage(bucket *s3.Bucket, prefix string) *S3Storage {
-	return &S3Storage{bucket, prefix}
+	return &S3Storage{bucket: bucket, prefix: prefix, retry: DefaultRetryPolicy(), client: s3client(bucket)}
+}
+
+//s3client returns a client with the timeouts goamz uses for the bucket
+func s3client(bucket *s3.Bucket) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  (&net.Dialer{Timeout: bucket.ConnectTimeout}).Dial,
+		ResponseHeaderTimeout: bucket.ReadTimeout,
+	}}
+}
+
+//SetHTTPClient replaces the client used for requests goamz has no call for,
+//i.e. getting and listing versions
+func (s3s *S3Storage) SetHTTPClient(client *http.Client) {
+	s3s.client = client
+}
+
+//SetRetryPolicy replaces the retry policy, nil disables retries
+func (s3s *S3Storage) SetRetryPolicy(p *RetryPolicy) {
+	s3s.retry = p
+}
+
+//Stats returns request counters
+func (s3s *S3Storage) Stats() StorageStats {
+	return s3s.stats.snapshot()
 }
 
 //key returns the S3 key for partition
@@ -43,78 +312,501 @@ func (s3s *S3Storage) key(part string) string {
 	return s3s.prefix + part
 }
 
+//s3object is a partition downloaded by a single Get attempt
+type s3object struct {
+	fname   string
+	mutable bool
+	lastmod time.Time
+	etag    string
+	engine  string
+}
+
 //Get a partition file from S3 store into local file, suppress not found error
 func (s3s *S3Storage) Get(part string) (fname string, found, mutable bool, lastmod time.Time, err error) {
-	//Access s3
-	st := time.Now()
-	resp, err := s3s.bucket.GetResponse(s3s.key(part))
+	return s3s.getversion(part, "")
+}
+
+//GetEngine is Get also returning the engine recorded by Put, see EngineStorage
+func (s3s *S3Storage) GetEngine(part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	obj, err := s3s.getobject(part, "")
 	if err != nil {
-		if IsNotFound(err) {
-			//Way back, but still in future for error condition in GetLastMod
-			lastmod = time.Unix(2, 2)
-			//Flag it as mutable so on future Expire() loop we check again
-			mutable = true
-			//Do not propagate not founc error
-			err = nil
-		}
-		//Return... with or without error
 		return
 	}
-	lastmod, err = s3s.parselmod(resp.Header.Get("last-modified"))
+	if obj == nil {
+		//Same as Get
+		return "", false, true, time.Unix(2, 2), "", nil
+	}
+	return obj.fname, true, obj.mutable, obj.lastmod, obj.engine, nil
+}
+
+//GetVersion retrieves a specific version of a partition, the bucket needs versioning enabled
+func (s3s *S3Storage) GetVersion(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	return s3s.getversion(part, versionID)
+}
+
+//GetVersionEngine is GetVersion also returning the engine recorded by Put, see EngineVersioner
+func (s3s *S3Storage) GetVersionEngine(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	obj, err := s3s.getobject(part, versionID)
+	if err != nil || obj == nil {
+		return "", false, true, time.Unix(2, 2), "", err
+	}
+	return obj.fname, true, obj.mutable, obj.lastmod, obj.engine, nil
+}
+
+//GetTag is Get also returning the ETag, see ConditionalStorage
+func (s3s *S3Storage) GetTag(part string) (fname string, found, mutable bool, tag string, err error) {
+	obj, err := s3s.getobject(part, "")
+	if err != nil || obj == nil {
+		return "", false, true, "", err
+	}
+	return obj.fname, true, obj.mutable, obj.etag, nil
+}
+
+//getobject downloads versionID of a partition with retries, nil if it does not exist
+func (s3s *S3Storage) getobject(part, versionID string) (*s3object, error) {
+	res, err := s3s.retry.do("Get "+part, &s3s.stats, func(ctx context.Context) (interface{}, error) {
+		return s3s.get(ctx, part, versionID)
+	}, func(res interface{}) {
+		os.Remove(res.(*s3object).fname)
+	})
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.(*s3object), nil
+}
+
+//getversion downloads versionID of a partition, the latest one if empty
+func (s3s *S3Storage) getversion(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	obj, err := s3s.getobject(part, versionID)
 	if err != nil {
 		return
 	}
-	req := time.Since(st)
+	if obj == nil {
+		//Not found errors are not propagated.
+		//Way back, so any partition created later looks newer
+		lastmod = time.Unix(2, 2)
+		//Flag it as mutable so on future Expire() loop we check again
+		mutable = true
+		return
+	}
+	return obj.fname, true, obj.mutable, obj.lastmod, nil
+}
+
+//get makes a single attempt at downloading a partition
+func (s3s *S3Storage) get(ctx context.Context, part, versionID string) (*s3object, error) {
+	//Access s3
+	st := time.Now()
+	var resp *http.Response
+	var err error
+	if versionID == "" {
+		resp, err = s3s.bucket.GetResponse(s3s.key(part))
+	} else {
+		resp, err = s3s.versionresponse(ctx, part, versionID)
+	}
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
-	gzrd, err := gzip.NewReader(resp.Body)
+	lastmod, err := s3s.parselmod(resp.Header.Get("last-modified"))
 	if err != nil {
-		return
+		return nil, err
+	}
+	req := time.Since(st)
+	//goamz can't be cancelled, an abandoned download stops at the next read
+	var body io.Reader = &ctxreader{ctx: ctx, r: resp.Body}
+	if resp.Header.Get("x-amz-meta-raw") == "" {
+		gzrd, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			if badgzip(err) {
+				err = errors.Wrapf(ErrCorruptPartition, "%s: %v", part, err)
+			}
+			return nil, err
+		}
+		defer gzrd.Close()
+		body = gzrd
 	}
-	defer gzrd.Close()
 	//The location of the TempFile is totally up to the Storage implementation
 	tmpfile, err := ioutil.TempFile("", "infreqdb-")
 	if err != nil {
-		return
+		return nil, err
 	}
-	_, err = io.Copy(tmpfile, gzrd)
-	if err != nil {
-		return
-	}
-	gunzip := time.Since(st)
-	fname = tmpfile.Name()
+	fname := tmpfile.Name()
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpfile, sum), body)
 	tmpfile.Close()
+	if badgzip(err) {
+		err = errors.Wrapf(ErrCorruptPartition, "%s: %v", part, err)
+	}
+	//Older objects were uploaded without a checksum
+	expected := resp.Header.Get("x-amz-meta-sha256")
+	if err == nil && expected != "" && expected != hex.EncodeToString(sum.Sum(nil)) {
+		err = errors.Wrapf(ErrCorruptPartition, "%s: sha256 %x, expected %s", part, sum.Sum(nil), expected)
+	}
 	if err != nil {
 		os.Remove(fname)
-		return
+		return nil, err
 	}
-	//All is well... populate mutable and found
-	mutable = resp.Header.Get("x-amz-meta-mutable") != ""
-	found = true
+	gunzip := time.Since(st)
 	log.Println("loadeds3 ", part, req, gunzip)
-	return
+	//All is well... populate mutable
+	return &s3object{
+		fname:   fname,
+		mutable: resp.Header.Get("x-amz-meta-mutable") != "",
+		lastmod: lastmod,
+		etag:    resp.Header.Get("ETag"),
+		engine:  resp.Header.Get("x-amz-meta-engine"),
+	}, nil
+}
+
+//badgzip tells if err means the gzip stream is mangled or truncated, worth downloading again
+func badgzip(err error) bool {
+	if _, ok := err.(flate.CorruptInputError); ok {
+		return true
+	}
+	return err == gzip.ErrHeader || err == gzip.ErrChecksum || err == io.ErrUnexpectedEOF || err == io.EOF
+}
+
+//versionresponse requests a version of a partition, goamz has no call for that
+func (s3s *S3Storage) versionresponse(ctx context.Context, part, versionID string) (*http.Response, error) {
+	return s3s.signedget(ctx, s3s.key(part), url.Values{"versionId": {versionID}})
+}
+
+//signedget makes a single GET of a presigned URL until ctx is done, non 200 responses are an *s3.Error
+func (s3s *S3Storage) signedget(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	u := s3s.bucket.SignedURLWithArgs(path, time.Now().Add(time.Hour), params, nil)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s3s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &s3.Error{StatusCode: resp.StatusCode, Message: resp.Status}
+	}
+	return resp, nil
+}
+
+//listversionsresult is a page of GET Bucket versions.
+//goamz only returns versions, we need the delete markers too, in order.
+type listversionsresult struct {
+	IsTruncated         bool
+	NextKeyMarker       string
+	NextVersionIdMarker string
+	Entries             []listversionsentry `xml:",any"`
+}
+
+//listversionsentry is a Version or DeleteMarker element
+type listversionsentry struct {
+	XMLName      xml.Name
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	Size         int64
+}
+
+//listversions makes a single attempt at listing versions of keys starting with prefix
+func (s3s *S3Storage) listversions(ctx context.Context, prefix, keymarker, versionmarker string) (*listversionsresult, error) {
+	params := url.Values{"versions": {""}, "prefix": {prefix}}
+	if keymarker != "" {
+		params.Set("key-marker", keymarker)
+		params.Set("version-id-marker", versionmarker)
+	}
+	resp, err := s3s.signedget(ctx, "/", params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	list := &listversionsresult{}
+	err = xml.NewDecoder(resp.Body).Decode(list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+//ListVersions returns the versions of a partition, newest first, including delete markers
+func (s3s *S3Storage) ListVersions(part string) ([]PartVersion, error) {
+	key := s3s.key(part)
+	var versions []PartVersion
+	keymarker, versionmarker := "", ""
+	for {
+		res, err := s3s.retry.do("ListVersions "+part, &s3s.stats, func(ctx context.Context) (interface{}, error) {
+			return s3s.listversions(ctx, key, keymarker, versionmarker)
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		list := res.(*listversionsresult)
+		for _, v := range list.Entries {
+			marker := v.XMLName.Local == "DeleteMarker"
+			//The prefix also matches longer names
+			if v.Key != key || (!marker && v.XMLName.Local != "Version") {
+				continue
+			}
+			lastmod, err := time.Parse(time.RFC3339Nano, v.LastModified)
+			if err != nil {
+				return nil, errors.Wrap(err, part)
+			}
+			versions = append(versions, PartVersion{
+				VersionID:    v.VersionId,
+				LastModified: lastmod,
+				Size:         v.Size,
+				Latest:       v.IsLatest,
+				DeleteMarker: marker,
+			})
+		}
+		if !list.IsTruncated || list.NextKeyMarker > key {
+			break
+		}
+		keymarker, versionmarker = list.NextKeyMarker, list.NextVersionIdMarker
+	}
+	//Stable keeps S3's order for versions within the same millisecond
+	sort.Stable(partversions(versions))
+	return versions, nil
+}
+
+//partversions sorts newest first
+type partversions []PartVersion
+
+func (pv partversions) Len() int           { return len(pv) }
+func (pv partversions) Swap(i, j int)      { pv[i], pv[j] = pv[j], pv[i] }
+func (pv partversions) Less(i, j int) bool { return pv[i].LastModified.After(pv[j].LastModified) }
+
+//s3range is a range of a partition read by a single attempt
+type s3range struct {
+	data []byte
+	//start is the offset of data in the partition
+	start int64
+	info  RangeInfo
+}
+
+//getrange makes a single attempt at reading rng of part, the body is only read if part is stored uncompressed.
+//Unless tag is "" the read is conditional on the ETag.
+func (s3s *S3Storage) getrange(part, rng, tag string) (*s3range, error) {
+	headers := map[string][]string{"Range": {rng}}
+	if tag != "" {
+		headers["If-Match"] = []string{tag}
+	}
+	resp, err := s3s.bucket.GetResponseWithHeaders(s3s.key(part), headers)
+	if e, ok := err.(*s3.Error); ok {
+		switch e.StatusCode {
+		case http.StatusPreconditionFailed:
+			return nil, errors.Wrapf(ErrPartitionChanged, "%s: %v", part, err)
+		case http.StatusRequestedRangeNotSatisfiable:
+			//Empty, or shorter than the index says
+			return nil, errors.Wrapf(ErrCorruptPartition, "%s: %v", part, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	lastmod, err := s3s.parselmod(resp.Header.Get("last-modified"))
+	if err != nil {
+		return nil, err
+	}
+	r := &s3range{info: RangeInfo{
+		LastModified: lastmod,
+		Mutable:      resp.Header.Get("x-amz-meta-mutable") != "",
+		Engine:       resp.Header.Get("x-amz-meta-engine"),
+		Ranged:       resp.Header.Get("x-amz-meta-raw") != "",
+		Tag:          resp.Header.Get("ETag"),
+	}}
+	if !r.info.Ranged {
+		return r, nil
+	}
+	r.data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.info.Size = int64(len(r.data))
+	//A server ignoring Range sends everything, without Content-Range
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		var end int64
+		_, err = fmt.Sscanf(cr, "bytes %d-%d/%d", &r.start, &end, &r.info.Size)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: Content-Range %q", part, cr)
+		}
+	}
+	return r, nil
+}
+
+//ReadTail reads the end of a partition, see RangeStorage
+func (s3s *S3Storage) ReadTail(part string, n int64) ([]byte, RangeInfo, bool, error) {
+	res, err := s3s.retry.do("ReadTail "+part, &s3s.stats, func(ctx context.Context) (interface{}, error) {
+		return s3s.getrange(part, "bytes=-"+strconv.FormatInt(n, 10), "")
+	}, nil)
+	if err != nil {
+		if IsNotFound(err) {
+			err = nil
+		}
+		return nil, RangeInfo{}, false, err
+	}
+	r := res.(*s3range)
+	tail := r.data
+	if int64(len(tail)) > n {
+		tail = tail[int64(len(tail))-n:]
+	}
+	return tail, r.info, true, nil
+}
+
+//ReadRange reads part of a partition, see RangeStorage
+func (s3s *S3Storage) ReadRange(part string, off, length int64, tag string) ([]byte, time.Time, error) {
+	res, err := s3s.retry.do("ReadRange "+part, &s3s.stats, func(ctx context.Context) (interface{}, error) {
+		return s3s.getrange(part, fmt.Sprintf("bytes=%d-%d", off, off+length-1), tag)
+	}, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	r := res.(*s3range)
+	data := r.data
+	if i := off - r.start; i > 0 && i <= int64(len(data)) {
+		data = data[i:]
+	}
+	if int64(len(data)) > length {
+		data = data[:length]
+	}
+	return data, r.info.LastModified, nil
 }
 
 //Put uploads a partition to s3
 func (s3s *S3Storage) Put(part, fname string, mutable bool) error {
+	return s3s.put(part, fname, PartMeta{Mutable: mutable, Engine: enginename(fname, nil)}, nil)
+}
+
+//PutEngine is Put recording engine, see EngineStorage
+func (s3s *S3Storage) PutEngine(part, fname string, mutable bool, engine string) error {
+	return s3s.put(part, fname, PartMeta{Mutable: mutable, Engine: engine}, nil)
+}
+
+//PutMeta is Put recording meta as object metadata, see MetaStorage
+func (s3s *S3Storage) PutMeta(part, fname string, meta PartMeta) error {
+	return s3s.put(part, fname, meta, nil)
+}
+
+//PutIf uploads a partition if its ETag is still tag, see ConditionalStorage.
+//Relies on S3 conditional writes, If-Match and If-None-Match on PUT.
+func (s3s *S3Storage) PutIf(part, fname string, mutable bool, tag string) error {
+	return s3s.putmetaif(part, fname, PartMeta{Mutable: mutable, Engine: enginename(fname, nil)}, tag)
+}
+
+//putmetaif is PutIf recording meta
+func (s3s *S3Storage) putmetaif(part, fname string, meta PartMeta, tag string) error {
+	cond := make(http.Header)
+	if tag == "" {
+		cond.Set("If-None-Match", "*")
+	} else {
+		cond.Set("If-Match", tag)
+	}
+	err := s3s.put(part, fname, meta, cond)
+	if e, ok := errors.Cause(err).(*s3.Error); ok {
+		switch e.StatusCode {
+		case http.StatusPreconditionFailed, http.StatusConflict, http.StatusNotFound:
+			//Conflict when another conditional write is in flight, not found when deleted since
+			return errors.Wrapf(ErrPreconditionFailed, "%s: %v", part, err)
+		}
+	}
+	return err
+}
+
+//s3meta are the object metadata keys of PartMeta, others are user metadata
+var s3meta = map[string]bool{"raw": true, "mutable": true, "sha256": true, "engine": true}
+
+//put uploads a partition with meta and extra request headers
+func (s3s *S3Storage) put(part, fname string, meta PartMeta, extra http.Header) error {
 	var network bytes.Buffer
-	//compress..
-	//Yikes in memory
-	gzrw := gzip.NewWriter(&network)
+	//Tables compress their blocks, ranges can't be read from a gzipped object
+	raw := meta.Raw || meta.Engine == TableEngine.Name()
 	f, err := os.Open(fname)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(gzrw, f)
+	//Checksum of the uncompressed file, verified by Get
+	sum := sha256.New()
+	if raw {
+		_, err = io.Copy(io.MultiWriter(&network, sum), f)
+	} else {
+		//compress..
+		//Yikes in memory
+		gzrw := gzip.NewWriter(&network)
+		_, err = io.Copy(io.MultiWriter(gzrw, sum), f)
+		gzrw.Close()
+	}
 	if err != nil {
 		return err
 	}
-	gzrw.Close()
 	hdr := make(http.Header)
-	if mutable {
+	for k, v := range meta.User {
+		k = strings.ToLower(k)
+		if s3meta[k] {
+			return errors.Errorf("%s: reserved metadata key %q", part, k)
+		}
+		hdr.Set("x-amz-meta-"+k, v)
+	}
+	if raw {
+		hdr.Set("x-amz-meta-raw", "yes")
+	}
+	if meta.Mutable {
 		hdr.Set("x-amz-meta-mutable", "yes")
 	}
-	return s3s.bucket.PutHeader(s3s.key(part), network.Bytes(), hdr, "")
+	hdr.Set("x-amz-meta-sha256", hex.EncodeToString(sum.Sum(nil)))
+	if meta.Engine != "" {
+		hdr.Set("x-amz-meta-engine", meta.Engine)
+	}
+	for k, v := range extra {
+		hdr[k] = v
+	}
+	conditional := hdr.Get("If-Match") != "" || hdr.Get("If-None-Match") != ""
+	return s3s.retry.dowrite("Put "+part, &s3s.stats, conditional, network.Bytes(), func(r io.Reader) error {
+		return s3s.bucket.PutReaderHeader(s3s.key(part), r, int64(network.Len()), hdr, "")
+	})
+}
+
+//Meta reads the object metadata with a HEAD request, see MetaStorage
+func (s3s *S3Storage) Meta(part string) (meta PartMeta, found bool, err error) {
+	resp, err := s3s.head(part)
+	if err != nil {
+		if IsNotFound(err) {
+			err = nil
+		}
+		return
+	}
+	meta = PartMeta{
+		Mutable: resp.Header.Get("x-amz-meta-mutable") != "",
+		Engine:  resp.Header.Get("x-amz-meta-engine"),
+		SHA256:  resp.Header.Get("x-amz-meta-sha256"),
+		Raw:     resp.Header.Get("x-amz-meta-raw") != "",
+	}
+	for k := range resp.Header {
+		k = strings.ToLower(k)
+		if !strings.HasPrefix(k, "x-amz-meta-") || s3meta[strings.TrimPrefix(k, "x-amz-meta-")] {
+			continue
+		}
+		if meta.User == nil {
+			meta.User = make(map[string]string)
+		}
+		meta.User[strings.TrimPrefix(k, "x-amz-meta-")] = resp.Header.Get(k)
+	}
+	return meta, true, nil
+}
+
+//Delete removes a partition from s3
+func (s3s *S3Storage) Delete(part string) error {
+	_, err := s3s.retry.do("Delete "+part, &s3s.stats, func(ctx context.Context) (interface{}, error) {
+		return nil, s3s.bucket.Del(s3s.key(part))
+	}, nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
 }
 
 //parselmod parses last-modified string into time
@@ -128,17 +820,100 @@ func (s3s *S3Storage) parselmod(t string) (time.Time, error) {
 	return lmod, err
 }
 
-//GetLastMod gets last modification time for a partition
-//Return ancient time on failure
-func (s3s *S3Storage) GetLastMod(part string) time.Time {
-	resp, err := s3s.bucket.Head(s3s.key(part), map[string][]string{})
+//head makes a HEAD request for a partition
+func (s3s *S3Storage) head(part string) (*http.Response, error) {
+	res, err := s3s.retry.do("Head "+part, &s3s.stats, func(ctx context.Context) (interface{}, error) {
+		return s3s.bucket.Head(s3s.key(part), map[string][]string{})
+	}, nil)
 	if err != nil {
-		log.Println(err)
-		return time.Unix(1, 0)
+		return nil, err
 	}
-	lmod, err := s3s.parselmod(resp.Header.Get("last-modified"))
+	return res.(*http.Response), nil
+}
+
+//Stat gets last modification time for a partition using a HEAD request
+func (s3s *S3Storage) Stat(part string) (lastmod time.Time, found bool, err error) {
+	resp, err := s3s.head(part)
 	if err != nil {
-		return time.Unix(1, 0)
+		if IsNotFound(err) {
+			err = nil
+		}
+		return
+	}
+	lastmod, err = s3s.parselmod(resp.Header.Get("last-modified"))
+	found = err == nil
+	return
+}
+
+//ListNames pages through the bucket listing, see NameLister
+func (s3s *S3Storage) ListNames(prefix string) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		res, err := s3s.retry.do("List "+prefix, &s3s.stats, func(ctx context.Context) (interface{}, error) {
+			return s3s.bucket.List(s3s.key(prefix), "", marker, 1000)
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		list := res.(*s3.ListResp)
+		for _, k := range list.Contents {
+			marker = k.Key
+			names = append(names, strings.TrimPrefix(k.Key, s3s.prefix))
+		}
+		if !list.IsTruncated || len(list.Contents) == 0 {
+			return names, nil
+		}
+		if list.NextMarker != "" {
+			marker = list.NextMarker
+		}
+	}
+}
+
+//List pages through the bucket listing. The mutable flag is only available from
+//object metadata, so this makes a HEAD request per partition.
+func (s3s *S3Storage) List(prefix string) ([]PartEntry, error) {
+	var entries []PartEntry
+	marker := ""
+	for {
+		res, err := s3s.retry.do("List "+prefix, &s3s.stats, func(ctx context.Context) (interface{}, error) {
+			return s3s.bucket.List(s3s.key(prefix), "", marker, 1000)
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		list := res.(*s3.ListResp)
+		for _, k := range list.Contents {
+			marker = k.Key
+			part := strings.TrimPrefix(k.Key, s3s.prefix)
+			if issidecar(part) {
+				continue
+			}
+			lastmod, err := time.Parse(time.RFC3339Nano, k.LastModified)
+			if err != nil {
+				return nil, errors.Wrap(err, part)
+			}
+			resp, err := s3s.head(part)
+			if IsNotFound(err) {
+				//Deleted while we were listing
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, PartEntry{
+				Partition:    part,
+				Size:         k.Size,
+				LastModified: lastmod,
+				Mutable:      resp.Header.Get("x-amz-meta-mutable") != "",
+				Engine:       resp.Header.Get("x-amz-meta-engine"),
+			})
+		}
+		if !list.IsTruncated || len(list.Contents) == 0 {
+			return entries, nil
+		}
+		if list.NextMarker != "" {
+			marker = list.NextMarker
+		}
 	}
-	return lmod
 }
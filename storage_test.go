@@ -1,8 +1,14 @@
 package infreqdb
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestS3Storage(t *testing.T) {
@@ -11,7 +17,8 @@ func TestS3Storage(t *testing.T) {
 		t.Error(err)
 	}
 	var storage Storage
-	storage = NewS3Storage(bucket, "/") //should be compile fail if interface is not implemented
+	s3s := NewS3Storage(bucket, "/")
+	storage = s3s //should be compile fail if interface is not implemented
 	//Get 404
 	fname, found, mutable, lastmod, err := storage.Get("foo")
 	if err != nil {
@@ -29,4 +36,226 @@ func TestS3Storage(t *testing.T) {
 	if lastmod != time.Unix(2, 2) {
 		t.Errorf("Expected to be %s, got not %s", time.Unix(2, 2), lastmod)
 	}
+	_, found, err = storage.Stat("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if found {
+		t.Errorf("Expected to be not found, got found")
+	}
+	//404 is an answer, not a failure to retry
+	stats := s3s.Stats()
+	if stats.Attempts != 2 || stats.Retries != 0 || stats.Failures != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestS3StorageChecksum(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	storage := NewS3Storage(bucket, "/")
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	err = ioutil.WriteFile(tf, []byte("hello world"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Put("foo", tf, true)
+	if err != nil {
+		t.Error(err)
+	}
+	fname, found, _, _, err := storage.Get("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if !found {
+		t.Errorf("Expected to be found")
+	}
+	os.Remove(fname)
+	//Replace content but keep the checksum of the original
+	resp, err := bucket.Head("/foo", map[string][]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var network bytes.Buffer
+	gzw := gzip.NewWriter(&network)
+	gzw.Write([]byte("hello wrold"))
+	gzw.Close()
+	err = bucket.PutHeader("/foo", network.Bytes(), map[string][]string{
+		"x-amz-meta-sha256": {resp.Header.Get("x-amz-meta-sha256")},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _, err = storage.Get("foo")
+	if errors.Cause(err) != ErrCorruptPartition {
+		t.Errorf("expected %v, got %v", ErrCorruptPartition, err)
+	}
+	//Truncated or mangled gzip streams
+	mangled := append([]byte(nil), network.Bytes()...)
+	for i := 10; i < len(mangled)-8; i++ {
+		mangled[i] = 0xff
+	}
+	for name, data := range map[string][]byte{
+		"truncated header": network.Bytes()[:4],
+		"truncated stream": network.Bytes()[:len(network.Bytes())-10],
+		"empty":            {},
+		"mangled":          mangled,
+	} {
+		err = bucket.PutHeader("/foo", data, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, _, err = storage.Get("foo")
+		if errors.Cause(err) != ErrCorruptPartition {
+			t.Errorf("%s: expected %v, got %v", name, ErrCorruptPartition, err)
+		}
+	}
+}
+
+func TestS3StorageList(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3s := NewS3Storage(bucket, "pre/")
+	//Outside the prefix, must not show up
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	err = ioutil.WriteFile(tf, []byte("elsewhere"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewS3Storage(bucket, "other/").Put("a-1", tf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testList(t, s3s)
+	ts, err := NewTieredStorage(&flakystorage{Storage: s3s}, s3s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := listerof(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := l.List("")
+	if err != nil || len(entries) != 3 {
+		t.Errorf("expected 3 partitions through TieredStorage, got %v %v", entries, err)
+	}
+	_, err = listerof(&flakystorage{Storage: s3s})
+	if err != ErrListNotSupported {
+		t.Errorf("expected ErrListNotSupported, got %v", err)
+	}
+}
+
+//testList stores a few partitions and lists them
+func testList(t *testing.T, l interface {
+	Storage
+	Lister
+}) {
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	err := ioutil.WriteFile(tf, []byte("hello world"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{"b/2", "a-1", "a+2"} {
+		err = l.Put(part, tf, part != "a+2")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := l.List("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Partition != "a+2" || entries[1].Partition != "a-1" {
+		t.Fatalf("expected a+2 and a-1, got %+v", entries)
+	}
+	if entries[0].Mutable || !entries[1].Mutable || entries[0].Size == 0 || entries[0].LastModified.IsZero() {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	entries, err = l.List("")
+	if err != nil || len(entries) != 3 || entries[2].Partition != "b/2" {
+		t.Errorf("expected 3 partitions, got %+v %v", entries, err)
+	}
+}
+
+func TestConditionalStorage(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "infreqdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3s := NewS3Storage(bucket, "/")
+	tiered, err := NewTieredStorage(fs, s3s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewStaticKeys("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	for name, storage := range map[string]ConditionalStorage{
+		"s3":        s3s,
+		"file":      fs,
+		"tiered":    tiered,
+		"encrypted": NewEncryptedStorage(fs, keys),
+	} {
+		part := "cond-" + name
+		_, found, _, tag, err := storage.GetTag(part)
+		if err != nil || found || tag != "" {
+			t.Errorf("%s: expected nothing, got %v %q %v", name, found, tag, err)
+		}
+		ioutil.WriteFile(tf, []byte("one"), 0600)
+		err = storage.PutIf(part, tf, true, "")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		//Must not exist anymore
+		err = storage.PutIf(part, tf, true, "")
+		if errors.Cause(err) != ErrPreconditionFailed {
+			t.Errorf("%s: expected %v, got %v", name, ErrPreconditionFailed, err)
+		}
+		fname, found, _, tag, err := storage.GetTag(part)
+		if err != nil || !found || tag == "" {
+			t.Fatalf("%s: expected a tag, got %v %q %v", name, found, tag, err)
+		}
+		os.Remove(fname)
+		ioutil.WriteFile(tf, []byte("two"), 0600)
+		err = storage.PutIf(part, tf, true, tag)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		//Someone else wrote since
+		ioutil.WriteFile(tf, []byte("three"), 0600)
+		err = storage.PutIf(part, tf, true, tag)
+		if errors.Cause(err) != ErrPreconditionFailed {
+			t.Errorf("%s: expected %v, got %v", name, ErrPreconditionFailed, err)
+		}
+		fname, _, _, _, err = storage.GetTag(part)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		b, _ := ioutil.ReadFile(fname)
+		os.Remove(fname)
+		if string(b) != "two" {
+			t.Errorf("%s: expected two, got %q", name, b)
+		}
+	}
+	//No conditional puts underneath
+	_, _, _, _, err = NewEncryptedStorage(&flakystorage{Storage: s3s}, keys).GetTag("cond-s3")
+	if errors.Cause(err) != ErrConditionalNotSupported {
+		t.Errorf("expected %v, got %v", ErrConditionalNotSupported, err)
+	}
 }
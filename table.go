@@ -0,0 +1,507 @@
+package infreqdb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+//tableMagic starts and ends a sorted table
+var tableMagic = []byte("IFQTBL1\n")
+
+const (
+	//tableBlockSize is where blocks are cut, a lookup reads a single block
+	tableBlockSize = 32 << 10
+	//tableFooterSize is the index offset and length followed by tableMagic
+	tableFooterSize = 8 + 8 + 8
+	//tableRaw is the codec of uncompressed blocks
+	tableRaw = 0
+	//tableFlate is the codec of blocks compressed with flate
+	tableFlate = 1
+)
+
+//tableengine writes immutable sorted tables. A table starts with tableMagic, followed by
+//blocks of records, each a key and a value prefixed with their uvarint lengths. Blocks never
+//span buckets, nested buckets are not supported. Each block is compressed with flate, unless
+//that does not make it smaller. Then comes the index: the bucket count, per
+//bucket its name, key count, last key and block count, and per block its first key, offset,
+//length, codec byte and the CRC32 (IEEE) of the block as stored in 4 big endian bytes,
+//all uvarints or length prefixed. The footer holds the index offset
+//and length as big endian uint64 followed by tableMagic again.
+type tableengine struct{}
+
+func (tableengine) Name() string {
+	return "table"
+}
+
+func (tableengine) Detect(header []byte) bool {
+	return bytes.HasPrefix(header, tableMagic)
+}
+
+func (tableengine) Open(fname string) (PartReader, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t, err := readtable(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.c = f
+	return t, nil
+}
+
+//Build fails on nested buckets
+func (tableengine) Build(fname string, src PartReader) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	tw := &tablewriter{w: bufio.NewWriter(f)}
+	err = tw.write(tableMagic)
+	if err == nil {
+		err = walkpart(src, tw.put)
+	}
+	if err == nil {
+		err = tw.finish()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//tablebucket is a bucket in the index of a table
+type tablebucket struct {
+	name   []byte
+	keys   int
+	last   []byte
+	blocks []tableblock
+}
+
+//tableblock locates a block of a table
+type tableblock struct {
+	first  []byte
+	off    int64
+	length int64
+	codec  byte
+	//crc is the CRC32 of the block as stored
+	crc uint32
+}
+
+//tablewriter writes a table, keys have to arrive in order
+type tablewriter struct {
+	w       *bufio.Writer
+	off     int64
+	buckets []tablebucket
+	//block is being filled, first and last are its first and latest keys
+	block       []byte
+	first, last []byte
+	//zw compresses blocks into zbuf
+	zw   *flate.Writer
+	zbuf bytes.Buffer
+}
+
+//write appends b to the file
+func (tw *tablewriter) write(b []byte) error {
+	n, err := tw.w.Write(b)
+	tw.off += int64(n)
+	return err
+}
+
+//put is a walkpart callback adding a bucket or key
+func (tw *tablewriter) put(path [][]byte, k, v []byte) error {
+	if len(path) > 1 {
+		return errors.Errorf("table: nested bucket %s not supported", bytes.Join(path, []byte("/")))
+	}
+	if k == nil {
+		if n := len(tw.buckets); n > 0 && bytes.Compare(path[0], tw.buckets[n-1].name) <= 0 {
+			return errors.Errorf("table: bucket %s out of order", path[0])
+		}
+		err := tw.flush()
+		tw.buckets = append(tw.buckets, tablebucket{name: append([]byte(nil), path[0]...)})
+		return err
+	}
+	tb := &tw.buckets[len(tw.buckets)-1]
+	if tb.keys > 0 && bytes.Compare(k, tw.last) <= 0 {
+		return errors.Errorf("table: key %q out of order in bucket %s", k, tb.name)
+	}
+	if len(tw.block) >= tableBlockSize {
+		if err := tw.flush(); err != nil {
+			return err
+		}
+	}
+	if len(tw.block) == 0 {
+		tw.first = append([]byte(nil), k...)
+	}
+	tw.block = appendbytes(tw.block, k)
+	tw.block = appendbytes(tw.block, v)
+	tw.last = append(tw.last[:0], k...)
+	tb.keys++
+	return nil
+}
+
+//flush writes the current block
+func (tw *tablewriter) flush() error {
+	if len(tw.block) == 0 {
+		return nil
+	}
+	data, codec, err := tw.compress()
+	if err != nil {
+		return err
+	}
+	tb := &tw.buckets[len(tw.buckets)-1]
+	tb.blocks = append(tb.blocks, tableblock{first: tw.first, off: tw.off, length: int64(len(data)), codec: codec, crc: crc32.ChecksumIEEE(data)})
+	tb.last = append([]byte(nil), tw.last...)
+	err = tw.write(data)
+	tw.block = tw.block[:0]
+	return err
+}
+
+//compress returns the current block compressed, or raw if that is not smaller
+func (tw *tablewriter) compress() ([]byte, byte, error) {
+	tw.zbuf.Reset()
+	if tw.zw == nil {
+		zw, err := flate.NewWriter(&tw.zbuf, flate.DefaultCompression)
+		if err != nil {
+			return nil, 0, err
+		}
+		tw.zw = zw
+	} else {
+		tw.zw.Reset(&tw.zbuf)
+	}
+	_, err := tw.zw.Write(tw.block)
+	if err == nil {
+		err = tw.zw.Close()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if tw.zbuf.Len() >= len(tw.block) {
+		return tw.block, tableRaw, nil
+	}
+	return tw.zbuf.Bytes(), tableFlate, nil
+}
+
+//finish writes the last block, the index and the footer
+func (tw *tablewriter) finish() error {
+	err := tw.flush()
+	if err != nil {
+		return err
+	}
+	index := appenduvarint(nil, uint64(len(tw.buckets)))
+	for _, tb := range tw.buckets {
+		index = appendbytes(index, tb.name)
+		index = appenduvarint(index, uint64(tb.keys))
+		index = appendbytes(index, tb.last)
+		index = appenduvarint(index, uint64(len(tb.blocks)))
+		for _, blk := range tb.blocks {
+			index = appendbytes(index, blk.first)
+			index = appenduvarint(index, uint64(blk.off))
+			index = appenduvarint(index, uint64(blk.length))
+			index = append(index, blk.codec)
+			index = append(index, byte(blk.crc>>24), byte(blk.crc>>16), byte(blk.crc>>8), byte(blk.crc))
+		}
+	}
+	footer := make([]byte, tableFooterSize)
+	binary.BigEndian.PutUint64(footer, uint64(tw.off))
+	binary.BigEndian.PutUint64(footer[8:], uint64(len(index)))
+	copy(footer[16:], tableMagic)
+	err = tw.write(index)
+	if err == nil {
+		err = tw.write(footer)
+	}
+	if err == nil {
+		err = tw.w.Flush()
+	}
+	return err
+}
+
+//appenduvarint appends v as a uvarint
+func appenduvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+//appendbytes appends v prefixed with its length
+func appendbytes(b, v []byte) []byte {
+	return append(appenduvarint(b, uint64(len(v))), v...)
+}
+
+//tablereader reads a table through r, only the index is held in memory
+type tablereader struct {
+	r       io.ReaderAt
+	c       io.Closer
+	size    int64
+	buckets []tablebucket
+}
+
+//errbadtable reports a malformed table
+func errbadtable(what string) error {
+	return errors.Wrap(ErrCorruptPartition, "table: "+what)
+}
+
+//readtable reads the index of a table of size bytes
+func readtable(r io.ReaderAt, size int64) (*tablereader, error) {
+	if size < int64(len(tableMagic))+tableFooterSize {
+		return nil, errbadtable("too short")
+	}
+	footer := make([]byte, tableFooterSize)
+	_, err := r.ReadAt(footer, size-tableFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[16:], tableMagic) {
+		return nil, errbadtable("bad footer")
+	}
+	off, n := binary.BigEndian.Uint64(footer), binary.BigEndian.Uint64(footer[8:])
+	if end := uint64(size - tableFooterSize); off < uint64(len(tableMagic)) || off > end || n > end-off {
+		return nil, errbadtable("bad index location")
+	}
+	index := make([]byte, n)
+	_, err = r.ReadAt(index, int64(off))
+	if err != nil {
+		return nil, err
+	}
+	t := &tablereader{r: r, size: size}
+	t.buckets, err = parseindex(index, int64(off))
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+//parseindex decodes the index of a table, blocks must end before indexoff
+func parseindex(index []byte, indexoff int64) ([]tablebucket, error) {
+	d := &tabledecoder{b: index}
+	var buckets []tablebucket
+	for nb := d.uvarint(); d.err == nil && nb > 0; nb-- {
+		tb := tablebucket{name: d.bytes(), keys: int(d.uvarint()), last: d.bytes()}
+		for nblk := d.uvarint(); d.err == nil && nblk > 0; nblk-- {
+			blk := tableblock{first: d.bytes(), off: int64(d.uvarint()), length: int64(d.uvarint()), codec: d.byte(), crc: d.uint32()}
+			if d.err == nil && (blk.off < int64(len(tableMagic)) || blk.length < 0 || blk.length > indexoff-blk.off) {
+				d.err = errbadtable("bad block location")
+			}
+			tb.blocks = append(tb.blocks, blk)
+		}
+		buckets = append(buckets, tb)
+	}
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errbadtable("trailing index bytes")
+	}
+	return buckets, d.err
+}
+
+//tabledecoder reads the fields of a table index, the first error sticks
+type tabledecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *tabledecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errbadtable("bad index")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *tabledecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.b)) {
+		d.err = errbadtable("bad index")
+	}
+	if d.err != nil {
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *tabledecoder) byte() byte {
+	if d.err == nil && len(d.b) == 0 {
+		d.err = errbadtable("bad index")
+	}
+	if d.err != nil {
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *tabledecoder) uint32() uint32 {
+	if d.err == nil && len(d.b) < 4 {
+		d.err = errbadtable("bad index")
+	}
+	if d.err != nil {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+//nextrecord splits the first record off block
+func nextrecord(block []byte) (k, v, rest []byte, err error) {
+	d := &tabledecoder{b: block}
+	k = d.bytes()
+	v = d.bytes()
+	if d.err != nil {
+		return nil, nil, nil, errbadtable("bad record")
+	}
+	return k, v, d.b, nil
+}
+
+//bucket finds the bucket at path, tables have top level buckets only
+func (t *tablereader) bucket(path [][]byte) (*tablebucket, error) {
+	if len(path) == 0 {
+		return nil, ErrEmptyPath
+	}
+	i := sort.Search(len(t.buckets), func(i int) bool {
+		return bytes.Compare(t.buckets[i].name, path[0]) >= 0
+	})
+	if i == len(t.buckets) || !bytes.Equal(t.buckets[i].name, path[0]) {
+		return nil, &BucketNotFoundError{Path: path, Depth: 0}
+	}
+	if len(path) > 1 {
+		return nil, &BucketNotFoundError{Path: path, Depth: 1}
+	}
+	return &t.buckets[i], nil
+}
+
+//seek returns the block key would be in, -1 if it comes before all of them
+func (tb *tablebucket) seek(key []byte) int {
+	return sort.Search(len(tb.blocks), func(i int) bool {
+		return bytes.Compare(tb.blocks[i].first, key) > 0
+	}) - 1
+}
+
+//readblock reads and decodes a block
+func (t *tablereader) readblock(blk *tableblock) ([]byte, error) {
+	if blk.codec != tableRaw && blk.codec != tableFlate {
+		return nil, errbadtable("unknown block codec")
+	}
+	b := make([]byte, blk.length)
+	_, err := t.r.ReadAt(b, blk.off)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b) != blk.crc {
+		return nil, errbadtable("block checksum mismatch")
+	}
+	if blk.codec == tableRaw {
+		return b, nil
+	}
+	zr := flate.NewReader(bytes.NewReader(b))
+	defer zr.Close()
+	b, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, errbadtable("bad block: " + err.Error())
+	}
+	return b, nil
+}
+
+func (t *tablereader) Get(path [][]byte, key []byte) ([]byte, error) {
+	tb, err := t.bucket(path)
+	if err != nil {
+		return nil, err
+	}
+	i := tb.seek(key)
+	if i < 0 {
+		return nil, nil
+	}
+	block, err := t.readblock(&tb.blocks[i])
+	for err == nil && len(block) > 0 {
+		var k, v []byte
+		k, v, block, err = nextrecord(block)
+		if err != nil {
+			break
+		}
+		switch bytes.Compare(k, key) {
+		case 0:
+			//The block is ours, no need to copy
+			return v[:len(v):len(v)], nil
+		case 1:
+			return nil, nil
+		}
+	}
+	return nil, err
+}
+
+func (t *tablereader) Iterate(path [][]byte, start, end []byte, fn func(k, v []byte) error) error {
+	tb, err := t.bucket(path)
+	if err != nil {
+		return err
+	}
+	i := 0
+	if start != nil {
+		if i = tb.seek(start); i < 0 {
+			i = 0
+		}
+	}
+	for ; i < len(tb.blocks); i++ {
+		if end != nil && bytes.Compare(tb.blocks[i].first, end) >= 0 {
+			return nil
+		}
+		block, err := t.readblock(&tb.blocks[i])
+		for err == nil && len(block) > 0 {
+			var k, v []byte
+			k, v, block, err = nextrecord(block)
+			if err != nil || (start != nil && bytes.Compare(k, start) < 0) {
+				continue
+			}
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				return nil
+			}
+			err = fn(k, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tablereader) Buckets() ([]BucketRange, error) {
+	buckets := make([]BucketRange, len(t.buckets))
+	for i, tb := range t.buckets {
+		buckets[i] = BucketRange{Name: string(tb.name), Keys: tb.keys}
+		if len(tb.blocks) > 0 {
+			buckets[i].Min = append([]byte(nil), tb.blocks[0].first...)
+			buckets[i].Max = append([]byte(nil), tb.last...)
+		}
+	}
+	return buckets, nil
+}
+
+func (t *tablereader) Size() int64 {
+	return t.size
+}
+
+func (t *tablereader) Close() error {
+	if t.c == nil {
+		return nil
+	}
+	return t.c.Close()
+}
@@ -0,0 +1,276 @@
+package infreqdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//buildtable writes a table from a bolt file filled by fn
+func buildtable(t *testing.T, fn func(tx *bolt.Tx) error) string {
+	bld, err := NewBuilder("table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bld.Update(fn)
+	if err == nil {
+		err = bld.bdb.Close()
+	}
+	defer os.Remove(bld.fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname, err := packfile(bld.fname, "", nil, TableEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestTable(t *testing.T) {
+	value := bytes.Repeat([]byte("v"), 100)
+	fname := buildtable(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("big"))
+		if err != nil {
+			return err
+		}
+		//Spans several blocks
+		for i := 0; i < 2000; i++ {
+			if err = b.Put([]byte(fmt.Sprintf("k%05d", i)), value); err != nil {
+				return err
+			}
+		}
+		if _, err = tx.CreateBucket([]byte("empty")); err != nil {
+			return err
+		}
+		b, err = tx.CreateBucket([]byte("small"))
+		if err == nil {
+			err = b.Put([]byte("a"), []byte{})
+		}
+		return err
+	})
+	defer os.Remove(fname)
+	r, e, err := openpart(fname, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if e != TableEngine {
+		t.Errorf("expected TableEngine, got %s", e.Name())
+	}
+	tr := r.(*tablereader)
+	if n := len(tr.buckets[0].blocks); n < 2 {
+		t.Errorf("expected several blocks, got %d", n)
+	}
+	buckets, err := r.Buckets()
+	if err != nil || len(buckets) != 3 {
+		t.Fatalf("expected 3 buckets, got %+v %v", buckets, err)
+	}
+	if br := buckets[0]; br.Name != "big" || br.Keys != 2000 || string(br.Min) != "k00000" || string(br.Max) != "k01999" {
+		t.Errorf("unexpected bucket %+v", br)
+	}
+	if br := buckets[1]; br.Name != "empty" || br.Keys != 0 || br.Min != nil {
+		t.Errorf("unexpected bucket %+v", br)
+	}
+	for _, i := range []int{0, 1, 999, 1000, 1999} {
+		v, err := r.Get([][]byte{[]byte("big")}, []byte(fmt.Sprintf("k%05d", i)))
+		if err != nil || !bytes.Equal(v, value) {
+			t.Errorf("%d: expected value, got %s %v", i, v, err)
+		}
+	}
+	for _, k := range []string{"a", "k00000x", "k2"} {
+		v, err := r.Get([][]byte{[]byte("big")}, []byte(k))
+		if err != nil || v != nil {
+			t.Errorf("%s: expected nothing, got %s %v", k, v, err)
+		}
+	}
+	v, err := r.Get([][]byte{[]byte("small")}, []byte("a"))
+	if err != nil || v == nil || len(v) != 0 {
+		t.Errorf("expected empty value, got %#v %v", v, err)
+	}
+	n := 0
+	err = r.Iterate([][]byte{[]byte("big")}, []byte("k00500"), []byte("k01500"), func(k, v []byte) error {
+		if expected := fmt.Sprintf("k%05d", 500+n); string(k) != expected {
+			return errors.Errorf("expected %s, got %s", expected, k)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != 1000 {
+		t.Errorf("expected 1000 keys, got %d %v", n, err)
+	}
+	err = r.Iterate([][]byte{[]byte("small")}, nil, nil, func(k, v []byte) error {
+		if v == nil {
+			return errors.New("empty value read as a nested bucket")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = r.Get([][]byte{[]byte("nope")}, []byte("a"))
+	if bnf, ok := err.(*BucketNotFoundError); !ok || bnf.Depth != 0 {
+		t.Errorf("expected BucketNotFoundError, got %v", err)
+	}
+	_, err = r.Get([][]byte{[]byte("big"), []byte("nested")}, []byte("a"))
+	if bnf, ok := err.(*BucketNotFoundError); !ok || bnf.Depth != 1 {
+		t.Errorf("expected BucketNotFoundError at depth 1, got %v", err)
+	}
+	_, err = r.Get(nil, []byte("a"))
+	if err != ErrEmptyPath {
+		t.Errorf("expected ErrEmptyPath, got %v", err)
+	}
+}
+
+func TestTableNested(t *testing.T) {
+	bld, err := NewBuilder("table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bld.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("outer"))
+		if err == nil {
+			_, err = b.CreateBucket([]byte("inner"))
+		}
+		return err
+	})
+	if err == nil {
+		err = bld.bdb.Close()
+	}
+	defer os.Remove(bld.fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = packfile(bld.fname, "", nil, TableEngine)
+	if err == nil {
+		t.Error("expected nested buckets to fail")
+	}
+}
+
+func TestTableCorrupt(t *testing.T) {
+	fname := buildtable(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("b"))
+		if err == nil {
+			err = b.Put([]byte("k"), []byte("v"))
+		}
+		return err
+	})
+	defer os.Remove(fname)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mangled := range map[string][]byte{
+		"truncated":   data[:len(data)-1],
+		"short":       data[:10],
+		"bad index":   append(append([]byte(nil), data[:len(data)-tableFooterSize-1]...), data[len(data)-tableFooterSize:]...),
+		"index moved": append(append([]byte(nil), data[:len(data)-tableFooterSize]...), append([]byte{0xff, 0, 0, 0, 0, 0, 0, 0}, data[len(data)-tableFooterSize+8:]...)...),
+	} {
+		err = ioutil.WriteFile(fname, mangled, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = TableEngine.Open(fname)
+		if errors.Cause(err) != ErrCorruptPartition {
+			t.Errorf("%s: expected ErrCorruptPartition, got %v", name, err)
+		}
+	}
+}
+
+func TestTableCodecs(t *testing.T) {
+	fname := buildtable(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("packed"))
+		for i := 0; err == nil && i < 2000; i++ {
+			err = b.Put([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte("v"), 100))
+		}
+		if err != nil {
+			return err
+		}
+		//Random bytes don't compress
+		b, err = tx.CreateBucket([]byte("random"))
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; err == nil && i < 10; i++ {
+			v := make([]byte, 100)
+			rnd.Read(v)
+			err = b.Put([]byte(fmt.Sprintf("k%05d", i)), v)
+		}
+		return err
+	})
+	defer os.Remove(fname)
+	r, err := TableEngine.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := r.(*tablereader)
+	packed, random := tr.buckets[0].blocks[0], tr.buckets[1].blocks[0]
+	if packed.codec != tableFlate || packed.length > tableBlockSize/10 || random.codec != tableRaw {
+		t.Errorf("unexpected blocks %+v %+v", packed, random)
+	}
+	v, err := r.Get([][]byte{[]byte("packed")}, []byte("k01999"))
+	if err != nil || !bytes.Equal(v, bytes.Repeat([]byte("v"), 100)) {
+		t.Errorf("expected value, got %s %v", v, err)
+	}
+	r.Close()
+	//Mangle the compressed block
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := packed.off; i < packed.off+packed.length; i++ {
+		data[i] = 0xff
+	}
+	err = ioutil.WriteFile(fname, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = TableEngine.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, err = r.Get([][]byte{[]byte("packed")}, []byte("k00000"))
+	if errors.Cause(err) != ErrCorruptPartition {
+		t.Errorf("expected ErrCorruptPartition, got %v", err)
+	}
+}
+
+func TestTableChecksums(t *testing.T) {
+	fname := buildtable(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("b"))
+		if err == nil {
+			err = b.Put([]byte("k"), []byte("v"))
+		}
+		return err
+	})
+	defer os.Remove(fname)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//A raw block, the record follows tableMagic
+	i := bytes.Index(data, []byte("\x01k\x01v"))
+	if i != len(tableMagic) {
+		t.Fatalf("expected a raw block, got %q", data)
+	}
+	data[i+3] = 'x'
+	err = ioutil.WriteFile(fname, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := TableEngine.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, err = r.Get([][]byte{[]byte("b")}, []byte("k"))
+	if errors.Cause(err) != ErrCorruptPartition {
+		t.Errorf("expected ErrCorruptPartition, got %v", err)
+	}
+
+}
@@ -0,0 +1,275 @@
+package infreqdb
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//TieredStorage chains storages, fastest first. The last tier is authoritative,
+//e.g. a FileStorage on local disk or NFS in front of S3Storage.
+//Get tries tiers in order and back-fills the faster tiers that missed,
+//Put writes through to every tier and Stat only asks the authoritative tier.
+type TieredStorage struct {
+	tiers []Storage
+}
+
+//BackfillStorage is implemented by storages that remember, for a faster tier of TieredStorage,
+//the last modified time the authoritative tier reported for the copy they hold.
+//Comparing that instead of local modification times is immune to clock skew and to
+//back-fills finishing after the authoritative copy changed again.
+//The engine is recorded too, see EngineStorage.
+type BackfillStorage interface {
+	//PutBackfill is Put recording source, the authoritative last modified time, and engine
+	PutBackfill(part, fname string, mutable bool, source time.Time, engine string) error
+	//GetBackfill is Get also returning the recorded source, zero if there is none, and engine
+	GetBackfill(part string) (fname string, found, mutable bool, lastmod, source time.Time, engine string, err error)
+}
+
+//NewTieredStorage creates a TieredStorage, the last tier is authoritative
+func NewTieredStorage(tiers ...Storage) (*TieredStorage, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("TieredStorage needs at least one tier")
+	}
+	return &TieredStorage{tiers: tiers}, nil
+}
+
+//authoritative is the source of truth
+func (ts *TieredStorage) authoritative() Storage {
+	return ts.tiers[len(ts.tiers)-1]
+}
+
+//Get returns the partition from the fastest tier holding a current copy.
+//Copies of mutable partitions in faster tiers are checked against the authoritative
+//tier, the returned lastmod is always the authoritative one so CheckExpiry keeps working.
+func (ts *TieredStorage) Get(part string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	fname, found, mutable, lastmod, _, err = ts.GetEngine(part)
+	return
+}
+
+//GetEngine is Get also returning the engine recorded by the tier that had the partition, see EngineStorage
+func (ts *TieredStorage) GetEngine(part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	last := len(ts.tiers) - 1
+	for i, tier := range ts.tiers {
+		if i == last {
+			fname, found, mutable, lastmod, engine, err = getengine(tier, part)
+		} else {
+			fname, found, mutable, lastmod, engine, err = ts.getcached(tier, part)
+		}
+		if err != nil {
+			if i == last {
+				return
+			}
+			log.Println("tier", i, part, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		ts.backfill(i, part, fname, mutable, lastmod, engine)
+		return
+	}
+	return
+}
+
+//getcached gets a partition from a faster tier, dropping it if it is stale.
+//Copies with a recorded source must match the authoritative lastmod exactly,
+//other copies must not be older than it. Immutable copies with a recorded source
+//are trusted as is, others take their lastmod from the authoritative tier.
+func (ts *TieredStorage) getcached(tier Storage, part string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	var source time.Time
+	if bs, ok := tier.(BackfillStorage); ok {
+		fname, found, mutable, lastmod, source, engine, err = bs.GetBackfill(part)
+	} else {
+		fname, found, mutable, lastmod, engine, err = getengine(tier, part)
+	}
+	if !source.IsZero() {
+		lastmod = source
+	}
+	if err != nil || !found || (!mutable && !source.IsZero()) {
+		return
+	}
+	authmod, authfound, err := ts.authoritative().Stat(part)
+	if err != nil {
+		//Can't tell, a possibly stale copy beats no copy
+		log.Println("tier stat", part, err)
+		return fname, true, mutable, lastmod, engine, nil
+	}
+	stale := !authfound || lastmod.Before(authmod)
+	if !mutable {
+		stale = !authfound
+	} else if !source.IsZero() {
+		stale = !authfound || !source.Equal(authmod)
+	}
+	if stale {
+		os.Remove(fname)
+		return "", false, false, time.Time{}, "", nil
+	}
+	return fname, true, mutable, authmod, engine, nil
+}
+
+//putsourced puts the partition in tier, recording source and engine if the tier can
+func putsourced(tier Storage, part, fname string, mutable bool, source time.Time, engine string) error {
+	if bs, ok := tier.(BackfillStorage); ok && !source.IsZero() {
+		return bs.PutBackfill(part, fname, mutable, source, engine)
+	}
+	return putengine(tier, part, fname, mutable, engine)
+}
+
+//backfill stores the partition in the tiers faster than tier n, lastmod is authoritative
+func (ts *TieredStorage) backfill(n int, part, fname string, mutable bool, lastmod time.Time, engine string) {
+	for i := 0; i < n; i++ {
+		err := putsourced(ts.tiers[i], part, fname, mutable, lastmod, engine)
+		if err != nil {
+			log.Println("backfill tier", i, part, err)
+		}
+	}
+}
+
+//Put writes through to all tiers, authoritative first so faster copies are never older.
+//Faster tiers record the lastmod the authoritative tier reports after the upload.
+//Returns the first error, but still tries every tier.
+func (ts *TieredStorage) Put(part, fname string, mutable bool) error {
+	return ts.PutEngine(part, fname, mutable, enginename(fname, nil))
+}
+
+//PutEngine is Put recording engine in every tier, see EngineStorage
+func (ts *TieredStorage) PutEngine(part, fname string, mutable bool, engine string) error {
+	return ts.put(part, fname, mutable, engine, func(part, fname string, mutable bool) error {
+		return putengine(ts.authoritative(), part, fname, mutable, engine)
+	})
+}
+
+//PutMeta is Put recording meta in the authoritative tier, faster tiers only record the engine, see MetaStorage
+func (ts *TieredStorage) PutMeta(part, fname string, meta PartMeta) error {
+	return ts.put(part, fname, meta.Mutable, meta.Engine, func(part, fname string, mutable bool) error {
+		return putmeta(ts.authoritative(), part, fname, meta)
+	})
+}
+
+//Meta asks the authoritative tier, see MetaStorage
+func (ts *TieredStorage) Meta(part string) (PartMeta, bool, error) {
+	ms, err := metaof(ts.authoritative())
+	if err != nil {
+		return PartMeta{}, false, err
+	}
+	return ms.Meta(part)
+}
+
+//GetTag asks the authoritative tier, see ConditionalStorage
+func (ts *TieredStorage) GetTag(part string) (fname string, found, mutable bool, tag string, err error) {
+	c, err := conditionalof(ts.authoritative())
+	if err != nil {
+		return
+	}
+	return c.GetTag(part)
+}
+
+//PutIf is Put conditional on the tag of the authoritative tier, see ConditionalStorage
+func (ts *TieredStorage) PutIf(part, fname string, mutable bool, tag string) error {
+	return ts.putmetaif(part, fname, PartMeta{Mutable: mutable, Engine: enginename(fname, nil)}, tag)
+}
+
+//putmetaif is PutIf recording meta in the authoritative tier
+func (ts *TieredStorage) putmetaif(part, fname string, meta PartMeta, tag string) error {
+	if _, err := conditionalof(ts.authoritative()); err != nil {
+		return err
+	}
+	return ts.put(part, fname, meta.Mutable, meta.Engine, func(part, fname string, mutable bool) error {
+		return putmetaif(ts.authoritative(), part, fname, meta, tag)
+	})
+}
+
+//put writes to the authoritative tier with authput, then to the faster tiers recording engine
+func (ts *TieredStorage) put(part, fname string, mutable bool, engine string, authput func(part, fname string, mutable bool) error) error {
+	last := len(ts.tiers) - 1
+	err := authput(part, fname, mutable)
+	if err != nil {
+		//No point in caching what the source of truth refused
+		return err
+	}
+	var source time.Time
+	if last > 0 {
+		source, _, err = ts.tiers[last].Stat(part)
+		if err != nil {
+			//Without the source faster copies would carry their own lastmod, drop them
+			//so the next Get backfills them from the authoritative tier
+			log.Println("tier stat", part, err)
+			for i := last - 1; i >= 0; i-- {
+				ts.tiers[i].Delete(part)
+			}
+			return nil
+		}
+	}
+	var first error
+	for i := last - 1; i >= 0; i-- {
+		err := putsourced(ts.tiers[i], part, fname, mutable, source, engine)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+//Delete removes part from all tiers, authoritative first so it can't be back-filled again
+func (ts *TieredStorage) Delete(part string) error {
+	for i := len(ts.tiers) - 1; i >= 0; i-- {
+		err := ts.tiers[i].Delete(part)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Stat asks the authoritative tier
+func (ts *TieredStorage) Stat(part string) (time.Time, bool, error) {
+	return ts.authoritative().Stat(part)
+}
+
+//List asks the authoritative tier
+func (ts *TieredStorage) List(prefix string) ([]PartEntry, error) {
+	l, err := listerof(ts.authoritative())
+	if err != nil {
+		return nil, err
+	}
+	return l.List(prefix)
+}
+
+//ListNames asks the authoritative tier
+func (ts *TieredStorage) ListNames(prefix string) ([]string, error) {
+	l, err := namelisterof(ts.authoritative())
+	if err != nil {
+		return nil, err
+	}
+	return l.ListNames(prefix)
+}
+
+//GetVersion asks the authoritative tier, faster tiers only hold current partitions
+func (ts *TieredStorage) GetVersion(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, err error) {
+	v, err := versionerof(ts.authoritative())
+	if err != nil {
+		return
+	}
+	return v.GetVersion(part, versionID)
+}
+
+//GetVersionEngine asks the authoritative tier, see EngineVersioner
+func (ts *TieredStorage) GetVersionEngine(part, versionID string) (fname string, found, mutable bool, lastmod time.Time, engine string, err error) {
+	v, err := versionerof(ts.authoritative())
+	if err != nil {
+		return
+	}
+	return getversionengine(v, part, versionID)
+}
+
+//ListVersions asks the authoritative tier
+func (ts *TieredStorage) ListVersions(part string) ([]PartVersion, error) {
+	v, err := versionerof(ts.authoritative())
+	if err != nil {
+		return nil, err
+	}
+	return v.ListVersions(part)
+}
@@ -0,0 +1,125 @@
+package infreqdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTieredStorage(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	dir, err := ioutil.TempDir("", "infreqdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := NewS3Storage(bucket, "/")
+	_, err = NewTieredStorage()
+	if err == nil {
+		t.Error("expected no tiers to fail")
+	}
+	storage, err := NewTieredStorage(local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	ioutil.WriteFile(tf, []byte("v1"), 0600)
+	//Upstream only, as if written by another node
+	err = remote.Put("foo", tf, true)
+	if err != nil {
+		t.Error(err)
+	}
+	readback := func(expected string) time.Time {
+		fname, found, _, lastmod, err := storage.Get("foo")
+		if err != nil || !found {
+			t.Fatalf("expected found, got %v %v", found, err)
+		}
+		defer os.Remove(fname)
+		b, _ := ioutil.ReadFile(fname)
+		if string(b) != expected {
+			t.Errorf("expected %v, got %s", expected, b)
+		}
+		return lastmod
+	}
+	lastmod := readback("v1")
+	//Must have been back-filled
+	_, found, _ := local.Stat("foo")
+	if !found {
+		t.Error("local tier was not back-filled")
+	}
+	authmod, _, _ := storage.Stat("foo")
+	if !lastmod.Equal(authmod) {
+		t.Errorf("expected authoritative lastmod %v, got %v", authmod, lastmod)
+	}
+	//Served from local tier now, still the authoritative lastmod
+	if l := readback("v1"); !l.Equal(authmod) {
+		t.Errorf("expected authoritative lastmod %v, got %v", authmod, l)
+	}
+	//YIKES: Sleep a second since http time is at 1 second resolution
+	time.Sleep(time.Second)
+	//Upstream changes behind our back, local copy is stale
+	ioutil.WriteFile(tf, []byte("v2"), 0600)
+	err = remote.Put("foo", tf, true)
+	if err != nil {
+		t.Error(err)
+	}
+	readback("v2")
+	//A local clock ahead, or a back-fill finishing late, must not hide a change
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(local.path("foo"), future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	ioutil.WriteFile(tf, []byte("v2.1"), 0600)
+	err = remote.Put("foo", tf, true)
+	if err != nil {
+		t.Error(err)
+	}
+	readback("v2.1")
+	//Write through
+	time.Sleep(time.Second)
+	ioutil.WriteFile(tf, []byte("v3"), 0600)
+	err = storage.Put("foo", tf, true)
+	if err != nil {
+		t.Error(err)
+	}
+	fname, _, _, _, err := local.Get("foo")
+	if err != nil {
+		t.Error(err)
+	}
+	b, _ := ioutil.ReadFile(fname)
+	os.Remove(fname)
+	if string(b) != "v3" {
+		t.Errorf("expected v3 in local tier, got %s", b)
+	}
+	readback("v3")
+	//Immutable copies without a recorded source still report the authoritative lastmod
+	err = remote.Put("bar", tf, false)
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	err = local.Put("bar", tf, false)
+	if err != nil {
+		t.Error(err)
+	}
+	authmod, _, _ = remote.Stat("bar")
+	fname, found, _, lastmod, err = storage.Get("bar")
+	if err != nil || !found {
+		t.Fatalf("expected found, got %v %v", found, err)
+	}
+	os.Remove(fname)
+	if !lastmod.Equal(authmod) {
+		t.Errorf("expected authoritative lastmod %v, got %v", authmod, lastmod)
+	}
+}
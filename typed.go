@@ -0,0 +1,324 @@
+//go:build go1.18
+// +build go1.18
+
+package infreqdb
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//Codec converts keys or values of type T to bytes and back, see Table
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	//Decode must not keep b, it is only valid during the call
+	Decode(b []byte) (T, error)
+}
+
+//Table reads and writes the buckets of a DB with typed keys and values, converted by codecs.
+//Use an order preserving key codec like IntCodec, TimeCodec or StringCodec for ScanRange.
+type Table[K, V any] struct {
+	db     *DB
+	keys   Codec[K]
+	values Codec[V]
+}
+
+//NewTable creates a Table reading db
+func NewTable[K, V any](db *DB, keys Codec[K], values Codec[V]) *Table[K, V] {
+	return &Table[K, V]{db: db, keys: keys, values: values}
+}
+
+//Get gets single key from a bucket of partid.
+//Missing keys fail as with DB.Get, keys and values failing their codec as *CodecError.
+func (t *Table[K, V]) Get(partid string, bucket []byte, key K) (V, error) {
+	var v V
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return v, &CodecError{Partition: partid, Bucket: bucket, Op: "encode key", Err: err}
+	}
+	b, err := t.db.Get(partid, bucket, k)
+	if err != nil {
+		return v, err
+	}
+	if b == nil {
+		//The partition does not exist
+		return v, errkeynotfound(bucket, k)
+	}
+	v, err = t.values.Decode(b)
+	if err != nil {
+		return v, &CodecError{Partition: partid, Bucket: bucket, Key: k, Op: "decode value", Err: err}
+	}
+	return v, nil
+}
+
+//Scan calls fn for every key of a bucket of partid in key order, nested buckets are skipped.
+//The scan stops at the first key or value failing its codec with *CodecError.
+func (t *Table[K, V]) Scan(partid string, bucket []byte, fn func(k K, v V) error) error {
+	return t.scan(partid, bucket, nil, nil, fn)
+}
+
+//ScanRange is Scan of the keys in [start, end)
+func (t *Table[K, V]) ScanRange(partid string, bucket []byte, start, end K, fn func(k K, v V) error) error {
+	s, err := t.keys.Encode(start)
+	if err != nil {
+		return &CodecError{Partition: partid, Bucket: bucket, Op: "encode start", Err: err}
+	}
+	e, err := t.keys.Encode(end)
+	if err != nil {
+		return &CodecError{Partition: partid, Bucket: bucket, Op: "encode end", Err: err}
+	}
+	return t.scan(partid, bucket, s, e, fn)
+}
+
+func (t *Table[K, V]) scan(partid string, bucket, start, end []byte, fn func(k K, v V) error) error {
+	return t.db.RangePath(partid, [][]byte{bucket}, start, end, func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		key, err := t.keys.Decode(k)
+		if err != nil {
+			return &CodecError{Partition: partid, Bucket: bucket, Key: copyvalue(k), Op: "decode key", Err: err}
+		}
+		value, err := t.values.Decode(v)
+		if err != nil {
+			return &CodecError{Partition: partid, Bucket: bucket, Key: copyvalue(k), Op: "decode value", Err: err}
+		}
+		return fn(key, value)
+	})
+}
+
+//Put stores a single key in a partition being built, creating bucket if needed.
+//Use PutTx inside Builder.Update for bulk loads, Put opens a transaction per call.
+func (t *Table[K, V]) Put(b *Builder, bucket []byte, key K, value V) error {
+	k, v, err := t.encode(b.Partition(), bucket, key, value)
+	if err != nil {
+		return err
+	}
+	return b.Put(bucket, k, v)
+}
+
+//PutTx stores a single key in tx, creating bucket if needed
+func (t *Table[K, V]) PutTx(tx *bolt.Tx, bucket []byte, key K, value V) error {
+	k, v, err := t.encode("", bucket, key, value)
+	if err != nil {
+		return err
+	}
+	bkt, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return err
+	}
+	return bkt.Put(k, v)
+}
+
+func (t *Table[K, V]) encode(partid string, bucket []byte, key K, value V) ([]byte, []byte, error) {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return nil, nil, &CodecError{Partition: partid, Bucket: bucket, Op: "encode key", Err: err}
+	}
+	v, err := t.values.Encode(value)
+	if err != nil {
+		return nil, nil, &CodecError{Partition: partid, Bucket: bucket, Key: k, Op: "encode value", Err: err}
+	}
+	return k, v, nil
+}
+
+type gobcodec[T any] struct{}
+
+//GobCodec encodes with encoding/gob, every value carries its type description
+func GobCodec[T any]() Codec[T] {
+	return gobcodec[T]{}
+}
+
+func (gobcodec[T]) Encode(v T) ([]byte, error) {
+	var network bytes.Buffer
+	err := gob.NewEncoder(&network).Encode(&v)
+	return network.Bytes(), err
+}
+
+func (gobcodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+type jsoncodec[T any] struct{}
+
+//JSONCodec encodes with encoding/json
+func JSONCodec[T any]() Codec[T] {
+	return jsoncodec[T]{}
+}
+
+func (jsoncodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsoncodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+//ProtoMessage is implemented by messages of protobuf generators like gogo/protobuf
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(b []byte) error
+}
+
+type protocodec[T any, PT interface {
+	*T
+	ProtoMessage
+}] struct{}
+
+//ProtoCodec encodes messages T whose pointers are a ProtoMessage, e.g. ProtoCodec[pb.City]()
+func ProtoCodec[T any, PT interface {
+	*T
+	ProtoMessage
+}]() Codec[T] {
+	return protocodec[T, PT]{}
+}
+
+func (protocodec[T, PT]) Encode(v T) ([]byte, error) {
+	return PT(&v).Marshal()
+}
+
+func (protocodec[T, PT]) Decode(b []byte) (T, error) {
+	var v T
+	err := PT(&v).Unmarshal(b)
+	return v, err
+}
+
+type binarycodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+//BinaryCodec encodes T whose pointers are an encoding.BinaryMarshaler and BinaryUnmarshaler,
+//e.g. BinaryCodec[time.Time]() reads keys written with time.Time.MarshalBinary
+func BinaryCodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}]() Codec[T] {
+	return binarycodec[T, PT]{}
+}
+
+func (binarycodec[T, PT]) Encode(v T) ([]byte, error) {
+	return PT(&v).MarshalBinary()
+}
+
+func (binarycodec[T, PT]) Decode(b []byte) (T, error) {
+	var v T
+	err := PT(&v).UnmarshalBinary(b)
+	return v, err
+}
+
+//Integer is any integer type, see IntCodec
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+type intcodec[T Integer] struct{}
+
+//IntCodec encodes integers as 8 bytes big endian, the sign bit of signed types flipped,
+//so keys sort in numeric order
+func IntCodec[T Integer]() Codec[T] {
+	return intcodec[T]{}
+}
+
+//signbit is flipped for signed T
+func (intcodec[T]) signbit() uint64 {
+	var v T
+	if v--; v < 0 {
+		return 1 << 63
+	}
+	return 0
+}
+
+func (c intcodec[T]) Encode(v T) ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v)^c.signbit())
+	return b, nil
+}
+
+func (c intcodec[T]) Decode(b []byte) (T, error) {
+	if len(b) != 8 {
+		return 0, errors.Errorf("integer of %d bytes, expected 8", len(b))
+	}
+	u := binary.BigEndian.Uint64(b) ^ c.signbit()
+	v := T(u)
+	if c.signbit() != 0 && int64(v) != int64(u) {
+		return 0, errors.Errorf("integer %d overflows %T", int64(u), v)
+	}
+	if c.signbit() == 0 && uint64(v) != u {
+		return 0, errors.Errorf("integer %d overflows %T", u, v)
+	}
+	return v, nil
+}
+
+type timecodec struct{}
+
+//TimeCodec encodes times as IntCodec encodes their UnixNano, so keys sort in time order.
+//Times decode in UTC, only those UnixNano can represent, years 1678 to 2262, can be encoded.
+func TimeCodec() Codec[time.Time] {
+	return timecodec{}
+}
+
+var (
+	//mintime and maxtime bound what UnixNano can represent
+	mintime = time.Unix(0, math.MinInt64)
+	maxtime = time.Unix(0, math.MaxInt64)
+)
+
+func (timecodec) Encode(v time.Time) ([]byte, error) {
+	if v.Before(mintime) || v.After(maxtime) {
+		return nil, errors.Errorf("time %v out of range, expected %v to %v", v, mintime.UTC(), maxtime.UTC())
+	}
+	return intcodec[int64]{}.Encode(v.UnixNano())
+}
+
+func (timecodec) Decode(b []byte) (time.Time, error) {
+	n, err := intcodec[int64]{}.Decode(b)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, n).UTC(), nil
+}
+
+type stringcodec struct{}
+
+//StringCodec stores strings as they are
+func StringCodec() Codec[string] {
+	return stringcodec{}
+}
+
+func (stringcodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (stringcodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+type bytescodec struct{}
+
+//BytesCodec stores byte slices as they are, decoding copies them
+func BytesCodec() Codec[[]byte] {
+	return bytescodec{}
+}
+
+func (bytescodec) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (bytescodec) Decode(b []byte) ([]byte, error) {
+	return copyvalue(b), nil
+}
@@ -0,0 +1,229 @@
+//go:build go1.18
+// +build go1.18
+
+package infreqdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+type cityinfo struct {
+	Temperature float64
+	WindSpeed   float64
+}
+
+//pbcity mimics a generated protobuf message
+type pbcity struct {
+	Temperature float64
+}
+
+func (c *pbcity) Marshal() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(c.Temperature))
+	return b, nil
+}
+
+func (c *pbcity) Unmarshal(b []byte) error {
+	if len(b) != 8 {
+		return errors.New("bad message")
+	}
+	c.Temperature = math.Float64frombits(binary.LittleEndian.Uint64(b))
+	return nil
+}
+
+func TestCodecs(t *testing.T) {
+	ci := cityinfo{Temperature: 30.5, WindSpeed: 2}
+	for name, c := range map[string]Codec[cityinfo]{"gob": GobCodec[cityinfo](), "json": JSONCodec[cityinfo]()} {
+		b, err := c.Encode(ci)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := c.Decode(b)
+		if err != nil || v != ci {
+			t.Errorf("%s: expected %+v, got %+v %v", name, ci, v, err)
+		}
+		_, err = c.Decode([]byte("junk"))
+		if err == nil {
+			t.Errorf("%s: expected junk to fail", name)
+		}
+	}
+	pc := ProtoCodec[pbcity]()
+	b, _ := pc.Encode(pbcity{Temperature: 12})
+	pb, err := pc.Decode(b)
+	if err != nil || pb.Temperature != 12 {
+		t.Errorf("expected 12, got %+v %v", pb, err)
+	}
+	ts := time.Date(2017, 1, 1, 0, 1, 0, 0, time.UTC)
+	bc := BinaryCodec[time.Time]()
+	b, _ = bc.Encode(ts)
+	bts, err := bc.Decode(b)
+	if err != nil || !bts.Equal(ts) {
+		t.Errorf("expected %v, got %v %v", ts, bts, err)
+	}
+
+	//Order is kept
+	ic := IntCodec[int32]()
+	var prev []byte
+	for _, i := range []int32{math.MinInt32, -1, 0, 1, math.MaxInt32} {
+		b, _ := ic.Encode(i)
+		if prev != nil && bytes.Compare(prev, b) >= 0 {
+			t.Errorf("%d sorts before the previous integer", i)
+		}
+		prev = b
+		v, err := ic.Decode(b)
+		if err != nil || v != i {
+			t.Errorf("expected %d, got %d %v", i, v, err)
+		}
+	}
+	big, _ := IntCodec[int64]().Encode(math.MaxInt64)
+	_, err = ic.Decode(big)
+	if err == nil {
+		t.Error("expected overflow")
+	}
+	big, _ = IntCodec[uint64]().Encode(math.MaxUint64)
+	_, err = IntCodec[uint16]().Decode(big)
+	if err == nil {
+		t.Error("expected overflow")
+	}
+	_, err = ic.Decode([]byte{1})
+	if err == nil {
+		t.Error("expected short integer to fail")
+	}
+	tc := TimeCodec()
+	early, _ := tc.Encode(time.Date(1969, 1, 1, 0, 0, 0, 0, time.UTC))
+	late, _ := tc.Encode(ts)
+	if bytes.Compare(early, late) >= 0 {
+		t.Error("expected 1969 to sort first")
+	}
+	tts, err := tc.Decode(late)
+	if err != nil || !tts.Equal(ts) {
+		t.Errorf("expected %v, got %v %v", ts, tts, err)
+	}
+	for _, out := range []time.Time{time.Date(1677, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2263, 1, 1, 0, 0, 0, 0, time.UTC), {}} {
+		_, err = tc.Encode(out)
+		if err == nil {
+			t.Errorf("expected %v to fail", out)
+		}
+	}
+	for _, edge := range []time.Time{time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64)} {
+		b, err := tc.Encode(edge)
+		if err == nil {
+			tts, err = tc.Decode(b)
+		}
+		if err != nil || !tts.Equal(edge) {
+			t.Errorf("expected %v, got %v %v", edge, tts, err)
+		}
+	}
+	in := []byte("v")
+	out, _ := BytesCodec().Decode(in)
+	in[0] = 'x'
+	if string(out) != "v" {
+		t.Error("expected a copy")
+	}
+}
+
+func TestTypedTable(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cities := NewTable(db, TimeCodec(), GobCodec[cityinfo]())
+	bld, err := NewBuilder("2017-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = bld.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 60; i++ {
+			err := cities.PutTx(tx, []byte("bangkok"), start.Add(time.Duration(i)*time.Minute), cityinfo{Temperature: float64(i)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = cities.Put(bld, []byte("amsterdam"), start, cityinfo{Temperature: -5})
+	}
+	if err == nil {
+		//Not a gob
+		err = bld.Put([]byte("broken"), []byte("12345678"), []byte("junk"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bld.Commit(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ci, err := cities.Get("2017-01-01", []byte("bangkok"), start.Add(30*time.Minute))
+	if err != nil || ci.Temperature != 30 {
+		t.Errorf("expected 30, got %+v %v", ci, err)
+	}
+	ci, err = cities.Get("2017-01-01", []byte("amsterdam"), start)
+	if err != nil || ci.Temperature != -5 {
+		t.Errorf("expected -5, got %+v %v", ci, err)
+	}
+	_, err = cities.Get("2017-01-01", []byte("bangkok"), start.Add(-time.Minute))
+	if err == nil {
+		t.Error("expected missing key to fail")
+	}
+	_, err = cities.Get("2017-01-02", []byte("bangkok"), start)
+	if err == nil {
+		t.Error("expected missing partition to fail")
+	}
+
+	n := 0
+	err = cities.ScanRange("2017-01-01", []byte("bangkok"), start.Add(10*time.Minute), start.Add(20*time.Minute), func(k time.Time, v cityinfo) error {
+		if expected := start.Add(time.Duration(10+n) * time.Minute); !k.Equal(expected) || v.Temperature != float64(10+n) {
+			return errors.Errorf("expected %v, got %v %+v", expected, k, v)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != 10 {
+		t.Errorf("expected 10 keys, got %d %v", n, err)
+	}
+	n = 0
+	err = cities.Scan("2017-01-01", []byte("bangkok"), func(k time.Time, v cityinfo) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 60 {
+		t.Errorf("expected 60 keys, got %d %v", n, err)
+	}
+
+	//Codec errors are returned, not fatal
+	err = cities.Scan("2017-01-01", []byte("broken"), func(k time.Time, v cityinfo) error {
+		return errors.New("not reached")
+	})
+	ce, ok := err.(*CodecError)
+	if !ok || ce.Op != "decode value" || string(ce.Key) != "12345678" || string(ce.Bucket) != "broken" {
+		t.Errorf("expected CodecError, got %v", err)
+	}
+	raw := NewTable(db, BytesCodec(), GobCodec[cityinfo]())
+	_, err = raw.Get("2017-01-01", []byte("broken"), []byte("12345678"))
+	if _, ok := err.(*CodecError); !ok {
+		t.Errorf("expected CodecError, got %v", err)
+	}
+	ints := NewTable(db, IntCodec[uint8](), StringCodec())
+	err = ints.Scan("2017-01-01", []byte("bangkok"), func(k uint8, v string) error {
+		return nil
+	})
+	if ce, ok := err.(*CodecError); !ok || ce.Op != "decode key" {
+		t.Errorf("expected CodecError decoding key, got %v", err)
+	}
+}
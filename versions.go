@@ -0,0 +1,177 @@
+package infreqdb
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+//versionkey is the cache key of a partition version, code walking the cache only handles string keys.
+//deltas are the versions of the deltas applied to it, "" for the version as stored.
+type versionkey struct {
+	partid, versionID, deltas string
+}
+
+func (vk versionkey) String() string {
+	if vk.deltas == "" {
+		return vk.partid + "@" + vk.versionID
+	}
+	return vk.partid + "@" + vk.versionID + "+" + vk.deltas
+}
+
+//versionat returns the version current at time at from versions sorted newest first,
+//nil if there was none yet
+func versionat(versions []PartVersion, at time.Time) *PartVersion {
+	for i := range versions {
+		if !versions[i].LastModified.After(at) {
+			return &versions[i]
+		}
+	}
+	return nil
+}
+
+//ViewAt is View on the version of partid that was current at time at, e.g. to reproduce
+//a report against last week's data. The storage must implement Versioner.
+//Versions share the cache with current partitions but never expire. With WithDeltas
+//the versions of its deltas current at time at are applied, finding them costs a
+//ListVersions per delta. Like View, it fails with NotOwnerError on nodes of a Cluster
+//not owning partid.
+//If the partition did not exist yet, or was deleted at that time, fn is not called,
+//like View does for missing partitions.
+func (db *DB) ViewAt(partid string, at time.Time, fn func(*bolt.Tx) error) error {
+	if db.cluster != nil && !db.cluster.IsOwner(partid) {
+		return &NotOwnerError{Partition: partid, Owners: db.cluster.Owners(partid)}
+	}
+	v, err := versionerof(db.storage)
+	if err != nil {
+		return errors.Wrap(err, "ViewAt")
+	}
+	versions, err := v.ListVersions(partid)
+	if err != nil {
+		return errors.Wrap(err, "ViewAt")
+	}
+	pv := versionat(versions, at)
+	if pv == nil || pv.DeleteMarker {
+		return nil
+	}
+	cp, err := db.getversion(v, partid, pv.VersionID, at)
+	if err != nil {
+		return errors.Wrap(err, "ViewAt")
+	}
+	return cp.view(fn)
+}
+
+//getversion returns versionID of partid with the deltas current at time at applied,
+//loading it like load does if it is not cached
+func (db *DB) getversion(v Versioner, partid, versionID string, at time.Time) (*cachepartition, error) {
+	key := versionkey{partid: partid, versionID: versionID}
+	cp, err := db.loadversion(key, func() (*cachepartition, error) {
+		return db.downloadversion(v, partid, versionID)
+	})
+	if err != nil || !db.usedeltas {
+		return cp, err
+	}
+	gen := deltagen(cp.lastModified, true)
+	deltas, err := deltaversions(v, partid, gen, at)
+	if err != nil || len(deltas) == 0 {
+		return cp, err
+	}
+	key.deltas = strings.Join(deltas, ",")
+	return db.loadversion(key, func() (*cachepartition, error) {
+		return db.applyversions(v, partid, versionID, gen, deltas)
+	})
+}
+
+//loadversion returns the version under key from the cache, loading it with fetch on a miss
+func (db *DB) loadversion(key versionkey, fetch func() (*cachepartition, error)) (*cachepartition, error) {
+	cp, ok, err := db.cached(key)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		atomic.AddInt64(&db.stats.hits, 1)
+		return cp, nil
+	}
+	atomic.AddInt64(&db.stats.misses, 1)
+	return db.loadkey(key, func() (*cachepartition, error) {
+		log.Println("loading", key)
+		atomic.AddInt64(&db.stats.loads, 1)
+		return fetch()
+	})
+}
+
+//downloadversion fetches versionID of partid and opens it with its recorded engine
+func (db *DB) downloadversion(v Versioner, partid, versionID string) (*cachepartition, error) {
+	fname, found, _, lastmod, engine, err := getversionengine(v, partid, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.Errorf("version %s of %s not found", versionID, partid)
+	}
+	//Versions never change, keep CheckExpiry away from them
+	return opencachepartition(partid, fname, engine, false, lastmod, db.engines)
+}
+
+//deltaversions returns the versions of the deltas of partid made against generation gen
+//that were current at time at, in the order they apply
+func deltaversions(v Versioner, partid string, gen int64, at time.Time) ([]string, error) {
+	var ids []string
+	for n := 1; ; n++ {
+		versions, err := v.ListVersions(deltaname(partid, gen, n))
+		if err != nil {
+			return nil, err
+		}
+		pv := versionat(versions, at)
+		if pv == nil || pv.DeleteMarker {
+			return ids, nil
+		}
+		ids = append(ids, pv.VersionID)
+	}
+}
+
+//applyversions fetches versionID of partid again and applies the given delta versions on top
+func (db *DB) applyversions(v Versioner, partid, versionID string, gen int64, deltas []string) (*cachepartition, error) {
+	fname, found, _, lastmod, engine, err := getversionengine(v, partid, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.Errorf("version %s of %s not found", versionID, partid)
+	}
+	bdb, fname, err := db.openforupdate(fname, engine)
+	if err != nil {
+		os.Remove(fname)
+		return nil, err
+	}
+	for i, id := range deltas {
+		name := deltaname(partid, gen, i+1)
+		var dname string
+		dname, found, _, _, err = v.GetVersion(name, id)
+		if err == nil && !found {
+			err = errors.Errorf("version %s not found", id)
+		}
+		if err == nil {
+			err = applydelta(bdb, dname)
+		}
+		if dname != "" {
+			os.Remove(dname)
+		}
+		if err != nil {
+			bdb.Close()
+			os.Remove(fname)
+			return nil, errors.Wrap(err, name)
+		}
+	}
+	err = bdb.Close()
+	if err != nil {
+		os.Remove(fname)
+		return nil, err
+	}
+	return opencachepartition(partid, fname, BoltEngine.Name(), false, lastmod, db.engines)
+}
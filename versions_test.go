@@ -0,0 +1,277 @@
+package infreqdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+func TestViewAt(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Error(err)
+	}
+	storage := NewS3Storage(bucket, "/")
+	db, err := NewWithStorage(storage, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	before := time.Now().Add(-time.Hour)
+	var times []time.Time
+	for _, v := range []string{"v1", "v2"} {
+		bld, err := NewBuilder("part")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bld.Put([]byte("b"), []byte("k"), []byte(v))
+		err = bld.Commit(db, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, time.Now())
+		//S3 timestamps have second granularity
+		time.Sleep(1100 * time.Millisecond)
+	}
+	versions, err := storage.ListVersions("part")
+	if err != nil || len(versions) != 2 || !versions[0].Latest || versions[1].Latest {
+		t.Fatalf("unexpected versions %+v %v", versions, err)
+	}
+	read := func(at time.Time) string {
+		var v string
+		err := db.ViewAt("part", at, func(tx *bolt.Tx) error {
+			v = string(tx.Bucket([]byte("b")).Get([]byte("k")))
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return v
+	}
+	if v := read(times[0]); v != "v1" {
+		t.Errorf("expected v1, got %q", v)
+	}
+	if v := read(times[1]); v != "v2" {
+		t.Errorf("expected v2, got %q", v)
+	}
+	if v := read(before); v != "" {
+		t.Errorf("expected nothing, got %q", v)
+	}
+	hits := db.Stats().Hits
+	if v := read(times[0]); v != "v1" || db.Stats().Hits != hits+1 {
+		t.Errorf("expected cached v1, got %q %+v", v, db.Stats())
+	}
+	//Versions are immutable, CheckExpiry leaves them alone
+	report := db.CheckExpiry()
+	if len(report.Expired)+len(report.Deleted)+len(report.Unchanged) != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	v, err := db.Get("part", []byte("b"), []byte("k"))
+	if err != nil || string(v) != "v2" {
+		t.Errorf("expected v2, got %s %v", v, err)
+	}
+	//Deleted partitions read as missing from then on
+	err = db.DeletePart("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := time.Now()
+	versions, err = storage.ListVersions("part")
+	if err != nil || len(versions) != 3 || !versions[0].DeleteMarker || !versions[0].Latest || versions[1].DeleteMarker {
+		t.Fatalf("unexpected versions %+v %v", versions, err)
+	}
+	if v := read(deleted); v != "" {
+		t.Errorf("expected nothing, got %q", v)
+	}
+	if v := read(times[1]); v != "v2" {
+		t.Errorf("expected v2, got %q", v)
+	}
+}
+
+//countingtransport counts round trips
+type countingtransport struct {
+	n int32
+}
+
+func (ct *countingtransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.n, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestVersionsClient(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewS3Storage(bucket, "/")
+	ct := &countingtransport{}
+	storage.SetHTTPClient(&http.Client{Transport: ct})
+	tf := gettmpfile(t)
+	defer os.Remove(tf)
+	ioutil.WriteFile(tf, []byte("hello"), 0600)
+	err = storage.Put("part", tf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := storage.ListVersions("part")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("unexpected versions %+v %v", versions, err)
+	}
+	attempts := storage.Stats().Attempts
+	fname, found, _, _, err := storage.GetVersion("part", versions[0].VersionID)
+	if err != nil || !found {
+		t.Fatalf("expected found, got %v %v", found, err)
+	}
+	os.Remove(fname)
+	_, found, _, _, err = storage.GetVersion("part", "nosuchversion")
+	if err != nil || found {
+		t.Errorf("expected not found, got %v %v", found, err)
+	}
+	if n := atomic.LoadInt32(&ct.n); n != 3 {
+		t.Errorf("expected 3 requests through the client, got %v", n)
+	}
+	if a := storage.Stats().Attempts; a != attempts+2 {
+		t.Errorf("expected 2 more attempts, got %v", a-attempts)
+	}
+}
+
+func TestViewAtNotSupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infreqdb-versions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewWithStorage(fs, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.ViewAt("part", time.Now(), func(tx *bolt.Tx) error { return nil })
+	if errors.Cause(err) != ErrVersionsNotSupported {
+		t.Errorf("expected ErrVersionsNotSupported, got %v", err)
+	}
+}
+
+func TestViewAtDeltas(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10, WithDeltas(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k"), []byte("base"))
+	err = bld.Commit(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []time.Time
+	for _, v := range []string{"d1", "d2"} {
+		times = append(times, time.Now())
+		//S3 timestamps have second granularity
+		time.Sleep(1100 * time.Millisecond)
+		d := db.NewDelta("part")
+		d.Put([]byte("b"), []byte("k"), []byte(v))
+		err = d.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	times = append(times, time.Now())
+	read := func(at time.Time) string {
+		var v string
+		err := db.ViewAt("part", at, func(tx *bolt.Tx) error {
+			v = string(tx.Bucket([]byte("b")).Get([]byte("k")))
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return v
+	}
+	//Concurrent readers share a single load
+	loads := db.Stats().Loads
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v := read(times[2]); v != "d2" {
+				t.Errorf("expected d2, got %q", v)
+			}
+		}()
+	}
+	wg.Wait()
+	//The version as stored, then with the deltas
+	if n := db.Stats().Loads - loads; n != 2 {
+		t.Errorf("expected 2 loads, got %v", n)
+	}
+	for i, expected := range []string{"base", "d1", "d2"} {
+		if v := read(times[i]); v != expected {
+			t.Errorf("expected %s at %v, got %q", expected, times[i], v)
+		}
+	}
+
+}
+
+func TestViewAtEngine(t *testing.T) {
+	bucket, err := getmockbucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewWithStorage(NewS3Storage(bucket, "/"), 10, WithEngines(BoltEngine, BBoltEngine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bld, err := NewBuilder("part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bld.Put([]byte("b"), []byte("k"), []byte("v"))
+	err = bld.Commit(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCompactor(db)
+	c.Engine = BBoltEngine
+	res, err := c.Compact("part")
+	if err != nil || !res.Uploaded {
+		t.Fatalf("expected a bbolt file, got %+v %v", res, err)
+	}
+	//Opened with the recorded engine, not the first one recognizing the file, and View needs bolt
+	err = db.ViewAt("part", time.Now(), func(tx *bolt.Tx) error { return nil })
+	if errors.Cause(err) != ErrNotBolt {
+		t.Errorf("expected ErrNotBolt, got %v", err)
+	}
+	//Like View, versions are only read by the owner
+	cluster := NewCluster("http://a", []string{"http://a", "http://b"}, 1)
+	db.cluster = cluster
+	defer func() { db.cluster = nil }()
+	other := "part"
+	for i := 0; cluster.IsOwner(other); i++ {
+		other = fmt.Sprint("part", i)
+	}
+	err = db.ViewAt(other, time.Now(), func(tx *bolt.Tx) error { return nil })
+	if _, ok := err.(*NotOwnerError); !ok {
+		t.Errorf("expected NotOwnerError, got %v", err)
+	}
+}